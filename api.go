@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,7 +16,6 @@ import (
 	"github.com/docopt/docopt-go"
 	"github.com/fiatjaf/lntxbot/t"
 	"github.com/gorilla/mux"
-	"gopkg.in/antage/eventsource.v1"
 )
 
 type Permission int
@@ -26,13 +26,14 @@ const (
 	ReadOnlyPermissions            = 3
 )
 
-// for now the API is a superset of bluewallet/lndhub APIs, most basic methods are there
-// maybe later we'll have a better API
+// the unversioned API is a superset of bluewallet/lndhub APIs and is kept for
+// compatibility, new clients should use /api/v2 (see apiv2.go)
 
 func registerAPIMethods() {
 	registerBluewalletMethods()
+	registerAPIv2Methods()
 
-	router.Path("/generatelnurlwithdraw").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Path("/generatelnurlwithdraw").Handler(idempotent(func(w http.ResponseWriter, r *http.Request) {
 		ctx, _, permission, err := loadUserFromAPICall(r)
 		if err != nil {
 			errorBadAuth(w)
@@ -52,10 +53,22 @@ func registerAPIMethods() {
 			return
 		}
 
-		lnurlEncoded := handleCreateLNURLWithdraw(ctx, docopt.Opts{
-			"<satoshis>": params.Satoshis,
-		})
+		opts := docopt.Opts{"<satoshis>": params.Satoshis}
+		msats, err := parseSatoshis(opts)
+		if err != nil {
+			errorInvalidParams(w)
+			return
+		}
+
+		// whoever has the voucher can take the money, so it counts as a payment
+		if err := checkAPIKeySpending(ctx, msats); err != nil {
+			errorPaymentFailed(w, err)
+			return
+		}
+
+		lnurlEncoded := handleCreateLNURLWithdraw(ctx, opts)
 		if lnurlEncoded == "" {
+			releaseAPIKeySpending(ctx, msats)
 			errorInvalidParams(w)
 			return
 		}
@@ -64,8 +77,157 @@ func registerAPIMethods() {
 		json.NewEncoder(w).Encode(struct {
 			LNURL string `json:"lnurl"`
 		}{lnurlEncoded})
+	}))
+
+	router.Path("/invoicewebhook").Handler(idempotent(func(w http.ResponseWriter, r *http.Request) {
+		_, user, permission, err := loadUserFromAPICall(r)
+		if err != nil {
+			errorBadAuth(w)
+			return
+		}
+
+		var settings UserWebhookSettings
+		if err := user.getAppData("webhook", &settings); err != nil {
+			errorInternal(w)
+			return
+		}
+
+		if r.Method == "POST" {
+			if permission < FullPermissions {
+				errorInsufficientPermissions(w)
+				return
+			}
+
+			var params struct {
+				URL string `json:"url"`
+			}
+			err = json.NewDecoder(r.Body).Decode(&params)
+			if err != nil || (params.URL != "" && !isValidWebhookURL(params.URL)) {
+				errorInvalidParams(w)
+				return
+			}
+
+			settings.InvoiceWebhook = params.URL
+			if err := user.setAppData("webhook", settings); err != nil {
+				errorInternal(w)
+				return
+			}
+		} else if permission < ReadOnlyPermissions {
+			errorInsufficientPermissions(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			URL string `json:"url"`
+		}{settings.InvoiceWebhook})
+	}))
+
+	router.Path("/webhooks").Handler(idempotent(func(w http.ResponseWriter, r *http.Request) {
+		_, user, permission, err := loadUserFromAPICall(r)
+		if err != nil {
+			errorBadAuth(w)
+			return
+		}
+
+		if r.Method == "POST" {
+			if permission < FullPermissions {
+				errorInsufficientPermissions(w)
+				return
+			}
+
+			var params struct {
+				URL    string   `json:"url"`
+				Events []string `json:"events"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+				errorInvalidParams(w)
+				return
+			}
+			hook, err := user.addWebhook(params.URL, params.Events)
+			if err != nil {
+				errorInvalidParams(w)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(hook)
+			return
+		}
+
+		if permission < ReadOnlyPermissions {
+			errorInsufficientPermissions(w)
+			return
+		}
+
+		hooks, err := user.listWebhooks()
+		if err != nil {
+			errorInternal(w)
+			return
+		}
+		if hooks == nil {
+			hooks = []UserWebhook{}
+		}
+
+		res := map[string]interface{}{"webhooks": hooks}
+		if permission >= FullPermissions {
+			res["secret"] = hex.EncodeToString(user.webhookSecret())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}))
+
+	router.Path("/webhooks/deliveries").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, user, permission, err := loadUserFromAPICall(r)
+		if err != nil {
+			errorBadAuth(w)
+			return
+		}
+		if permission < ReadOnlyPermissions {
+			errorInsufficientPermissions(w)
+			return
+		}
+
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > 500 {
+			limit = 50
+		}
+
+		deliveries, err := user.listWebhookDeliveries(limit)
+		if err != nil {
+			errorInternal(w)
+			return
+		}
+		if deliveries == nil {
+			deliveries = []WebhookDelivery{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deliveries)
 	})
 
+	router.Path("/webhooks/{id:[0-9]+}").Methods("DELETE").Handler(idempotent(func(w http.ResponseWriter, r *http.Request) {
+		_, user, permission, err := loadUserFromAPICall(r)
+		if err != nil {
+			errorBadAuth(w)
+			return
+		}
+		if permission < FullPermissions {
+			errorInsufficientPermissions(w)
+			return
+		}
+
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+		if err := user.removeWebhook(id); err != nil {
+			errorInvalidParams(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+	}))
+
 	router.Path("/invoicestatus/{hash}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, user, permission, err := loadUserFromAPICall(r)
 		if err != nil {
@@ -167,46 +329,31 @@ func registerAPIMethods() {
 			return
 		}
 
-		var es eventsource.EventSource
-		if ies, ok := userPaymentStream.Get(strconv.Itoa(user.Id)); ok {
-			es = ies.(eventsource.EventSource)
-		} else {
-			es = eventsource.New(
-				&eventsource.Settings{
-					Timeout:        5 * time.Second,
-					CloseOnTimeout: true,
-					IdleTimeout:    1 * time.Minute,
-				},
-				func(r *http.Request) [][]byte {
-					return [][]byte{
-						[]byte("X-Accel-Buffering: no"),
-						[]byte("Cache-Control: no-cache"),
-						[]byte("Content-Type: text/event-stream"),
-						[]byte("Connection: keep-alive"),
-						[]byte("Access-Control-Allow-Origin: *"),
-					}
-				},
-			)
-			userPaymentStream.Set(strconv.Itoa(user.Id), es)
-			go func() {
-				for {
-					time.Sleep(25 * time.Second)
-					es.SendEventMessage("", "keepalive", "")
-				}
-			}()
-		}
-
-		go func() {
-			time.Sleep(100 * time.Millisecond)
-			es.SendRetryMessage(3 * time.Second)
-		}()
-
-		es.ServeHTTP(w, r)
+		servePaymentStream(w, r, user)
 	})
 }
 
+// apiCallAuth is the result of authenticating an API call, kept on the request
+// context so it is only done once.
+type apiCallAuth struct {
+	ctx        context.Context
+	user       *User
+	permission Permission
+}
+
+const apiCallAuthKey = "apiauth"
+
 func loadUserFromAPICall(
 	r *http.Request,
+) (ctx context.Context, user *User, permission Permission, err error) {
+	if auth, ok := r.Context().Value(apiCallAuthKey).(apiCallAuth); ok {
+		return auth.ctx, auth.user, auth.permission, nil
+	}
+	return authenticateAPICall(r)
+}
+
+func authenticateAPICall(
+	r *http.Request,
 ) (ctx context.Context, user *User, permission Permission, err error) {
 	ctx = context.WithValue(context.Background(), "origin", "api")
 
@@ -255,6 +402,15 @@ func loadUserFromAPICall(
 		return
 	}
 
+	// named api keys
+	if strings.HasPrefix(password, apiKeySecretPrefix) {
+		if key, errK := loadAPIKey(user.Id, password); errK == nil {
+			permission = key.Permission
+			ctx = context.WithValue(ctx, "apikey", &key)
+			return
+		}
+	}
+
 	err = errors.New("invalid password")
 	return
 }
@@ -326,6 +482,8 @@ func handleAPI(ctx context.Context, opts docopt.Opts) {
 	tokenReadOnly := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", u.Id, passwordReadOnly)))
 
 	switch {
+	case opts["keys"].(bool), opts["key"].(bool):
+		handleAPIKeys(ctx, opts)
 	case opts["full"].(bool):
 		send(ctx, qrURL(tokenFull), tokenFull)
 	case opts["invoice"].(bool):
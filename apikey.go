@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/lntxbot/t"
+	"github.com/lib/pq"
+)
+
+// APIKey is a named credential with its own scope and spending limits.
+// keys are given to clients as base64("<account id>:<secret>"), just like the
+// legacy tokens, and put on the context as "apikey" when used.
+type APIKey struct {
+	Id                  int            `db:"id"`
+	AccountId           int            `db:"account_id"`
+	Name                string         `db:"name"`
+	SecretHash          string         `db:"secret_hash"`
+	Permission          Permission     `db:"permission"`
+	MaxPaymentMsat      sql.NullInt64  `db:"max_payment_msat"`
+	DailyBudgetMsat     sql.NullInt64  `db:"daily_budget_msat"`
+	AllowedDestinations pq.StringArray `db:"allowed_destinations"`
+	CreatedAt           time.Time      `db:"created_at"`
+	LastUsedAt          *time.Time     `db:"last_used_at"`
+	RevokedAt           *time.Time     `db:"revoked_at"`
+}
+
+const apiKeySecretPrefix = "k_"
+
+var (
+	ErrAPIKeyPaymentLimit  = errors.New("Payment is above this API key's limit.")
+	ErrAPIKeyDailyBudget   = errors.New("This API key's daily budget is exhausted.")
+	ErrAPIKeyDestination   = errors.New("This API key can't pay to this destination.")
+	ErrInvalidAPIKeyScope  = errors.New("Scope must be one of full, invoice or readonly.")
+	ErrAPIKeyNameNotUnique = errors.New("There's already a key with this name.")
+)
+
+func (k APIKey) Scope() string {
+	return k.Permission.Scope()
+}
+
+func (p Permission) Scope() string {
+	switch {
+	case p >= FullPermissions:
+		return "full"
+	case p >= InvoicePermissions:
+		return "invoice"
+	default:
+		return "readonly"
+	}
+}
+
+func permissionFromScope(scope string) (Permission, error) {
+	switch scope {
+	case "full", "":
+		return FullPermissions, nil
+	case "invoice":
+		return InvoicePermissions, nil
+	case "readonly":
+		return ReadOnlyPermissions, nil
+	default:
+		return 0, ErrInvalidAPIKeyScope
+	}
+}
+
+func hashAPIKeySecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func (u User) createAPIKey(
+	name string,
+	permission Permission,
+	maxPaymentMsat int64,
+	dailyBudgetMsat int64,
+	destinations []string,
+) (key APIKey, token string, err error) {
+	random := make([]byte, 24)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	secret := apiKeySecretPrefix + hex.EncodeToString(random)
+
+	var allowed pq.StringArray
+	if len(destinations) > 0 {
+		allowed = pq.StringArray(destinations)
+	}
+
+	err = pg.Get(&key, `
+INSERT INTO api_key
+  (account_id, name, secret_hash, permission,
+   max_payment_msat, daily_budget_msat, allowed_destinations)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING *
+    `, u.Id, name, hashAPIKeySecret(secret), permission,
+		sql.NullInt64{Int64: maxPaymentMsat, Valid: maxPaymentMsat > 0},
+		sql.NullInt64{Int64: dailyBudgetMsat, Valid: dailyBudgetMsat > 0},
+		allowed)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+			err = ErrAPIKeyNameNotUnique
+		}
+		return
+	}
+
+	token = base64.StdEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%d:%s", u.Id, secret)))
+	return
+}
+
+func (u User) listAPIKeys() (keys []APIKey, err error) {
+	err = pg.Select(&keys, `
+SELECT * FROM api_key
+WHERE account_id = $1 AND revoked_at IS NULL
+ORDER BY id
+    `, u.Id)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (u User) revokeAPIKey(name string) error {
+	res, err := pg.Exec(`
+UPDATE api_key SET revoked_at = now()
+WHERE account_id = $1 AND name = $2 AND revoked_at IS NULL
+    `, u.Id, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func loadAPIKey(userId int, secret string) (key APIKey, err error) {
+	err = pg.Get(&key, `
+SELECT * FROM api_key
+WHERE account_id = $1 AND secret_hash = $2 AND revoked_at IS NULL
+    `, userId, hashAPIKeySecret(secret))
+	if err != nil {
+		return
+	}
+
+	go pg.Exec(`UPDATE api_key SET last_used_at = now() WHERE id = $1`, key.Id)
+	return
+}
+
+// checkAPIKeySpending enforces the limits of the API key used on this call,
+// if any. destinations are the ways the receiver can be identified.
+// the amount is reserved from the daily budget here, callers give it back with
+// releaseAPIKeySpending when the payment doesn't go out, or hand it over to
+// trackAPIKeySpending when it goes out and may still fail.
+func checkAPIKeySpending(ctx context.Context, msatoshi int64, destinations ...string) error {
+	key, ok := ctx.Value("apikey").(*APIKey)
+	if !ok {
+		return nil
+	}
+
+	if key.MaxPaymentMsat.Valid && msatoshi > key.MaxPaymentMsat.Int64 {
+		return ErrAPIKeyPaymentLimit
+	}
+
+	if len(key.AllowedDestinations) > 0 {
+		allowed := false
+		for _, allowedDestination := range key.AllowedDestinations {
+			for _, destination := range destinations {
+				if destination != "" && strings.EqualFold(
+					strings.TrimPrefix(allowedDestination, "@"),
+					strings.TrimPrefix(destination, "@"),
+				) {
+					allowed = true
+				}
+			}
+		}
+		if !allowed {
+			return ErrAPIKeyDestination
+		}
+	}
+
+	if key.DailyBudgetMsat.Valid {
+		rkey := key.budgetKey()
+		spent, err := rds.IncrBy(rkey, msatoshi).Result()
+		if err != nil {
+			return err
+		}
+		rds.Expire(rkey, 48*time.Hour)
+		if spent > key.DailyBudgetMsat.Int64 {
+			rds.DecrBy(rkey, msatoshi)
+			return ErrAPIKeyDailyBudget
+		}
+	}
+
+	return nil
+}
+
+func releaseAPIKeySpending(ctx context.Context, msatoshi int64) {
+	if key, ok := ctx.Value("apikey").(*APIKey); ok && key.DailyBudgetMsat.Valid {
+		rds.DecrBy(key.budgetKey(), msatoshi)
+	}
+}
+
+// trackAPIKeySpending remembers what an outgoing payment has reserved so
+// paymentHasFailed can give it back with releaseAPIKeySpendingFor.
+func trackAPIKeySpending(ctx context.Context, hash string, msatoshi int64) {
+	if key, ok := ctx.Value("apikey").(*APIKey); ok && key.DailyBudgetMsat.Valid {
+		rds.Set("apikey:payment:"+hash,
+			fmt.Sprintf("%d %s", msatoshi, key.budgetKey()), 48*time.Hour)
+	}
+}
+
+func releaseAPIKeySpendingFor(hash string) {
+	releaseReservedSpending("apikey:payment:" + hash)
+}
+
+// releaseReservedSpending gives back an amount saved as "<msatoshi> <budget key>".
+func releaseReservedSpending(rkey string) {
+	reserved := strings.SplitN(rds.Get(rkey).Val(), " ", 2)
+	if len(reserved) != 2 {
+		return
+	}
+	msatoshi, err := strconv.ParseInt(reserved[0], 10, 64)
+	if err != nil {
+		return
+	}
+
+	// only whoever deletes it gives the amount back
+	if rds.Del(rkey).Val() == 1 {
+		rds.DecrBy(reserved[1], msatoshi)
+	}
+}
+
+func (k APIKey) budgetKey() string {
+	return fmt.Sprintf("apikey:spent:%d:%s", k.Id, time.Now().UTC().Format("2006-01-02"))
+}
+
+func handleAPIKeys(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+
+	switch {
+	case opts["create"].(bool):
+		name, _ := opts.String("<keyname>")
+		scope, _ := opts.String("--scope")
+		permission, err := permissionFromScope(scope)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		var maxPayment, dailyBudget int64
+		if v, ok := opts["--max-payment"].(string); ok {
+			msats, err := parseAmountString(v)
+			if err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": "invalid --max-payment."})
+				return
+			}
+			maxPayment = msats
+		}
+		if v, ok := opts["--daily"].(string); ok {
+			msats, err := parseAmountString(v)
+			if err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": "invalid --daily."})
+				return
+			}
+			dailyBudget = msats
+		}
+
+		var destinations []string
+		if v, ok := opts["--destinations"].(string); ok {
+			for _, destination := range strings.Split(v, ",") {
+				if destination = strings.TrimSpace(destination); destination != "" {
+					destinations = append(destinations, destination)
+				}
+			}
+		}
+
+		key, token, err := u.createAPIKey(name, permission,
+			maxPayment, dailyBudget, destinations)
+		if err != nil {
+			log.Warn().Err(err).Stringer("user", u).Msg("failed to create api key")
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.APIKEYCREATED, t.T{"Key": key, "Token": token})
+		send(ctx, qrURL(token), "<code>"+token+"</code>")
+	case opts["revoke"].(bool):
+		name, _ := opts.String("<keyname>")
+		if err := u.revokeAPIKey(name); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": "key not found."})
+			return
+		}
+		send(ctx, t.COMPLETED)
+	default:
+		keys, err := u.listAPIKeys()
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, u, t.APIKEYLIST, t.T{"Keys": keys})
+	}
+}
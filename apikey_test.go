@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestAPIKeySpending(t *testing.T) {
+	setupTestRedis(t)
+
+	key := &APIKey{
+		Id:              4242,
+		MaxPaymentMsat:  sql.NullInt64{Int64: 50000, Valid: true},
+		DailyBudgetMsat: sql.NullInt64{Int64: 100000, Valid: true},
+	}
+	rds.Del(key.budgetKey())
+	ctx := context.WithValue(context.Background(), "apikey", key)
+	spent := func() int64 {
+		v, _ := rds.Get(key.budgetKey()).Int64()
+		return v
+	}
+
+	if err := checkAPIKeySpending(context.Background(), 1000000000); err != nil {
+		t.Errorf("calls without a key have no limits: %s", err)
+	}
+	if err := checkAPIKeySpending(ctx, 60000); err != ErrAPIKeyPaymentLimit {
+		t.Errorf("expected the payment limit, got %v", err)
+	}
+
+	// reserved and then given back on a synchronous error
+	if err := checkAPIKeySpending(ctx, 40000); err != nil {
+		t.Fatal(err)
+	}
+	if spent() != 40000 {
+		t.Errorf("spent %d", spent())
+	}
+	releaseAPIKeySpending(ctx, 40000)
+	if spent() != 0 {
+		t.Errorf("spent %d after releasing", spent())
+	}
+
+	// reserved for a payment that fails later, given back only once
+	for _, hash := range []string{"aa", "bb"} {
+		if err := checkAPIKeySpending(ctx, 50000); err != nil {
+			t.Fatal(err)
+		}
+		trackAPIKeySpending(ctx, hash, 50000)
+	}
+	if err := checkAPIKeySpending(ctx, 1000); err != ErrAPIKeyDailyBudget {
+		t.Errorf("expected the budget to be exhausted, got %v", err)
+	}
+	releaseAPIKeySpendingFor("aa")
+	releaseAPIKeySpendingFor("aa")
+	releaseAPIKeySpendingFor("unknown")
+	if spent() != 50000 {
+		t.Errorf("spent %d after a failure", spent())
+	}
+
+	// keys restricted to some destinations can't pay to nowhere in particular
+	key.AllowedDestinations = pq.StringArray{"@fiatjaf"}
+	if err := checkAPIKeySpending(ctx, 1000); err != ErrAPIKeyDestination {
+		t.Errorf("expected the destination to be rejected, got %v", err)
+	}
+	if err := checkAPIKeySpending(ctx, 1000, "FiatJaf"); err != nil {
+		t.Errorf("destination should be allowed: %s", err)
+	}
+}
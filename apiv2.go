@@ -0,0 +1,1121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/go-lnurl"
+	decodepay "github.com/fiatjaf/ln-decodepay"
+	"github.com/gorilla/mux"
+	"gopkg.in/jmcvetta/napping.v3"
+)
+
+// APIError is the single error format of /api/v2:
+// {"error": {"code": "...", "message": "..."}} with a matching http status.
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string { return e.Message }
+
+func apiError(status int, code string, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+var (
+	APIErrBadAuth           = apiError(401, "bad_auth", "Invalid or missing credentials.")
+	APIErrPermission        = apiError(403, "insufficient_permissions", "Insufficient permissions.")
+	APIErrNotFound          = apiError(404, "not_found", "Not found.")
+	APIErrInvalidBody       = apiError(400, "invalid_body", "Request body must be valid JSON.")
+	APIErrInternal          = apiError(500, "internal", "Internal failure.")
+	APIErrUnsupportedLNURL  = apiError(400, "unsupported_lnurl", "Unsupported lnurl.")
+	APIErrInvalidAmount     = apiError(400, "invalid_amount", ErrInvalidAmount.Error())
+	APIErrInsufficientFunds = apiError(400, "insufficient_balance", ErrInsufficientBalance.Error())
+)
+
+func apiInvalidParam(param string) *APIError {
+	return apiError(400, "invalid_param", fmt.Sprintf("Invalid '%s'.", param))
+}
+
+// apiErrorFrom translates errors from user operations into API errors.
+func apiErrorFrom(err error, code string) *APIError {
+	switch err {
+	case ErrInsufficientBalance:
+		return APIErrInsufficientFunds
+	case ErrInvalidAmount:
+		return APIErrInvalidAmount
+	case ErrDatabase:
+		return APIErrInternal
+	case ErrAPIKeyPaymentLimit, ErrAPIKeyDailyBudget, ErrAPIKeyDestination:
+		return apiError(403, "api_key_limit", err.Error())
+	}
+	if lnurlerr, ok := err.(lnurl.LNURLErrorResponse); ok {
+		return apiError(400, "lnurl_error", lnurlerr.Reason)
+	}
+	return apiError(400, code, err.Error())
+}
+
+func writeAPIError(w http.ResponseWriter, err *APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(struct {
+		Error *APIError `json:"error"`
+	}{err})
+}
+
+type apiV2Handler func(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError)
+
+// apiV2Route describes an endpoint both for the router and for the OpenAPI
+// document, so they can't get out of sync.
+type apiV2Route struct {
+	Method     string
+	Path       string
+	Summary    string
+	Permission Permission
+	Query      []apiV2Param
+	Request    interface{}
+	Response   interface{}
+	Handler    apiV2Handler
+}
+
+type apiV2Param struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+func registerAPIv2Methods() {
+	v2 := router.PathPrefix("/api/v2").Subrouter()
+
+	for _, route := range apiV2Routes() {
+		route := route
+		handler := http.Handler(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				ctx, user, permission, err := loadUserFromAPICall(r)
+				if err != nil {
+					writeAPIError(w, APIErrBadAuth)
+					return
+				}
+				if permission < route.Permission {
+					writeAPIError(w, APIErrPermission)
+					return
+				}
+
+				res, apierr := route.Handler(ctx, user, r)
+				if apierr != nil {
+					writeAPIError(w, apierr)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(res)
+			}))
+		if route.Method != "GET" {
+			handler = idempotencyMiddleware(handler)
+		}
+		v2.Path(route.Path).Methods(route.Method).Handler(handler)
+	}
+
+	v2.Path("/openapi.json").Methods("GET").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(generateOpenAPIDocument(apiV2Routes()))
+		})
+
+	v2.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, APIErrNotFound)
+	})
+}
+
+func apiV2Routes() []apiV2Route {
+	return []apiV2Route{
+		{
+			Method:     "GET",
+			Path:       "/balance",
+			Summary:    "Get the account balance",
+			Permission: ReadOnlyPermissions,
+			Response:   APIBalance{},
+			Handler:    apiV2GetBalance,
+		},
+		{
+			Method:     "GET",
+			Path:       "/balance/tags",
+			Summary:    "Get the balance spent and earned on each bot app",
+			Permission: ReadOnlyPermissions,
+			Response:   []APITaggedBalance{},
+			Handler:    apiV2GetTaggedBalances,
+		},
+		{
+			Method:     "GET",
+			Path:       "/transactions",
+			Summary:    "List transactions, newest first",
+			Permission: ReadOnlyPermissions,
+			Query: []apiV2Param{
+				{"limit", "integer", "Page size, at most 500. Defaults to 50."},
+				{"offset", "integer", "How many transactions to skip."},
+				{"direction", "string", "Either 'in' or 'out'."},
+				{"status", "string", "One of 'received', 'sent' or 'pending'."},
+				{"tag", "string", "Only transactions of this bot app."},
+				{"since", "integer", "Unix timestamp, inclusive."},
+				{"until", "integer", "Unix timestamp, exclusive."},
+			},
+			Response: APITransactionList{},
+			Handler:  apiV2ListTransactions,
+		},
+		{
+			Method:     "GET",
+			Path:       "/transactions/{hash}",
+			Summary:    "Get a transaction by payment hash",
+			Permission: ReadOnlyPermissions,
+			Response:   APITransaction{},
+			Handler:    apiV2GetTransaction,
+		},
+		{
+			Method:     "POST",
+			Path:       "/invoices",
+			Summary:    "Create an invoice",
+			Permission: InvoicePermissions,
+			Request:    APICreateInvoiceParams{},
+			Response:   APIInvoice{},
+			Handler:    apiV2CreateInvoice,
+		},
+		{
+			Method:     "GET",
+			Path:       "/invoices/{hash}",
+			Summary:    "Get the status of an invoice",
+			Permission: ReadOnlyPermissions,
+			Response:   APIInvoice{},
+			Handler:    apiV2GetInvoice,
+		},
+		{
+			Method:     "POST",
+			Path:       "/payments",
+			Summary:    "Pay a bolt11 invoice",
+			Permission: FullPermissions,
+			Request:    APIPayParams{},
+			Response:   APIPayment{},
+			Handler:    apiV2Pay,
+		},
+		{
+			Method:     "GET",
+			Path:       "/payments/{hash}",
+			Summary:    "Get the status of an outgoing payment",
+			Permission: ReadOnlyPermissions,
+			Response:   APIPayment{},
+			Handler:    apiV2GetPayment,
+		},
+		{
+			Method:     "POST",
+			Path:       "/send",
+			Summary:    "Send to another lntxbot user by Telegram username or account id",
+			Permission: FullPermissions,
+			Request:    APISendParams{},
+			Response:   APIPayment{},
+			Handler:    apiV2Send,
+		},
+		{
+			Method:     "GET",
+			Path:       "/decode",
+			Summary:    "Parse a bolt11 invoice, lnurl, lightning address, lightning: or bitcoin: URI",
+			Permission: ReadOnlyPermissions,
+			Query: []apiV2Param{
+				{"q", "string", "The text or QR code contents to parse."},
+			},
+			Response: APIPaymentRequest{},
+			Handler:  apiV2DecodePaymentRequest,
+		},
+		{
+			Method:     "GET",
+			Path:       "/lnurl",
+			Summary:    "Fetch and describe an lnurl or lightning address",
+			Permission: ReadOnlyPermissions,
+			Query: []apiV2Param{
+				{"q", "string", "The bech32 lnurl, lnurl URL or lightning address."},
+			},
+			Response: APILNURLInfo{},
+			Handler:  apiV2DescribeLNURL,
+		},
+		{
+			Method:     "POST",
+			Path:       "/lnurl/pay",
+			Summary:    "Pay an lnurl-pay code or lightning address",
+			Permission: FullPermissions,
+			Request:    APILNURLPayParams{},
+			Response:   APIPayment{},
+			Handler:    apiV2LNURLPay,
+		},
+		{
+			Method:     "POST",
+			Path:       "/lnurl/withdraw",
+			Summary:    "Withdraw from an lnurl-withdraw code into this account",
+			Permission: InvoicePermissions,
+			Request:    APILNURLWithdrawParams{},
+			Response:   APIInvoice{},
+			Handler:    apiV2LNURLWithdraw,
+		},
+		{
+			Method:     "POST",
+			Path:       "/lnurl/auth",
+			Summary:    "Log in to an lnurl-auth service",
+			Permission: FullPermissions,
+			Request:    APILNURLParams{},
+			Response:   APILNURLAuthResult{},
+			Handler:    apiV2LNURLAuth,
+		},
+		{
+			Method:     "POST",
+			Path:       "/lnaddress/pay",
+			Summary:    "Pay a lightning address in msatoshis or an amount like 10usd",
+			Permission: FullPermissions,
+			Request:    APILightningAddressPayParams{},
+			Response:   APIPayment{},
+			Handler:    apiV2LightningAddressPay,
+		},
+		{
+			Method:     "GET",
+			Path:       "/lnaddress/settings",
+			Summary:    "Get the settings of this account's lightning address",
+			Permission: ReadOnlyPermissions,
+			Response:   APILightningAddressSettings{},
+			Handler:    apiV2GetLightningAddressSettings,
+		},
+		{
+			Method:     "POST",
+			Path:       "/lnaddress/settings",
+			Summary:    "Change the settings of this account's lightning address, omitted fields are kept",
+			Permission: FullPermissions,
+			Request:    APILightningAddressSettingsParams{},
+			Response:   APILightningAddressSettings{},
+			Handler:    apiV2SetLightningAddressSettings,
+		},
+	}
+}
+
+func decodeAPIBody(r *http.Request, params interface{}) *APIError {
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return APIErrInvalidBody
+	}
+	return nil
+}
+
+func apiPaymentHashParam(r *http.Request) (string, *APIError) {
+	hash := strings.ToLower(mux.Vars(r)["hash"])
+	if len(hash) != 64 {
+		return "", apiInvalidParam("hash")
+	}
+	return hash, nil
+}
+
+// balance
+
+type APIBalance struct {
+	BalanceMsat       int64 `json:"balance_msat"`
+	UsableBalanceMsat int64 `json:"usable_balance_msat"`
+	TotalSentMsat     int64 `json:"total_sent_msat"`
+	TotalReceivedMsat int64 `json:"total_received_msat"`
+	TotalFeesMsat     int64 `json:"total_fees_msat"`
+}
+
+type APITaggedBalance struct {
+	Tag         string `json:"tag"`
+	BalanceMsat int64  `json:"balance_msat"`
+}
+
+func apiV2GetBalance(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	info, err := user.getInfo()
+	if err != nil {
+		return nil, APIErrInternal
+	}
+
+	return APIBalance{
+		BalanceMsat:       info.BalanceMsat,
+		UsableBalanceMsat: int64(info.UsableBalance * 1000),
+		TotalSentMsat:     int64(info.TotalSent * 1000),
+		TotalReceivedMsat: int64(info.TotalReceived * 1000),
+		TotalFeesMsat:     int64(info.TotalFees * 1000),
+	}, nil
+}
+
+func apiV2GetTaggedBalances(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	balances, err := user.getTaggedBalances()
+	if err != nil {
+		return nil, APIErrInternal
+	}
+
+	res := make([]APITaggedBalance, len(balances))
+	for i, b := range balances {
+		res[i] = APITaggedBalance{Tag: b.Tag, BalanceMsat: int64(b.Balance * 1000)}
+	}
+	return res, nil
+}
+
+// transactions
+
+type APITransaction struct {
+	Time        time.Time `json:"time" db:"time"`
+	Status      string    `json:"status" db:"status"`
+	AmountMsat  int64     `json:"amount_msat" db:"amount"`
+	FeeMsat     int64     `json:"fee_msat" db:"fees"`
+	PaymentHash string    `json:"payment_hash" db:"payment_hash"`
+	Preimage    *string   `json:"preimage" db:"preimage"`
+	Description string    `json:"description" db:"description"`
+	Tag         *string   `json:"tag" db:"tag"`
+	Peer        *string   `json:"telegram_peer" db:"telegram_peer"`
+	Anonymous   bool      `json:"anonymous" db:"anonymous"`
+	Payee       *string   `json:"payee_node" db:"payee_node"`
+}
+
+type APITransactionList struct {
+	Transactions []APITransaction `json:"transactions"`
+	Limit        int              `json:"limit"`
+	Offset       int              `json:"offset"`
+	NextOffset   *int             `json:"next_offset"`
+}
+
+func apiV2ListTransactions(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	qs := r.URL.Query()
+
+	var filter TransactionFilter
+	var invalid string
+	filter.Limit, filter.Offset, invalid = getLimitAndOffset(r)
+	if invalid != "" {
+		return nil, apiInvalidParam(invalid)
+	}
+
+	switch qs.Get("direction") {
+	case "":
+		filter.Direction = Both
+	case "in":
+		filter.Direction = In
+	case "out":
+		filter.Direction = Out
+	default:
+		return nil, apiInvalidParam("direction")
+	}
+
+	switch status := qs.Get("status"); status {
+	case "", "received", "sent", "pending":
+		filter.Status = strings.ToUpper(status)
+	default:
+		return nil, apiInvalidParam("status")
+	}
+
+	filter.Tag = qs.Get("tag")
+
+	for param, target := range map[string]**time.Time{
+		"since": &filter.Since,
+		"until": &filter.Until,
+	} {
+		if v := qs.Get(param); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, apiInvalidParam(param)
+			}
+			at := time.Unix(ts, 0)
+			*target = &at
+		}
+	}
+
+	txns, err := user.listTransactionsFiltered(filter)
+	if err != nil {
+		log.Warn().Err(err).Stringer("user", user).Msg("failed to list api transactions")
+		return nil, APIErrInternal
+	}
+
+	res := APITransactionList{Transactions: txns, Limit: filter.Limit, Offset: filter.Offset}
+	if len(txns) == filter.Limit {
+		next := filter.Offset + filter.Limit
+		res.NextOffset = &next
+	}
+	return res, nil
+}
+
+func apiV2GetTransaction(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	hash, apierr := apiPaymentHashParam(r)
+	if apierr != nil {
+		return nil, apierr
+	}
+
+	var txn APITransaction
+	err := pg.Get(&txn, `
+SELECT
+  time,
+  status,
+  amount::bigint AS amount,
+  fees::bigint AS fees,
+  payment_hash,
+  preimage,
+  coalesce(description, '') AS description,
+  tag,
+  telegram_peer,
+  anonymous,
+  payee_node
+FROM lightning.account_txn
+WHERE account_id = $1 AND payment_hash = $2
+    `, user.Id, hash)
+	if err != nil {
+		return nil, APIErrNotFound
+	}
+	return txn, nil
+}
+
+// invoices
+
+type APICreateInvoiceParams struct {
+	AmountMsat      int64  `json:"amount_msat"`
+	Description     string `json:"description"`
+	DescriptionHash string `json:"description_hash,omitempty"`
+	ExpirySeconds   int64  `json:"expiry,omitempty"`
+}
+
+type APIInvoice struct {
+	Bolt11      string     `json:"bolt11,omitempty"`
+	PaymentHash string     `json:"payment_hash"`
+	AmountMsat  int64      `json:"amount_msat"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+func apiV2CreateInvoice(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	var params APICreateInvoiceParams
+	if apierr := decodeAPIBody(r, &params); apierr != nil {
+		return nil, apierr
+	}
+	if params.AmountMsat < 0 {
+		return nil, apiInvalidParam("amount_msat")
+	}
+	if params.DescriptionHash != "" && len(params.DescriptionHash) != 64 {
+		return nil, apiInvalidParam("description_hash")
+	}
+
+	args := &MakeInvoiceArgs{
+		Msatoshi:        params.AmountMsat,
+		Description:     params.Description,
+		DescriptionHash: params.DescriptionHash,
+	}
+	if params.ExpirySeconds > 0 {
+		expiry := time.Duration(params.ExpirySeconds) * time.Second
+		args.Expiry = &expiry
+	}
+
+	bolt11, hash, err := user.makeInvoice(ctx, args)
+	if err != nil {
+		return nil, apiErrorFrom(err, "invoice_failed")
+	}
+
+	expiresAt := time.Now().Add(*args.Expiry)
+	return APIInvoice{
+		Bolt11:      bolt11,
+		PaymentHash: hash,
+		AmountMsat:  params.AmountMsat,
+		Description: params.Description,
+		Status:      "pending",
+		ExpiresAt:   &expiresAt,
+	}, nil
+}
+
+func apiV2GetInvoice(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	hash, apierr := apiPaymentHashParam(r)
+	if apierr != nil {
+		return nil, apierr
+	}
+
+	var inv struct {
+		Msatoshi    int64     `db:"msatoshi"`
+		Description string    `db:"description"`
+		CreatedAt   time.Time `db:"created_at"`
+		ExpiresAt   time.Time `db:"expires_at"`
+		Paid        bool      `db:"paid"`
+		Received    *int64    `db:"received"`
+	}
+	err := pg.Get(&inv, `
+SELECT
+  i.msatoshi::bigint AS msatoshi,
+  coalesce(i.description, '') AS description,
+  i.created_at,
+  i.expires_at,
+  t.amount IS NOT NULL AS paid,
+  t.amount::bigint AS received
+FROM lightning.invoice AS i
+LEFT JOIN lightning.transaction AS t
+  ON t.payment_hash = i.payment_hash AND t.to_id = i.account_id
+WHERE i.account_id = $1 AND i.payment_hash = $2
+    `, user.Id, hash)
+	if err != nil {
+		return nil, APIErrNotFound
+	}
+
+	res := APIInvoice{
+		PaymentHash: hash,
+		AmountMsat:  inv.Msatoshi,
+		Description: inv.Description,
+		CreatedAt:   &inv.CreatedAt,
+		ExpiresAt:   &inv.ExpiresAt,
+	}
+	switch {
+	case inv.Paid:
+		res.Status = "paid"
+		res.AmountMsat = *inv.Received
+	case inv.ExpiresAt.Before(time.Now()):
+		res.Status = "expired"
+	default:
+		res.Status = "pending"
+	}
+	return res, nil
+}
+
+// payments
+
+type APIPayParams struct {
+	Bolt11     string `json:"bolt11"`
+	AmountMsat int64  `json:"amount_msat,omitempty"`
+}
+
+type APIPayment struct {
+	PaymentHash   string               `json:"payment_hash"`
+	Status        string               `json:"status"`
+	AmountMsat    int64                `json:"amount_msat"`
+	FeeMsat       int64                `json:"fee_msat"`
+	Preimage      string               `json:"preimage,omitempty"`
+	SuccessAction *lnurl.SuccessAction `json:"success_action,omitempty"`
+}
+
+// apiPaymentResult reports the state of an outgoing payment, waiting a little
+// for it to settle if it's still pending.
+func apiPaymentResult(user *User, hash string, wait time.Duration) APIPayment {
+	res := loadAPIPayment(user, hash)
+	if res.Status == "pending" && wait > 0 {
+		select {
+		case <-waitPaymentSuccess(hash):
+		case <-time.After(wait):
+		}
+		res = loadAPIPayment(user, hash)
+	}
+	return res
+}
+
+func loadAPIPayment(user *User, hash string) APIPayment {
+	res := APIPayment{PaymentHash: hash, Status: "pending"}
+
+	var txn APITransaction
+	err := pg.Get(&txn, `
+SELECT status, amount::bigint AS amount, fees::bigint AS fees, preimage
+FROM lightning.account_txn
+WHERE account_id = $1 AND payment_hash = $2 AND amount < 0
+    `, user.Id, hash)
+	if err != nil {
+		// failed payments are deleted
+		res.Status = "failed"
+		return res
+	}
+
+	res.AmountMsat = -txn.AmountMsat
+	res.FeeMsat = txn.FeeMsat
+	if txn.Status == "SENT" {
+		res.Status = "complete"
+		if txn.Preimage != nil {
+			res.Preimage = *txn.Preimage
+		}
+	}
+	return res
+}
+
+func apiV2Pay(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	var params APIPayParams
+	if apierr := decodeAPIBody(r, &params); apierr != nil {
+		return nil, apierr
+	}
+	if req, ok := parsePaymentRequest(params.Bolt11); ok && req.Bolt11 != "" {
+		params.Bolt11 = req.Bolt11
+	}
+	if _, err := decodepay.Decodepay(params.Bolt11); err != nil {
+		return nil, apiInvalidParam("bolt11")
+	}
+
+	hash, err := user.payInvoice(ctx, params.Bolt11, params.AmountMsat)
+	if err != nil {
+		return nil, apiErrorFrom(err, "payment_failed")
+	}
+
+	return apiPaymentResult(user, hash, 10*time.Second), nil
+}
+
+func apiV2GetPayment(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	hash, apierr := apiPaymentHashParam(r)
+	if apierr != nil {
+		return nil, apierr
+	}
+
+	return apiPaymentResult(user, hash, 0), nil
+}
+
+type APIPaymentRequest struct {
+	Kind             string `json:"kind"`
+	Bolt11           string `json:"bolt11,omitempty"`
+	LNURL            string `json:"lnurl,omitempty"`
+	LightningAddress string `json:"lightning_address,omitempty"`
+	OnchainAddress   string `json:"onchain_address,omitempty"`
+	AmountMsat       int64  `json:"amount_msat,omitempty"`
+	Description      string `json:"description,omitempty"`
+}
+
+func apiV2DecodePaymentRequest(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	req, ok := parsePaymentRequest(r.URL.Query().Get("q"))
+	if !ok {
+		return nil, apiInvalidParam("q")
+	}
+
+	res := APIPaymentRequest{
+		Kind:             req.Kind(),
+		Bolt11:           req.Bolt11,
+		LNURL:            req.LNURL,
+		LightningAddress: req.Address,
+		OnchainAddress:   req.Onchain,
+		AmountMsat:       req.AmountMsat,
+		Description:      req.Message,
+	}
+	if res.Description == "" {
+		res.Description = req.Label
+	}
+
+	if req.Bolt11 != "" {
+		inv, err := decodepay.Decodepay(req.Bolt11)
+		if err != nil {
+			return nil, apiInvalidParam("q")
+		}
+		res.AmountMsat = inv.MSatoshi
+		res.Description = inv.Description
+	}
+
+	return res, nil
+}
+
+// internal sends
+
+type APISendParams struct {
+	Username    string `json:"username,omitempty"`
+	AccountId   int    `json:"account_id,omitempty"`
+	AmountMsat  int64  `json:"amount_msat"`
+	Description string `json:"description,omitempty"`
+	Anonymous   bool   `json:"anonymous,omitempty"`
+}
+
+func apiV2Send(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	var params APISendParams
+	if apierr := decodeAPIBody(r, &params); apierr != nil {
+		return nil, apierr
+	}
+	if params.AmountMsat <= 0 {
+		return nil, APIErrInvalidAmount
+	}
+
+	var (
+		receiver *User
+		err      error
+	)
+	switch {
+	case params.Username != "" && params.AccountId != 0:
+		return nil, apiError(400, "invalid_param",
+			"Provide either 'username' or 'account_id', not both.")
+	case params.Username != "":
+		receiver, err = examineTelegramUsername(
+			"@" + strings.TrimPrefix(params.Username, "@"))
+		if err != nil {
+			return nil, apiInvalidParam("username")
+		}
+	case params.AccountId != 0:
+		receiver, err = loadUser(params.AccountId)
+		if err != nil {
+			return nil, apiInvalidParam("account_id")
+		}
+	default:
+		return nil, apiError(400, "invalid_param", "Missing 'username' or 'account_id'.")
+	}
+
+	// retries are handled by idempotencyMiddleware
+	hash, err := randomHex()
+	if err != nil {
+		return nil, APIErrInternal
+	}
+
+	fees := int64(float64(params.AmountMsat) * 0.003)
+	err = user.sendInternally(ctx, receiver, params.Anonymous,
+		params.AmountMsat, fees, params.Description, hash, "")
+	if err != nil {
+		log.Warn().Err(err).Str("from", user.Username).
+			Str("to", receiver.Username).Msg("failed to send through the api")
+		return nil, apiErrorFrom(err, "send_failed")
+	}
+
+	go user.track("api send", map[string]interface{}{"sats": params.AmountMsat / 1000})
+	notifyInternalSendReceiver(ctx, nil, user, receiver,
+		params.AmountMsat, "", params.Anonymous)
+
+	return APIPayment{
+		PaymentHash: hash,
+		Status:      "complete",
+		AmountMsat:  params.AmountMsat,
+		FeeMsat:     fees,
+	}, nil
+}
+
+// lnurl
+
+type APILNURLParams struct {
+	LNURL string `json:"lnurl"`
+}
+
+type APILNURLInfo struct {
+	Kind             string `json:"kind"`
+	Domain           string `json:"domain"`
+	MinMsat          int64  `json:"min_msat,omitempty"`
+	MaxMsat          int64  `json:"max_msat,omitempty"`
+	Description      string `json:"description,omitempty"`
+	CommentAllowed   int64  `json:"comment_allowed,omitempty"`
+	LightningAddress string `json:"lightning_address,omitempty"`
+}
+
+type APILNURLPayParams struct {
+	LNURL      string `json:"lnurl"`
+	AmountMsat int64  `json:"amount_msat"`
+	Comment    string `json:"comment,omitempty"`
+}
+
+// APILightningAddressPayParams takes either amount_msat or amount.
+type APILightningAddressPayParams struct {
+	Address    string `json:"address"`
+	AmountMsat int64  `json:"amount_msat,omitempty"`
+	Amount     string `json:"amount,omitempty"` // satoshis or an expression like "10usd"
+	Comment    string `json:"comment,omitempty"`
+	Anonymous  bool   `json:"anonymous,omitempty"`
+}
+
+type APILNURLWithdrawParams struct {
+	LNURL      string `json:"lnurl"`
+	AmountMsat int64  `json:"amount_msat,omitempty"`
+}
+
+type APILNURLAuthResult struct {
+	Domain string `json:"domain"`
+	Key    string `json:"key"`
+}
+
+func fetchLNURLParams(lnurltext string) (lnurl.LNURLParams, *APIError) {
+	if lnurltext == "" {
+		return nil, apiInvalidParam("lnurl")
+	}
+	if req, ok := parsePaymentRequest(lnurltext); ok && req.Bolt11 == "" {
+		lnurltext = req.String()
+	}
+
+	_, params, err := lnurl.HandleLNURL(lnurltext)
+	if err != nil {
+		if lnurlerr, ok := err.(lnurl.LNURLErrorResponse); ok {
+			return nil, apiError(400, "lnurl_error", lnurlerr.Reason)
+		}
+		return nil, apiError(400, "lnurl_unreachable",
+			fmt.Sprintf("Failed to fetch lnurl params: %s", err.Error()))
+	}
+	return params, nil
+}
+
+func apiV2DescribeLNURL(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	iparams, apierr := fetchLNURLParams(r.URL.Query().Get("q"))
+	if apierr != nil {
+		return nil, apierr
+	}
+
+	info := APILNURLInfo{Kind: iparams.LNURLKind()}
+	switch params := iparams.(type) {
+	case lnurl.LNURLPayParams:
+		info.Domain = params.CallbackURL().Hostname()
+		info.MinMsat = params.MinSendable
+		info.MaxMsat = params.MaxSendable
+		info.Description = params.Metadata.Description
+		info.CommentAllowed = params.CommentAllowed
+		info.LightningAddress = params.Metadata.LightningAddress
+	case lnurl.LNURLWithdrawResponse:
+		info.Domain = params.CallbackURL.Hostname()
+		info.MinMsat = params.MinWithdrawable
+		info.MaxMsat = params.MaxWithdrawable
+		info.Description = params.DefaultDescription
+	case lnurl.LNURLAuthParams:
+		info.Domain = params.Host
+	default:
+		return nil, APIErrUnsupportedLNURL
+	}
+	return info, nil
+}
+
+func apiLNURLPay(
+	ctx context.Context,
+	user *User,
+	lnurltext string,
+	msats int64,
+	comment string,
+	anonymous bool,
+) (interface{}, *APIError) {
+	iparams, apierr := fetchLNURLParams(lnurltext)
+	if apierr != nil {
+		return nil, apierr
+	}
+	params, ok := iparams.(lnurl.LNURLPayParams)
+	if !ok {
+		return nil, APIErrUnsupportedLNURL
+	}
+
+	if msats < params.MinSendable || msats > params.MaxSendable {
+		return nil, apiError(400, "invalid_amount", fmt.Sprintf(
+			"Amount must be between %d and %d msat.",
+			params.MinSendable, params.MaxSendable))
+	}
+	comment = truncateLNURLComment(comment, params.CommentAllowed)
+
+	payerdata, _, err := lnurlPayerData(user, params, anonymous)
+	if err != nil {
+		return nil, APIErrInternal
+	}
+
+	res, err := params.Call(msats, comment, payerdata)
+	if err != nil {
+		return nil, apiErrorFrom(err, "lnurl_error")
+	}
+	if payerdata != nil && payerdata.KeyAuth != nil {
+		go user.recordLNURLAuth(params.CallbackURL().Hostname(), payerdata.KeyAuth.Key, "payerdata")
+	}
+
+	hash, err := user.payInvoice(ctx, res.PR, 0)
+	if err != nil {
+		return nil, apiErrorFrom(err, "payment_failed")
+	}
+
+	payment := apiPaymentResult(user, hash, 10*time.Second)
+	payment.SuccessAction = res.SuccessAction
+	return payment, nil
+}
+
+func apiV2LNURLPay(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	var params APILNURLPayParams
+	if apierr := decodeAPIBody(r, &params); apierr != nil {
+		return nil, apierr
+	}
+
+	return apiLNURLPay(ctx, user, params.LNURL, params.AmountMsat, params.Comment, false)
+}
+
+func apiV2LightningAddressPay(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	var params APILightningAddressPayParams
+	if apierr := decodeAPIBody(r, &params); apierr != nil {
+		return nil, apierr
+	}
+	if _, _, ok := lnurl.ParseInternetIdentifier(params.Address); !ok {
+		return nil, apiInvalidParam("address")
+	}
+
+	msats := params.AmountMsat
+	if params.Amount != "" {
+		if msats != 0 {
+			return nil, apiInvalidParam("amount")
+		}
+		var err error
+		if msats, err = parseAmountString(params.Amount); err != nil {
+			return nil, apiInvalidParam("amount")
+		}
+	}
+
+	return apiLNURLPay(ctx, user, params.Address, msats, params.Comment, params.Anonymous)
+}
+
+func apiV2LNURLWithdraw(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	var body APILNURLWithdrawParams
+	if apierr := decodeAPIBody(r, &body); apierr != nil {
+		return nil, apierr
+	}
+
+	iparams, apierr := fetchLNURLParams(body.LNURL)
+	if apierr != nil {
+		return nil, apierr
+	}
+	params, ok := iparams.(lnurl.LNURLWithdrawResponse)
+	if !ok {
+		return nil, APIErrUnsupportedLNURL
+	}
+
+	msats := body.AmountMsat
+	if msats == 0 {
+		msats = params.MaxWithdrawable
+	}
+	if msats <= 0 || msats < params.MinWithdrawable || msats > params.MaxWithdrawable {
+		return nil, apiError(400, "invalid_amount", fmt.Sprintf(
+			"Amount must be between %d and %d msat.",
+			params.MinWithdrawable, params.MaxWithdrawable))
+	}
+
+	bolt11, hash, err := user.makeInvoice(ctx, &MakeInvoiceArgs{
+		Msatoshi:    msats,
+		Description: params.DefaultDescription,
+	})
+	if err != nil {
+		return nil, apiErrorFrom(err, "invoice_failed")
+	}
+
+	var sentinvres lnurl.LNURLResponse
+	_, err = napping.Get(params.Callback, &url.Values{
+		"k1": {params.K1},
+		"pr": {bolt11},
+	}, &sentinvres, &sentinvres)
+	if err != nil {
+		return nil, apiError(400, "lnurl_unreachable", err.Error())
+	}
+	if sentinvres.Status == "ERROR" {
+		return nil, apiError(400, "lnurl_error", sentinvres.Reason)
+	}
+
+	go user.track("lnurl-withdraw", map[string]interface{}{"sats": msats / 1000})
+
+	return APIInvoice{
+		Bolt11:      bolt11,
+		PaymentHash: hash,
+		AmountMsat:  msats,
+		Description: params.DefaultDescription,
+		Status:      "pending",
+	}, nil
+}
+
+func apiV2LNURLAuth(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	var body APILNURLParams
+	if apierr := decodeAPIBody(r, &body); apierr != nil {
+		return nil, apierr
+	}
+
+	iparams, apierr := fetchLNURLParams(body.LNURL)
+	if apierr != nil {
+		return nil, apierr
+	}
+	params, ok := iparams.(lnurl.LNURLAuthParams)
+	if !ok {
+		return nil, APIErrUnsupportedLNURL
+	}
+	if user.isLNURLAuthBlocked(params.Host) {
+		return nil, apiError(403, "lnurl_auth_blocked", ErrLNURLAuthBlocked.Error())
+	}
+
+	key, sig, err := user.SignKeyAuth(params.Host, params.K1)
+	if err != nil {
+		return nil, APIErrInternal
+	}
+
+	var sentsigres lnurl.LNURLResponse
+	_, err = napping.Get(params.Callback, &url.Values{
+		"key": {key},
+		"sig": {sig},
+	}, &sentsigres, &sentsigres)
+	if err != nil {
+		return nil, apiError(400, "lnurl_unreachable", err.Error())
+	}
+	if sentsigres.Status == "ERROR" {
+		return nil, apiError(400, "lnurl_error", sentsigres.Reason)
+	}
+
+	go user.recordLNURLAuth(params.Host, key, "api")
+	go user.track("lnurl-auth", map[string]interface{}{"domain": params.Host})
+
+	return APILNURLAuthResult{Domain: params.Host, Key: key}, nil
+}
+
+type APILightningAddressSettings struct {
+	MinSendableMsat int64             `json:"min_sendable_msat"`
+	MaxSendableMsat int64             `json:"max_sendable_msat"`
+	CommentAllowed  int64             `json:"comment_allowed"`
+	Description     string            `json:"description"`
+	HasImage        bool              `json:"has_image"`
+	PayerData       map[string]string `json:"payer_data"`
+}
+
+type APILightningAddressSettingsParams struct {
+	MinSendableMsat *int64            `json:"min_sendable_msat"`
+	MaxSendableMsat *int64            `json:"max_sendable_msat"`
+	CommentAllowed  *int64            `json:"comment_allowed"`
+	Description     *string           `json:"description"`
+	ImageURL        *string           `json:"image_url"` // empty removes the image
+	PayerData       map[string]string `json:"payer_data,omitempty"`
+}
+
+func apiLightningAddressSettings(settings LightningAddressSettings) APILightningAddressSettings {
+	return APILightningAddressSettings{
+		MinSendableMsat: settings.minSendable(),
+		MaxSendableMsat: settings.maxSendable(),
+		CommentAllowed:  settings.commentAllowed(),
+		Description:     settings.Description,
+		HasImage:        settings.Image != nil,
+		PayerData:       settings.payerDataModes(),
+	}
+}
+
+func apiV2GetLightningAddressSettings(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	settings, err := user.getLightningAddressSettings()
+	if err != nil {
+		return nil, APIErrInternal
+	}
+	return apiLightningAddressSettings(settings), nil
+}
+
+func apiV2SetLightningAddressSettings(ctx context.Context, user *User, r *http.Request) (interface{}, *APIError) {
+	var params APILightningAddressSettingsParams
+	if apierr := decodeAPIBody(r, &params); apierr != nil {
+		return nil, apierr
+	}
+
+	settings, err := user.getLightningAddressSettings()
+	if err != nil {
+		return nil, APIErrInternal
+	}
+
+	if params.MinSendableMsat != nil {
+		settings.MinSendable = *params.MinSendableMsat
+	}
+	if params.MaxSendableMsat != nil {
+		settings.MaxSendable = *params.MaxSendableMsat
+	}
+	if params.CommentAllowed != nil {
+		settings.CommentAllowed = params.CommentAllowed
+	}
+	if params.Description != nil {
+		settings.Description = *params.Description
+	}
+	if params.ImageURL != nil {
+		settings.Image = nil
+		if *params.ImageURL != "" {
+			b, err := imageBytesFromURL(*params.ImageURL)
+			if err != nil {
+				return nil, apiInvalidParam("image_url")
+			}
+			settings.Image = b
+		}
+	}
+	for field, mode := range params.PayerData {
+		if settings.PayerData == nil {
+			settings.PayerData = make(map[string]string)
+		}
+		settings.PayerData[field] = mode
+	}
+
+	if err := settings.validate(); err != nil {
+		return nil, apiError(400, "invalid_settings", err.Error())
+	}
+	if err := user.setLightningAddressSettings(settings); err != nil {
+		return nil, APIErrInternal
+	}
+
+	return apiLightningAddressSettings(settings), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// LightningBackend is whatever node we use to actually send and receive
+// lightning payments. all payment flows go through this, never to a node directly.
+type LightningBackend interface {
+	Start() error
+	GetInfo() (NodeInfo, error)
+	CreateInvoice(params CreateInvoiceParams) (CreateInvoiceResult, error)
+	PayInvoice(bolt11 string, msatoshi int64) error
+	CheckPayment(hash string) (PaymentStatus, error)
+
+	// raw node-specific commands, used only by the admin
+	Call(method string, params map[string]interface{}) (json.RawMessage, error)
+
+	IncomingPayments() <-chan IncomingPayment
+	PaymentSuccesses() <-chan PaymentSuccess
+	PaymentFailures() <-chan PaymentFailure
+}
+
+// InvoiceLister is implemented by backends that can list the invoices they
+// have settled, so we can credit payments we may have missed.
+type InvoiceLister interface {
+	ListSettledInvoices(since time.Time) ([]IncomingPayment, error)
+}
+
+var ErrUnsupportedCall = errors.New("method not supported by this lightning backend")
+
+type NodeInfo struct {
+	Pubkey      string
+	BlockHeight int
+	Channels    int
+}
+
+type CreateInvoiceParams struct {
+	Msatoshi          int64
+	Preimage          string
+	Description       string
+	DescriptionHash   string
+	HashedDescription string // the text behind DescriptionHash, if known
+	Label             string
+	Expiry            time.Duration
+}
+
+type CreateInvoiceResult struct {
+	Invoice     string
+	PaymentHash string
+}
+
+const (
+	PaymentPending  = "pending"
+	PaymentComplete = "complete"
+	PaymentFailed   = "failed"
+)
+
+type PaymentStatus struct {
+	Status      string
+	IsIncoming  bool
+	Msatoshi    int64
+	FeeMsatoshi int64
+	Preimage    string
+}
+
+type IncomingPayment struct {
+	PaymentHash string
+	Preimage    string
+	Msatoshi    int64
+	PaidAt      time.Time // zero or the epoch when unknown, taken as now
+}
+
+type PaymentSuccess struct {
+	PaymentHash string
+	Preimage    string
+	Msatoshi    int64
+	FeeMsatoshi int64
+}
+
+type PaymentFailure struct {
+	PaymentHash string
+	Failure     []string
+}
+
+func setupLightningBackend() {
+	switch s.LightningBackend {
+	case "cliche":
+		ln = newClicheBackend()
+	case "lnd":
+		ln = newLNDBackend()
+	case "cln":
+		ln = newCLNBackend()
+	case "fake":
+		ln = newFakeBackend()
+		connectRelay = connectMemoryRelay
+		swaps = newFakeSwapProvider()
+	default:
+		log.Fatal().Str("backend", s.LightningBackend).Msg("unknown lightning backend")
+	}
+
+	log.Info().Str("backend", s.LightningBackend).Msg("starting lightning backend")
+	if err := ln.Start(); err != nil {
+		log.Fatal().Err(err).Msg("failed to start lightning backend")
+	}
+
+	if nodeinfo, err := ln.GetInfo(); err != nil {
+		log.Fatal().Err(err).Msg("can't talk to lightning backend")
+	} else {
+		log.Info().
+			Str("pubkey", nodeinfo.Pubkey).
+			Int("blockHeight", nodeinfo.BlockHeight).
+			Int("channels", nodeinfo.Channels).
+			Msg("lightning backend connected")
+	}
+}
+
+func handleBackendEvents() {
+	ctx := context.WithValue(context.Background(), "origin", "backend")
+
+	go func() {
+		for event := range ln.IncomingPayments() {
+			go paymentReceived(ctx, event.PaymentHash, event.Msatoshi, event.PaidAt)
+		}
+	}()
+
+	go func() {
+		for event := range ln.PaymentSuccesses() {
+			go paymentHasSucceeded(
+				ctx,
+				event.Msatoshi,
+				event.FeeMsatoshi,
+				event.Preimage,
+				"",
+				event.PaymentHash,
+			)
+		}
+	}()
+
+	go func() {
+		for event := range ln.PaymentFailures() {
+			go paymentHasFailed(ctx, event.PaymentHash, event.Failure)
+		}
+	}()
+}
+
+func backendCheckingRoutine() {
+	ctx := context.Background()
+
+	for {
+		time.Sleep(5 * time.Minute)
+
+		select {
+		case err := <-backendPing():
+			if err != nil {
+				log.Error().Err(err).Msg("lightning backend ping returned error")
+				break
+			} else {
+				log.Debug().Msg("lightning backend is fine")
+				continue
+			}
+		case <-time.After(3 * time.Minute):
+			log.Error().Msg("lightning backend is not responding after 3 minutes")
+			break
+		}
+
+		// message admin
+		if admin, err := loadUser(s.AdminAccount); err == nil {
+			send(ctx, admin, "lightning backend has failed, bot restarting")
+		}
+
+		// exit with a failure so systemd can restart us
+		os.Exit(7)
+	}
+}
+
+func backendPing() chan error {
+	ch := make(chan error)
+	go func() {
+		_, err := ln.GetInfo()
+		ch <- err
+	}()
+	return ch
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CLNBackend talks to a Core Lightning node through its lightning-rpc unix socket.
+type CLNBackend struct {
+	socketPath string
+	nextId     uint64
+
+	incoming  chan IncomingPayment
+	successes chan PaymentSuccess
+	failures  chan PaymentFailure
+}
+
+func newCLNBackend() *CLNBackend {
+	if s.CLNSocketPath == "" {
+		log.Fatal().Msg("CLN_SOCKET_PATH is required for the cln backend")
+	}
+
+	return &CLNBackend{
+		socketPath: s.CLNSocketPath,
+		incoming:   make(chan IncomingPayment),
+		successes:  make(chan PaymentSuccess),
+		failures:   make(chan PaymentFailure),
+	}
+}
+
+// clnMsat accepts both the old "1000msat" strings and plain integers.
+type clnMsat int64
+
+func (m *clnMsat) UnmarshalJSON(b []byte) error {
+	str := strings.TrimSuffix(strings.Trim(string(b), `"`), "msat")
+	if str == "null" || str == "" {
+		*m = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid msat amount %s: %w", string(b), err)
+	}
+	*m = clnMsat(v)
+	return nil
+}
+
+type clnError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func (e clnError) Error() string {
+	return fmt.Sprintf("cln error %d: %s", e.Code, e.Message)
+}
+
+type clnInvoice struct {
+	Label              string  `json:"label"`
+	PaymentHash        string  `json:"payment_hash"`
+	Status             string  `json:"status"`
+	AmountMsat         clnMsat `json:"amount_msat"`
+	AmountReceivedMsat clnMsat `json:"amount_received_msat"`
+	PaymentPreimage    string  `json:"payment_preimage"`
+	PayIndex           uint64  `json:"pay_index"`
+	PaidAt             int64   `json:"paid_at"`
+	UpdatedIndex       uint64  `json:"updated_index"`
+}
+
+func (c *CLNBackend) Call(method string, params map[string]interface{}) (json.RawMessage, error) {
+	conn, err := net.Dial("unix", c.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to cln socket: %w", err)
+	}
+	defer conn.Close()
+
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	id := atomic.AddUint64(&c.nextId, 1)
+	if err := json.NewEncoder(conn).Encode(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  method,
+		"params":  params,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to write to cln socket: %w", err)
+	}
+
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *clnError       `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read from cln socket: %w", err)
+	}
+	if resp.Error != nil {
+		return nil, *resp.Error
+	}
+	return resp.Result, nil
+}
+
+func (c *CLNBackend) call(method string, params map[string]interface{}, result interface{}) error {
+	res, err := c.Call(method, params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(res, result)
+}
+
+func (c *CLNBackend) Start() error {
+	go c.waitInvoices()
+	return nil
+}
+
+func (c *CLNBackend) GetInfo() (NodeInfo, error) {
+	var info struct {
+		Id                 string `json:"id"`
+		Blockheight        int    `json:"blockheight"`
+		NumActiveChannels  int    `json:"num_active_channels"`
+		NumPendingChannels int    `json:"num_pending_channels"`
+	}
+	if err := c.call("getinfo", nil, &info); err != nil {
+		return NodeInfo{}, err
+	}
+	return NodeInfo{
+		Pubkey:      info.Id,
+		BlockHeight: info.Blockheight,
+		Channels:    info.NumActiveChannels,
+	}, nil
+}
+
+func (c *CLNBackend) CreateInvoice(params CreateInvoiceParams) (CreateInvoiceResult, error) {
+	preimage, err := hex.DecodeString(params.Preimage)
+	if err != nil {
+		return CreateInvoiceResult{}, fmt.Errorf("invalid preimage: %w", err)
+	}
+	hash := sha256.Sum256(preimage)
+
+	var amount interface{} = "any"
+	if params.Msatoshi > 0 {
+		amount = params.Msatoshi
+	}
+
+	// labels must be unique on cln
+	p := map[string]interface{}{
+		"amount_msat": amount,
+		"label":       params.Label + ":" + hex.EncodeToString(hash[:]),
+		"description": params.Description,
+		"preimage":    params.Preimage,
+	}
+	if params.DescriptionHash != "" {
+		// cln can't take a raw hash, it must hash the description itself,
+		// which callers often give us along with its hash
+		text := params.HashedDescription
+		if text == "" {
+			dhash := sha256.Sum256([]byte(params.Description))
+			if hex.EncodeToString(dhash[:]) == strings.ToLower(params.DescriptionHash) {
+				text = params.Description
+			}
+		}
+		if text == "" {
+			return CreateInvoiceResult{},
+				errors.New("cln needs the full text behind a description_hash")
+		}
+		p["description"] = text
+		p["deschashonly"] = true
+	}
+	if params.Expiry > 0 {
+		p["expiry"] = int64(params.Expiry.Seconds())
+	}
+
+	var res struct {
+		Bolt11      string `json:"bolt11"`
+		PaymentHash string `json:"payment_hash"`
+	}
+	if err := c.call("invoice", p, &res); err != nil {
+		return CreateInvoiceResult{}, err
+	}
+
+	return CreateInvoiceResult{
+		Invoice:     res.Bolt11,
+		PaymentHash: res.PaymentHash,
+	}, nil
+}
+
+func (c *CLNBackend) PayInvoice(bolt11 string, msatoshi int64) error {
+	p := map[string]interface{}{"bolt11": bolt11}
+	if inv, err := decodeInvoiceAsLndHub(bolt11); err == nil && inv.NumSatoshis == "0" {
+		p["amount_msat"] = msatoshi
+	}
+
+	// 'pay' only returns when the payment is done, so we wait for it in the background
+	go func() {
+		var res struct {
+			PaymentHash     string  `json:"payment_hash"`
+			PaymentPreimage string  `json:"payment_preimage"`
+			AmountMsat      clnMsat `json:"amount_msat"`
+			AmountSentMsat  clnMsat `json:"amount_sent_msat"`
+			Status          string  `json:"status"`
+		}
+		err := c.call("pay", p, &res)
+		if err != nil {
+			hash := ""
+			if inv, errd := decodeInvoiceAsLndHub(bolt11); errd == nil {
+				hash = inv.PaymentHash
+			}
+
+			if cerr, ok := err.(clnError); ok && clnPayFailureCodes[cerr.Code] {
+				c.failures <- PaymentFailure{PaymentHash: hash, Failure: []string{err.Error()}}
+				return
+			}
+
+			// we don't know if the payment has gone out or not, so we ask cln
+			// about it and leave it pending if it can't tell us
+			log.Warn().Err(err).Str("hash", hash).Msg("cln pay returned no result")
+			c.resolvePayment(hash)
+			return
+		}
+
+		switch res.Status {
+		case "complete":
+			c.successes <- PaymentSuccess{
+				PaymentHash: res.PaymentHash,
+				Preimage:    res.PaymentPreimage,
+				Msatoshi:    int64(res.AmountMsat),
+				FeeMsatoshi: int64(res.AmountSentMsat - res.AmountMsat),
+			}
+		case "failed":
+			c.failures <- PaymentFailure{PaymentHash: res.PaymentHash}
+		}
+	}()
+
+	return nil
+}
+
+// clnPayFailureCodes are the 'pay' errors after which the payment is surely
+// not going to happen (see lightning-pay(7)). on any other error, including
+// "in progress" and "already paid", we must look at what cln has.
+var clnPayFailureCodes = map[int]bool{
+	-32602: true, // invalid parameters
+	203:    true, // permanent failure at destination
+	205:    true, // unable to find a route
+	206:    true, // route too expensive
+	207:    true, // invoice expired
+	210:    true, // payment timed out without a success
+}
+
+var clnPayCheckInterval = time.Second * 10
+
+// resolvePayment watches a payment on listpays until it is done. if that
+// doesn't happen soon the payment is left pending for the periodic checks.
+func (c *CLNBackend) resolvePayment(hash string) {
+	for i := 0; i < 60; i++ {
+		time.Sleep(clnPayCheckInterval)
+
+		pay, found, err := c.lookupPay(hash)
+		if err != nil || !found {
+			continue
+		}
+		switch pay.Status {
+		case "complete":
+			c.successes <- PaymentSuccess{
+				PaymentHash: hash,
+				Preimage:    pay.Preimage,
+				Msatoshi:    int64(pay.AmountMsat),
+				FeeMsatoshi: int64(pay.AmountSentMsat - pay.AmountMsat),
+			}
+			return
+		case "failed":
+			c.failures <- PaymentFailure{PaymentHash: hash}
+			return
+		}
+	}
+
+	log.Warn().Str("hash", hash).Msg("cln payment still unresolved, leaving it pending")
+}
+
+type clnPay struct {
+	Status         string  `json:"status"`
+	Preimage       string  `json:"preimage"`
+	AmountMsat     clnMsat `json:"amount_msat"`
+	AmountSentMsat clnMsat `json:"amount_sent_msat"`
+}
+
+func (c *CLNBackend) lookupPay(hash string) (pay clnPay, found bool, err error) {
+	var pays struct {
+		Pays []clnPay `json:"pays"`
+	}
+	if err := c.call("listpays",
+		map[string]interface{}{"payment_hash": hash}, &pays); err != nil {
+		return pay, false, err
+	}
+	if len(pays.Pays) == 0 {
+		return pay, false, nil
+	}
+	return pays.Pays[0], true, nil
+}
+
+func (c *CLNBackend) CheckPayment(hash string) (PaymentStatus, error) {
+	var invoices struct {
+		Invoices []clnInvoice `json:"invoices"`
+	}
+	if err := c.call("listinvoices",
+		map[string]interface{}{"payment_hash": hash}, &invoices); err != nil {
+		return PaymentStatus{}, err
+	}
+	if len(invoices.Invoices) > 0 {
+		inv := invoices.Invoices[0]
+		status := PaymentStatus{
+			IsIncoming: true,
+			Status:     PaymentPending,
+			Msatoshi:   int64(inv.AmountMsat),
+		}
+		switch inv.Status {
+		case "paid":
+			status.Status = PaymentComplete
+			status.Msatoshi = int64(inv.AmountReceivedMsat)
+			status.Preimage = inv.PaymentPreimage
+		case "expired":
+			status.Status = PaymentFailed
+		}
+		return status, nil
+	}
+
+	pay, found, err := c.lookupPay(hash)
+	if err != nil {
+		return PaymentStatus{}, err
+	}
+	if !found {
+		// cln doesn't know about it, so it has failed
+		return PaymentStatus{Status: PaymentFailed}, nil
+	}
+
+	status := PaymentStatus{
+		Status:      PaymentPending,
+		Msatoshi:    int64(pay.AmountMsat),
+		FeeMsatoshi: int64(pay.AmountSentMsat - pay.AmountMsat),
+		Preimage:    pay.Preimage,
+	}
+	switch pay.Status {
+	case "complete":
+		status.Status = PaymentComplete
+	case "failed":
+		status.Status = PaymentFailed
+	}
+	return status, nil
+}
+
+// ListSettledInvoices implements InvoiceLister. cln can't list invoices by
+// date, so this only goes through invoices paid or expired since the last call.
+func (c *CLNBackend) ListSettledInvoices(since time.Time) ([]IncomingPayment, error) {
+	var settled []IncomingPayment
+	err := c.walkUpdatedInvoices(func(inv clnInvoice) {
+		if inv.Status != "paid" || inv.PaidAt < since.Unix() {
+			return
+		}
+		settled = append(settled, IncomingPayment{
+			PaymentHash: inv.PaymentHash,
+			Preimage:    inv.PaymentPreimage,
+			Msatoshi:    int64(inv.AmountReceivedMsat),
+			PaidAt:      time.Unix(inv.PaidAt, 0),
+		})
+	})
+	return settled, err
+}
+
+const clnInvoicesPageSize = 500
+
+// walkUpdatedInvoices pages through the invoices updated after the last one
+// we've seen, keeping that position and the highest pay_index on redis.
+func (c *CLNBackend) walkUpdatedInvoices(each func(clnInvoice)) error {
+	updated, _ := rds.Get("cln:listedindex").Uint64()
+	payIndex, _ := rds.Get("cln:listedpayindex").Uint64()
+
+	for {
+		var page struct {
+			Invoices []clnInvoice `json:"invoices"`
+		}
+		if err := c.call("listinvoices", map[string]interface{}{
+			"index": "updated",
+			"start": updated + 1,
+			"limit": clnInvoicesPageSize,
+		}, &page); err != nil {
+			return err
+		}
+
+		for _, inv := range page.Invoices {
+			each(inv)
+			if inv.UpdatedIndex > updated {
+				updated = inv.UpdatedIndex
+			}
+			if inv.PayIndex > payIndex {
+				payIndex = inv.PayIndex
+			}
+		}
+		rds.Set("cln:listedindex", updated, 0)
+		rds.Set("cln:listedpayindex", payIndex, 0)
+
+		if len(page.Invoices) < clnInvoicesPageSize {
+			return nil
+		}
+	}
+}
+
+func (c *CLNBackend) waitInvoices() {
+	// we keep the last pay_index we've seen so we don't skip or repeat
+	// payments across restarts. when starting from scratch we begin after
+	// the last invoice paid so far, as the startup reconciliation has seen those.
+	params := map[string]interface{}{}
+	if lastPayIndex, err := rds.Get("cln:lastpayindex").Uint64(); err == nil {
+		params["lastpay_index"] = lastPayIndex
+	} else {
+		for {
+			lastPayIndex, err := c.lastPayIndex()
+			if err == nil {
+				params["lastpay_index"] = lastPayIndex
+				rds.Set("cln:lastpayindex", lastPayIndex, 0)
+				break
+			}
+			log.Warn().Err(err).Msg("failed to get the last cln pay_index")
+			time.Sleep(10 * time.Second)
+		}
+	}
+
+	for {
+		var inv clnInvoice
+		err := c.call("waitanyinvoice", params, &inv)
+		if err != nil {
+			log.Warn().Err(err).Msg("cln waitanyinvoice failed")
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		params["lastpay_index"] = inv.PayIndex
+		rds.Set("cln:lastpayindex", inv.PayIndex, 0)
+
+		if inv.Status != "paid" {
+			continue
+		}
+		c.incoming <- IncomingPayment{
+			PaymentHash: inv.PaymentHash,
+			Preimage:    inv.PaymentPreimage,
+			Msatoshi:    int64(inv.AmountReceivedMsat),
+			PaidAt:      time.Unix(inv.PaidAt, 0),
+		}
+	}
+}
+
+// lastPayIndex only goes through invoices updated since the last listing,
+// which at startup has just been done by the incoming payments check.
+func (c *CLNBackend) lastPayIndex() (uint64, error) {
+	if err := c.walkUpdatedInvoices(func(clnInvoice) {}); err != nil {
+		return 0, err
+	}
+	return rds.Get("cln:listedpayindex").Uint64()
+}
+
+func (c *CLNBackend) IncomingPayments() <-chan IncomingPayment { return c.incoming }
+func (c *CLNBackend) PaymentSuccesses() <-chan PaymentSuccess  { return c.successes }
+func (c *CLNBackend) PaymentFailures() <-chan PaymentFailure   { return c.failures }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubCLN listens on a unix socket like lightningd does and answers each
+// json-rpc call with whatever the test has set for that method.
+type stubCLN struct {
+	sync.Mutex
+
+	// a handler returns the result, an error or nil to hang up without answering
+	handlers map[string]func(params map[string]interface{}) interface{}
+	calls    map[string][]map[string]interface{}
+}
+
+func newStubCLN(t *testing.T) (*stubCLN, *CLNBackend) {
+	setupTestRedis(t)
+
+	dir, err := ioutil.TempDir("", "cln")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "lightning-rpc")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	stub := &stubCLN{
+		handlers: make(map[string]func(map[string]interface{}) interface{}),
+		calls:    make(map[string][]map[string]interface{}),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+
+	s.CLNSocketPath = socket
+	return stub, newCLNBackend()
+}
+
+func (stub *stubCLN) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var req struct {
+		Id     uint64                 `json:"id"`
+		Method string                 `json:"method"`
+		Params map[string]interface{} `json:"params"`
+	}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	stub.Lock()
+	stub.calls[req.Method] = append(stub.calls[req.Method], req.Params)
+	handler, ok := stub.handlers[req.Method]
+	stub.Unlock()
+
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.Id}
+	if !ok {
+		resp["error"] = clnError{Code: -32601, Message: "unknown method " + req.Method}
+	} else {
+		switch res := handler(req.Params).(type) {
+		case nil:
+			return
+		case clnError:
+			resp["error"] = res
+		default:
+			resp["result"] = res
+		}
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+func (stub *stubCLN) handle(method string, handler func(map[string]interface{}) interface{}) {
+	stub.Lock()
+	defer stub.Unlock()
+	stub.handlers[method] = handler
+}
+
+func (stub *stubCLN) lastCall(method string) map[string]interface{} {
+	stub.Lock()
+	defer stub.Unlock()
+	calls := stub.calls[method]
+	if len(calls) == 0 {
+		return nil
+	}
+	return calls[len(calls)-1]
+}
+
+// handleInvoices answers listinvoices by updated_index, the only way we list
+// them, giving each invoice the updated_index of its position.
+func (stub *stubCLN) handleInvoices(invoices []map[string]interface{}) {
+	for i, inv := range invoices {
+		inv["updated_index"] = i + 1
+	}
+	stub.handle("listinvoices", func(params map[string]interface{}) interface{} {
+		if params["index"] != "updated" {
+			return clnError{Code: -32602, Message: "unpaged listinvoices"}
+		}
+		start := int(params["start"].(float64))
+		limit := int(params["limit"].(float64))
+
+		page := []map[string]interface{}{}
+		for i := start - 1; i >= 0 && i < len(invoices) && len(page) < limit; i++ {
+			page = append(page, invoices[i])
+		}
+		return map[string]interface{}{"invoices": page}
+	})
+}
+
+func TestCLNBackendListSettledInvoices(t *testing.T) {
+	stub, c := newStubCLN(t)
+	rds.Del("cln:listedindex", "cln:listedpayindex")
+
+	now := time.Now().Unix()
+	var invoices []map[string]interface{}
+	for i := 0; i < clnInvoicesPageSize+10; i++ {
+		invoices = append(invoices, map[string]interface{}{
+			"payment_hash": fmt.Sprintf("%064x", i), "status": "paid",
+			"pay_index": i + 1, "paid_at": now - 60, "amount_received_msat": "1000msat",
+		})
+	}
+	invoices[0]["paid_at"] = now - 3600
+	invoices[1]["status"] = "expired"
+	stub.handleInvoices(invoices)
+
+	settled, err := c.ListSettledInvoices(time.Now().Add(-time.Minute * 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settled) != clnInvoicesPageSize+8 {
+		t.Errorf("got %d settled invoices", len(settled))
+	}
+	stub.Lock()
+	calls := len(stub.calls["listinvoices"])
+	stub.Unlock()
+	if calls != 2 {
+		t.Errorf("listed invoices in %d calls", calls)
+	}
+
+	// the next check only asks for what came after
+	settled, _ = c.ListSettledInvoices(time.Now().Add(-time.Minute * 30))
+	if len(settled) != 0 {
+		t.Errorf("got %d settled invoices again", len(settled))
+	}
+	if start := stub.lastCall("listinvoices")["start"]; start != float64(len(invoices)+1) {
+		t.Errorf("listed invoices again from %v", start)
+	}
+}
+
+func TestCLNBackendInvoices(t *testing.T) {
+	stub, c := newStubCLN(t)
+	stub.handle("invoice", func(params map[string]interface{}) interface{} {
+		return map[string]string{"bolt11": "lnbcrt1stub", "payment_hash": "aa"}
+	})
+
+	preimage := strings.Repeat("01", 32)
+	if _, err := c.CreateInvoice(CreateInvoiceParams{
+		Msatoshi:    5000,
+		Preimage:    preimage,
+		Description: "coffee",
+		Label:       "lntxbotuser=1",
+	}); err != nil {
+		t.Fatalf("failed to create invoice: %s", err)
+	}
+	call := stub.lastCall("invoice")
+	bpreimage, _ := hex.DecodeString(preimage)
+	hash := sha256.Sum256(bpreimage)
+	if call["label"] != "lntxbotuser=1:"+hex.EncodeToString(hash[:]) {
+		t.Errorf("label is %v", call["label"])
+	}
+	if call["description"] != "coffee" || call["deschashonly"] != nil {
+		t.Errorf("unexpected params %v", call)
+	}
+
+	text := `[["text/plain","fiatjaf"]]`
+	dhash := sha256.Sum256([]byte(text))
+	for _, tc := range []struct {
+		name   string
+		params CreateInvoiceParams
+		ok     bool
+	}{
+		{"hashed description", CreateInvoiceParams{HashedDescription: text}, true},
+		{"description matching the hash", CreateInvoiceParams{Description: text}, true},
+		{"description not matching the hash", CreateInvoiceParams{Description: "other"}, false},
+		{"no description", CreateInvoiceParams{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.params.Preimage = preimage
+			tc.params.DescriptionHash = hex.EncodeToString(dhash[:])
+			_, err := c.CreateInvoice(tc.params)
+			if !tc.ok {
+				if err == nil {
+					t.Error("should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create invoice: %s", err)
+			}
+			call := stub.lastCall("invoice")
+			if call["description"] != text || call["deschashonly"] != true {
+				t.Errorf("unexpected params %v", call)
+			}
+		})
+	}
+}
+
+func TestCLNBackendPayments(t *testing.T) {
+	stub, c := newStubCLN(t)
+	other := newFakeBackend()
+	clnPayCheckInterval = 10 * time.Millisecond
+
+	pays := make(map[string]interface{}) // hash -> listpays entry
+	stub.handle("listpays", func(params map[string]interface{}) interface{} {
+		stub.Lock()
+		defer stub.Unlock()
+		if pay, ok := pays[params["payment_hash"].(string)]; ok {
+			return map[string]interface{}{"pays": []interface{}{pay}}
+		}
+		return map[string]interface{}{"pays": []interface{}{}}
+	})
+
+	pay := func(payResult interface{}) string {
+		inv, _ := other.CreateInvoice(CreateInvoiceParams{Msatoshi: 5000})
+		stub.handle("pay", func(map[string]interface{}) interface{} {
+			if m, ok := payResult.(map[string]interface{}); ok {
+				m["payment_hash"] = inv.PaymentHash
+			}
+			return payResult
+		})
+		if err := c.PayInvoice(inv.Invoice, 5000); err != nil {
+			t.Fatalf("failed to pay: %s", err)
+		}
+		return inv.PaymentHash
+	}
+
+	expectSuccess := func(hash string) {
+		t.Helper()
+		select {
+		case success := <-c.PaymentSuccesses():
+			if success.PaymentHash != hash || success.FeeMsatoshi != 10 {
+				t.Errorf("unexpected success %v", success)
+			}
+		case failure := <-c.PaymentFailures():
+			t.Errorf("unexpected failure %v", failure)
+		case <-time.After(5 * time.Second):
+			t.Error("payment never succeeded")
+		}
+	}
+	expectFailure := func(hash string) {
+		t.Helper()
+		select {
+		case failure := <-c.PaymentFailures():
+			if failure.PaymentHash != hash {
+				t.Errorf("unexpected failure %v", failure)
+			}
+		case success := <-c.PaymentSuccesses():
+			t.Errorf("unexpected success %v", success)
+		case <-time.After(5 * time.Second):
+			t.Error("payment never failed")
+		}
+	}
+	expectNothing := func() {
+		t.Helper()
+		select {
+		case failure := <-c.PaymentFailures():
+			t.Errorf("unexpected failure %v", failure)
+		case success := <-c.PaymentSuccesses():
+			t.Errorf("unexpected success %v", success)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	t.Run("complete", func(t *testing.T) {
+		hash := pay(map[string]interface{}{
+			"status":           "complete",
+			"payment_preimage": "00",
+			"amount_msat":      5000,
+			"amount_sent_msat": "5010msat",
+		})
+		expectSuccess(hash)
+	})
+
+	t.Run("no route", func(t *testing.T) {
+		hash := pay(clnError{Code: 205, Message: "Could not find a route"})
+		expectFailure(hash)
+	})
+
+	t.Run("connection lost and then complete", func(t *testing.T) {
+		hash := pay(nil)
+		expectNothing()
+		stub.Lock()
+		pays[hash] = map[string]interface{}{
+			"status": "complete", "preimage": "00",
+			"amount_msat": 5000, "amount_sent_msat": 5010,
+		}
+		stub.Unlock()
+		expectSuccess(hash)
+	})
+
+	t.Run("in progress and then failed", func(t *testing.T) {
+		hash := pay(clnError{Code: 200, Message: "In progress"})
+		expectNothing()
+		stub.Lock()
+		pays[hash] = map[string]interface{}{"status": "failed"}
+		stub.Unlock()
+		expectFailure(hash)
+	})
+
+	t.Run("unknown error", func(t *testing.T) {
+		pay(clnError{Code: -1, Message: "something"})
+		expectNothing()
+	})
+}
+
+func TestCLNBackendWaitInvoices(t *testing.T) {
+	stub, c := newStubCLN(t)
+	rds.Del("cln:lastpayindex", "cln:listedindex", "cln:listedpayindex")
+
+	stub.handleInvoices([]map[string]interface{}{
+		{"status": "paid", "pay_index": 3},
+		{"status": "expired"},
+		{"status": "paid", "pay_index": 7},
+	})
+
+	// we start after the last invoice paid before, then after the one we got
+	next := make(chan map[string]interface{})
+	expected := []float64{7, 8}
+	stub.handle("waitanyinvoice", func(params map[string]interface{}) interface{} {
+		if len(expected) > 0 {
+			if params["lastpay_index"] != expected[0] {
+				t.Errorf("waiting for invoices after %v, not %v",
+					params["lastpay_index"], expected[0])
+			}
+			expected = expected[1:]
+		}
+		return <-next
+	})
+	c.Start()
+
+	next <- map[string]interface{}{
+		"payment_hash": "bb", "status": "paid", "pay_index": 8,
+		"amount_received_msat": "3000msat", "payment_preimage": "cc",
+	}
+	select {
+	case in := <-c.IncomingPayments():
+		if in.PaymentHash != "bb" || in.Msatoshi != 3000 || in.Preimage != "cc" {
+			t.Errorf("unexpected incoming payment %v", in)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("payment never came")
+	}
+
+	eventually(t, func() bool {
+		last, _ := rds.Get("cln:lastpayindex").Uint64()
+		return last == 8
+	})
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/bech32"
+	decodepay "github.com/fiatjaf/ln-decodepay"
+)
+
+// FakeBackend is an in-memory lightning node that issues real (regtest) bolt11
+// invoices but never touches the network. invoices it issued are settled when
+// paid through it or when "settle" is called, everything else "succeeds" instantly.
+type FakeBackend struct {
+	sync.Mutex
+
+	key      *btcec.PrivateKey
+	invoices map[string]*fakeInvoice
+	payments map[string]PaymentStatus
+
+	incoming  chan IncomingPayment
+	successes chan PaymentSuccess
+	failures  chan PaymentFailure
+}
+
+type fakeInvoice struct {
+	Bolt11   string    `json:"bolt11"`
+	Preimage string    `json:"preimage"`
+	Msatoshi int64     `json:"msatoshi"`
+	Label    string    `json:"label"`
+	Paid     bool      `json:"paid"`
+	PaidAt   time.Time `json:"paid_at"`
+}
+
+func newFakeBackend() *FakeBackend {
+	key, _ := btcec.NewPrivateKey(btcec.S256())
+	return &FakeBackend{
+		key:       key,
+		invoices:  make(map[string]*fakeInvoice),
+		payments:  make(map[string]PaymentStatus),
+		incoming:  make(chan IncomingPayment, 100),
+		successes: make(chan PaymentSuccess, 100),
+		failures:  make(chan PaymentFailure, 100),
+	}
+}
+
+func (f *FakeBackend) Start() error { return nil }
+
+func (f *FakeBackend) GetInfo() (NodeInfo, error) {
+	return NodeInfo{
+		Pubkey: hex.EncodeToString(f.key.PubKey().SerializeCompressed()),
+	}, nil
+}
+
+func (f *FakeBackend) CreateInvoice(params CreateInvoiceParams) (CreateInvoiceResult, error) {
+	preimage, err := hex.DecodeString(params.Preimage)
+	if err != nil || len(preimage) != 32 {
+		preimage = make([]byte, 32)
+		if _, err := rand.Read(preimage); err != nil {
+			return CreateInvoiceResult{}, err
+		}
+	}
+	hash := sha256.Sum256(preimage)
+
+	var descriptionHash []byte
+	if params.DescriptionHash != "" {
+		descriptionHash, err = hex.DecodeString(params.DescriptionHash)
+		if err != nil || len(descriptionHash) != 32 {
+			return CreateInvoiceResult{}, errors.New("invalid description_hash")
+		}
+	}
+
+	bolt11, err := encodeFakeBolt11(f.key, fakeBolt11{
+		Msatoshi:        params.Msatoshi,
+		PaymentHash:     hash[:],
+		Description:     params.Description,
+		DescriptionHash: descriptionHash,
+		Expiry:          params.Expiry,
+	})
+	if err != nil {
+		return CreateInvoiceResult{}, err
+	}
+
+	hashhex := hex.EncodeToString(hash[:])
+
+	f.Lock()
+	f.invoices[hashhex] = &fakeInvoice{
+		Bolt11:   bolt11,
+		Preimage: hex.EncodeToString(preimage),
+		Msatoshi: params.Msatoshi,
+		Label:    params.Label,
+	}
+	f.Unlock()
+
+	return CreateInvoiceResult{Invoice: bolt11, PaymentHash: hashhex}, nil
+}
+
+func (f *FakeBackend) PayInvoice(bolt11 string, msatoshi int64) error {
+	inv, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		return err
+	}
+	if msatoshi == 0 {
+		msatoshi = inv.MSatoshi
+	}
+
+	// the channels are buffered, but sending to them while holding the lock
+	// would block every other caller once a buffer is full
+	var incoming *IncomingPayment
+
+	f.Lock()
+
+	if _, ok := f.payments[inv.PaymentHash]; ok {
+		f.Unlock()
+		return errors.New("payment already attempted")
+	}
+
+	preimage := make([]byte, 32)
+	rand.Read(preimage)
+	preimagehex := hex.EncodeToString(preimage)
+
+	if own, ok := f.invoices[inv.PaymentHash]; ok {
+		if own.Paid {
+			f.payments[inv.PaymentHash] = PaymentStatus{Status: PaymentFailed}
+			f.Unlock()
+			f.failures <- PaymentFailure{
+				PaymentHash: inv.PaymentHash,
+				Failure:     []string{"invoice already paid"},
+			}
+			return nil
+		}
+
+		own.Paid = true
+		own.PaidAt = time.Now()
+		preimagehex = own.Preimage
+		incoming = &IncomingPayment{
+			PaymentHash: inv.PaymentHash,
+			Preimage:    own.Preimage,
+			Msatoshi:    msatoshi,
+			PaidAt:      own.PaidAt,
+		}
+	}
+
+	f.payments[inv.PaymentHash] = PaymentStatus{
+		Status:   PaymentComplete,
+		Msatoshi: msatoshi,
+		Preimage: preimagehex,
+	}
+	f.Unlock()
+
+	if incoming != nil {
+		f.incoming <- *incoming
+	}
+	f.successes <- PaymentSuccess{
+		PaymentHash: inv.PaymentHash,
+		Preimage:    preimagehex,
+		Msatoshi:    msatoshi,
+	}
+
+	return nil
+}
+
+// Settle simulates an external payer paying one of our invoices.
+func (f *FakeBackend) Settle(hash string, msatoshi int64) error {
+	f.Lock()
+
+	inv, ok := f.invoices[hash]
+	if !ok {
+		f.Unlock()
+		return fmt.Errorf("unknown invoice %s", hash)
+	}
+	if inv.Paid {
+		f.Unlock()
+		return fmt.Errorf("invoice %s already paid", hash)
+	}
+	if msatoshi == 0 {
+		msatoshi = inv.Msatoshi
+	}
+
+	inv.Paid = true
+	inv.PaidAt = time.Now()
+	f.Unlock()
+
+	f.incoming <- IncomingPayment{
+		PaymentHash: hash,
+		Preimage:    inv.Preimage,
+		Msatoshi:    msatoshi,
+		PaidAt:      inv.PaidAt,
+	}
+	return nil
+}
+
+func (f *FakeBackend) CheckPayment(hash string) (PaymentStatus, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if inv, ok := f.invoices[hash]; ok {
+		status := PaymentStatus{
+			IsIncoming: true,
+			Status:     PaymentPending,
+			Msatoshi:   inv.Msatoshi,
+		}
+		if inv.Paid {
+			status.Status = PaymentComplete
+			status.Preimage = inv.Preimage
+		}
+		return status, nil
+	}
+
+	if status, ok := f.payments[hash]; ok {
+		return status, nil
+	}
+
+	// like cliche, we treat unknown payments as failed
+	return PaymentStatus{Status: PaymentFailed}, nil
+}
+
+// ListSettledInvoices implements InvoiceLister.
+func (f *FakeBackend) ListSettledInvoices(since time.Time) ([]IncomingPayment, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	var settled []IncomingPayment
+	for hash, inv := range f.invoices {
+		if !inv.Paid || inv.PaidAt.Before(since) {
+			continue
+		}
+		settled = append(settled, IncomingPayment{
+			PaymentHash: hash,
+			Preimage:    inv.Preimage,
+			Msatoshi:    inv.Msatoshi,
+			PaidAt:      inv.PaidAt,
+		})
+	}
+	return settled, nil
+}
+
+func (f *FakeBackend) Call(method string, params map[string]interface{}) (json.RawMessage, error) {
+	switch method {
+	case "settle":
+		hash, _ := params["hash"].(string)
+		msatoshi, _ := params["msatoshi"].(float64)
+		if err := f.Settle(hash, int64(msatoshi)); err != nil {
+			return nil, err
+		}
+		return json.RawMessage(`{"settled":true}`), nil
+	case "list-invoices":
+		f.Lock()
+		defer f.Unlock()
+		return json.Marshal(f.invoices)
+	default:
+		return nil, ErrUnsupportedCall
+	}
+}
+
+func (f *FakeBackend) IncomingPayments() <-chan IncomingPayment { return f.incoming }
+func (f *FakeBackend) PaymentSuccesses() <-chan PaymentSuccess  { return f.successes }
+func (f *FakeBackend) PaymentFailures() <-chan PaymentFailure   { return f.failures }
+
+// fakeBolt11 is just what we need to issue regtest invoices, see BOLT #11.
+type fakeBolt11 struct {
+	Msatoshi        int64
+	PaymentHash     []byte
+	Description     string
+	DescriptionHash []byte
+	Expiry          time.Duration
+}
+
+func encodeFakeBolt11(key *btcec.PrivateKey, inv fakeBolt11) (string, error) {
+	hrp := "lnbcrt"
+	switch msat := inv.Msatoshi; {
+	case msat == 0:
+	case msat%100000000 == 0:
+		hrp += fmt.Sprintf("%dm", msat/100000000)
+	case msat%100000 == 0:
+		hrp += fmt.Sprintf("%du", msat/100000)
+	case msat%100 == 0:
+		hrp += fmt.Sprintf("%dn", msat/100)
+	default:
+		hrp += fmt.Sprintf("%dp", msat*10)
+	}
+
+	// timestamp, 35 bits
+	var data []byte
+	timestamp := uint64(time.Now().Unix())
+	for i := 6; i >= 0; i-- {
+		data = append(data, byte(timestamp>>(uint(i)*5))&31)
+	}
+
+	field := func(tag byte, value []byte) error {
+		groups, err := bech32.ConvertBits(value, 8, 5, true)
+		if err != nil {
+			return err
+		}
+		if len(groups) > 1023 {
+			return errors.New("bolt11 field too long")
+		}
+		data = append(data, tag, byte(len(groups)>>5), byte(len(groups)&31))
+		data = append(data, groups...)
+		return nil
+	}
+
+	if err := field(1, inv.PaymentHash); err != nil { // p
+		return "", err
+	}
+	if inv.DescriptionHash != nil {
+		if err := field(23, inv.DescriptionHash); err != nil { // h
+			return "", err
+		}
+	} else if err := field(13, []byte(inv.Description)); err != nil { // d
+		return "", err
+	}
+	if inv.Expiry > 0 {
+		var expiry []byte
+		for seconds := uint64(inv.Expiry.Seconds()); seconds > 0; seconds >>= 5 {
+			expiry = append([]byte{byte(seconds & 31)}, expiry...)
+		}
+		data = append(data, 6, byte(len(expiry)>>5), byte(len(expiry)&31)) // x
+		data = append(data, expiry...)
+	}
+
+	// the signature commits to the hrp and the data packed back into bytes
+	packed, err := bech32.ConvertBits(data, 5, 8, true)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(append([]byte(hrp), packed...))
+	compact, err := btcec.SignCompact(btcec.S256(), key, hash[:], true)
+	if err != nil {
+		return "", err
+	}
+	// compact is <recovery flag><r><s>, bolt11 wants <r><s><recovery id>
+	sig := append(compact[1:], compact[0]-27-4)
+	groups, err := bech32.ConvertBits(sig, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	data = append(data, groups...)
+
+	return bech32.Encode(hrp, data)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	decodepay "github.com/fiatjaf/ln-decodepay"
+)
+
+func TestFakeBackendInvoices(t *testing.T) {
+	f := newFakeBackend()
+	info, _ := f.GetInfo()
+
+	for _, tc := range []struct {
+		name   string
+		params CreateInvoiceParams
+	}{
+		{"amountless", CreateInvoiceParams{Description: "anything"}},
+		{"millisatoshis", CreateInvoiceParams{Msatoshi: 1234, Description: "odd"}},
+		{"satoshis", CreateInvoiceParams{Msatoshi: 21000, Description: "sats"}},
+		{"bitcoins", CreateInvoiceParams{Msatoshi: 200000000, Description: "btc"}},
+		{"expiry", CreateInvoiceParams{Msatoshi: 5000, Expiry: time.Hour}},
+		{"description hash", CreateInvoiceParams{
+			Msatoshi:        5000,
+			DescriptionHash: hex.EncodeToString(make([]byte, 32)),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := f.CreateInvoice(tc.params)
+			if err != nil {
+				t.Fatalf("failed to create invoice: %s", err)
+			}
+
+			inv, err := decodepay.Decodepay(res.Invoice)
+			if err != nil {
+				t.Fatalf("invoice %s doesn't decode: %s", res.Invoice, err)
+			}
+			if inv.PaymentHash != res.PaymentHash {
+				t.Errorf("hash is %s, expected %s", inv.PaymentHash, res.PaymentHash)
+			}
+			if inv.MSatoshi != tc.params.Msatoshi {
+				t.Errorf("amount is %d, expected %d", inv.MSatoshi, tc.params.Msatoshi)
+			}
+			if inv.Payee != info.Pubkey {
+				t.Errorf("payee is %s, expected %s", inv.Payee, info.Pubkey)
+			}
+			if tc.params.DescriptionHash != "" {
+				if inv.DescriptionHash != tc.params.DescriptionHash {
+					t.Errorf("description hash is %s", inv.DescriptionHash)
+				}
+			} else if inv.Description != tc.params.Description {
+				t.Errorf("description is %q", inv.Description)
+			}
+			if tc.params.Expiry > 0 && inv.Expiry != int(tc.params.Expiry.Seconds()) {
+				t.Errorf("expiry is %d", inv.Expiry)
+			}
+		})
+	}
+}
+
+func TestFakeBackendPayments(t *testing.T) {
+	f := newFakeBackend()
+	other := newFakeBackend()
+
+	// paying our own invoice is received too
+	own, _ := f.CreateInvoice(CreateInvoiceParams{Msatoshi: 10000})
+	if err := f.PayInvoice(own.Invoice, 0); err != nil {
+		t.Fatal(err)
+	}
+	if in := <-f.IncomingPayments(); in.PaymentHash != own.PaymentHash || in.Msatoshi != 10000 {
+		t.Errorf("unexpected incoming payment %v", in)
+	}
+	success := <-f.PaymentSuccesses()
+	preimage, _ := hex.DecodeString(success.Preimage)
+	if hash := sha256.Sum256(preimage); hex.EncodeToString(hash[:]) != own.PaymentHash {
+		t.Errorf("preimage %s doesn't match", success.Preimage)
+	}
+
+	// and can't be paid twice
+	f.payments = make(map[string]PaymentStatus)
+	f.PayInvoice(own.Invoice, 0)
+	if failure := <-f.PaymentFailures(); failure.PaymentHash != own.PaymentHash {
+		t.Errorf("unexpected failure %v", failure)
+	}
+
+	// external invoices just succeed
+	external, _ := other.CreateInvoice(CreateInvoiceParams{Msatoshi: 20000})
+	if err := f.PayInvoice(external.Invoice, 0); err != nil {
+		t.Fatal(err)
+	}
+	if success := <-f.PaymentSuccesses(); success.PaymentHash != external.PaymentHash {
+		t.Errorf("unexpected success %v", success)
+	}
+	if status, _ := f.CheckPayment(external.PaymentHash); status.Status != PaymentComplete {
+		t.Errorf("external payment is %s", status.Status)
+	}
+	if err := f.PayInvoice(external.Invoice, 0); err == nil {
+		t.Error("paying the same invoice twice should fail")
+	}
+}
+
+func TestFakeBackendFullChannels(t *testing.T) {
+	f := newFakeBackend()
+	other := newFakeBackend()
+
+	// nobody is reading the successes, so the buffer fills up and the last
+	// payment blocks on it, which mustn't block everybody else
+	for i := 0; i <= cap(f.successes); i++ {
+		inv, _ := other.CreateInvoice(CreateInvoiceParams{Msatoshi: 1000})
+		go f.PayInvoice(inv.Invoice, 0)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.GetInfo()
+		f.CheckPayment("00")
+		f.CreateInvoice(CreateInvoiceParams{Msatoshi: 1000})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fake backend is deadlocked")
+	}
+}
+
+func TestBotAgainstFakeBackend(t *testing.T) {
+	setupTestBot(t)
+
+	alice := testUser(t, "alice")
+	fundTestUser(t, alice, 100000)
+
+	// pay some other node
+	other := newFakeBackend()
+	external, _ := other.CreateInvoice(CreateInvoiceParams{Msatoshi: 50000})
+	ctx := context.WithValue(context.Background(), "initiator", alice)
+	hash, err := alice.payInvoice(ctx, external.Invoice, 0)
+	if err != nil {
+		t.Fatalf("failed to pay: %s", err)
+	}
+
+	eventually(t, func() bool {
+		txn, err := alice.getTransaction(hash)
+		return err == nil && txn.Status == "SENT"
+	})
+	info, _ := alice.getInfo()
+	if info.BalanceMsat > 50000 {
+		t.Errorf("balance is %d after paying", info.BalanceMsat)
+	}
+
+	// pay another user
+	bob := testUser(t, "bob")
+	bobctx := context.WithValue(context.Background(), "initiator", bob)
+	bolt11, _, err := bob.makeInvoice(bobctx, &MakeInvoiceArgs{
+		IgnoreRateLimit: true,
+		Msatoshi:        10000,
+		Description:     "internal",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.payInvoice(ctx, bolt11, 0); err != nil {
+		t.Fatalf("failed to pay internally: %s", err)
+	}
+	eventually(t, func() bool {
+		info, err := bob.getInfo()
+		return err == nil && info.BalanceMsat == 10000
+	})
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// labels are kept for this long after their invoices expire.
+const lndLabelRetention = time.Hour * 24 * 3
+
+// LNDBackend talks to an LND node through its REST interface.
+//
+// LND invoices have no label, so the "lntxbotuser=<id>" label is kept on redis
+// under lnd:label:<hash>, and also saved as the memo on invoices that commit to a
+// description_hash (on the others the memo is the description itself).
+type LNDBackend struct {
+	baseURL  string
+	macaroon string
+
+	// client is for plain calls, streamClient for the streaming endpoints,
+	// which only have their connection setup bounded.
+	client       *http.Client
+	streamClient *http.Client
+
+	incoming  chan IncomingPayment
+	successes chan PaymentSuccess
+	failures  chan PaymentFailure
+}
+
+func newLNDBackend() *LNDBackend {
+	if s.LNDRESTURL == "" {
+		log.Fatal().Msg("LND_REST_URL is required for the lnd backend")
+	}
+
+	var macaroon string
+	if s.LNDMacaroonPath != "" {
+		b, err := ioutil.ReadFile(s.LNDMacaroonPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", s.LNDMacaroonPath).Msg("failed to read lnd macaroon")
+		}
+		macaroon = hex.EncodeToString(b)
+	}
+
+	tlsConfig := &tls.Config{}
+	if s.LNDTLSCertPath != "" {
+		cert, err := ioutil.ReadFile(s.LNDTLSCertPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", s.LNDTLSCertPath).Msg("failed to read lnd tls cert")
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(cert)
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	return &LNDBackend{
+		baseURL:      strings.TrimSuffix(s.LNDRESTURL, "/"),
+		macaroon:     macaroon,
+		client:       &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		streamClient: &http.Client{Transport: transport},
+		incoming:     make(chan IncomingPayment),
+		successes:    make(chan PaymentSuccess),
+		failures:     make(chan PaymentFailure),
+	}
+}
+
+type lndPayment struct {
+	PaymentHash     string `json:"payment_hash"`
+	PaymentPreimage string `json:"payment_preimage"`
+	Status          string `json:"status"`
+	ValueMsat       int64  `json:"value_msat,string"`
+	FeeMsat         int64  `json:"fee_msat,string"`
+	FailureReason   string `json:"failure_reason"`
+}
+
+type lndInvoice struct {
+	Memo         string `json:"memo"`
+	RPreimage    []byte `json:"r_preimage"`
+	RHash        []byte `json:"r_hash"`
+	ValueMsat    int64  `json:"value_msat,string"`
+	AmtPaidMsat  int64  `json:"amt_paid_msat,string"`
+	State        string `json:"state"`
+	SettleIndex  uint64 `json:"settle_index,string"`
+	SettleDate   int64  `json:"settle_date,string"`
+	CreationDate int64  `json:"creation_date,string"`
+	Expiry       int64  `json:"expiry,string"`
+}
+
+func (l *LNDBackend) request(method, path string, body interface{}) (*http.Response, error) {
+	return l.do(l.client, method, path, body)
+}
+
+func (l *LNDBackend) stream(method, path string, body interface{}) (*http.Response, error) {
+	return l.do(l.streamClient, method, path, body)
+}
+
+func (l *LNDBackend) do(client *http.Client, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(j)
+	}
+
+	req, err := http.NewRequest(method, l.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if l.macaroon != "" {
+		req.Header.Set("Grpc-Metadata-macaroon", l.macaroon)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call lnd %s: %w", path, err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var lerr struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(b, &lerr)
+		if lerr.Message == "" {
+			lerr.Message = lerr.Error
+		}
+		if lerr.Message == "" {
+			lerr.Message = string(b)
+		}
+		return nil, fmt.Errorf("lnd %s returned %d: %s", path, resp.StatusCode, lerr.Message)
+	}
+
+	return resp, nil
+}
+
+func (l *LNDBackend) call(method, path string, body interface{}, result interface{}) error {
+	resp, err := l.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (l *LNDBackend) Start() error {
+	go l.subscribeInvoices()
+	return nil
+}
+
+func (l *LNDBackend) GetInfo() (NodeInfo, error) {
+	var info struct {
+		IdentityPubkey    string `json:"identity_pubkey"`
+		BlockHeight       int    `json:"block_height"`
+		NumActiveChannels int    `json:"num_active_channels"`
+	}
+	if err := l.call("GET", "/v1/getinfo", nil, &info); err != nil {
+		return NodeInfo{}, err
+	}
+	return NodeInfo{
+		Pubkey:      info.IdentityPubkey,
+		BlockHeight: info.BlockHeight,
+		Channels:    info.NumActiveChannels,
+	}, nil
+}
+
+func (l *LNDBackend) CreateInvoice(params CreateInvoiceParams) (CreateInvoiceResult, error) {
+	preimage, err := hex.DecodeString(params.Preimage)
+	if err != nil {
+		return CreateInvoiceResult{}, fmt.Errorf("invalid preimage: %w", err)
+	}
+
+	body := map[string]interface{}{
+		"value_msat": params.Msatoshi,
+		"r_preimage": preimage,
+		"memo":       params.Description,
+	}
+	if params.DescriptionHash != "" {
+		dh, err := hex.DecodeString(params.DescriptionHash)
+		if err != nil {
+			return CreateInvoiceResult{}, fmt.Errorf("invalid description_hash: %w", err)
+		}
+		body["description_hash"] = dh
+		body["memo"] = params.Label
+	}
+	if params.Expiry > 0 {
+		body["expiry"] = int64(params.Expiry.Seconds())
+	}
+
+	var res struct {
+		RHash          []byte `json:"r_hash"`
+		PaymentRequest string `json:"payment_request"`
+	}
+	if err := l.call("POST", "/v1/invoices", body, &res); err != nil {
+		return CreateInvoiceResult{}, err
+	}
+
+	hash := hex.EncodeToString(res.RHash)
+	if params.Label != "" {
+		// only needed while the invoice can be paid and reconciled
+		expiry := params.Expiry
+		if expiry <= 0 {
+			expiry = time.Hour // lnd's default
+		}
+		if err := rds.Set("lnd:label:"+hash, params.Label, expiry+lndLabelRetention).Err(); err != nil {
+			log.Warn().Err(err).Str("hash", hash).Str("label", params.Label).
+				Msg("failed to save lnd invoice label")
+		}
+	}
+
+	return CreateInvoiceResult{
+		Invoice:     res.PaymentRequest,
+		PaymentHash: hash,
+	}, nil
+}
+
+// Label returns the label we gave to one of our invoices, if any.
+func (l *LNDBackend) Label(hash string) string {
+	return rds.Get("lnd:label:" + hash).Val()
+}
+
+func (l *LNDBackend) PayInvoice(bolt11 string, msatoshi int64) error {
+	feeLimit := int64(float64(msatoshi) * 0.005)
+	if msatoshi < 1000000 {
+		feeLimit += 5000
+	}
+
+	body := map[string]interface{}{
+		"payment_request":     bolt11,
+		"fee_limit_msat":      feeLimit,
+		"timeout_seconds":     60,
+		"no_inflight_updates": true,
+	}
+	if inv, err := decodeInvoiceAsLndHub(bolt11); err == nil && inv.NumSatoshis == "0" {
+		body["amt_msat"] = msatoshi
+	}
+
+	resp, err := l.stream("POST", "/v2/router/send", body)
+	if err != nil {
+		return err
+	}
+
+	// the rest of the payment flow happens in the background and
+	// we get to know about it through the successes and failures channels
+	go l.consumePaymentStream(resp.Body)
+	return nil
+}
+
+func (l *LNDBackend) consumePaymentStream(body io.ReadCloser) {
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Result *lndPayment `json:"result"`
+			Error  *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err != io.EOF {
+				log.Warn().Err(err).Msg("lnd payment stream broken")
+			}
+			return
+		}
+		if msg.Error != nil {
+			log.Warn().Str("err", msg.Error.Message).Msg("lnd payment stream error")
+			return
+		}
+		if msg.Result == nil {
+			continue
+		}
+
+		payment := msg.Result
+		switch payment.Status {
+		case "SUCCEEDED":
+			l.successes <- PaymentSuccess{
+				PaymentHash: payment.PaymentHash,
+				Preimage:    payment.PaymentPreimage,
+				Msatoshi:    payment.ValueMsat,
+				FeeMsatoshi: payment.FeeMsat,
+			}
+			return
+		case "FAILED":
+			l.failures <- PaymentFailure{
+				PaymentHash: payment.PaymentHash,
+				Failure:     []string{payment.FailureReason},
+			}
+			return
+		}
+	}
+}
+
+func (l *LNDBackend) CheckPayment(hash string) (PaymentStatus, error) {
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return PaymentStatus{}, fmt.Errorf("invalid hash: %w", err)
+	}
+
+	// is it an invoice of ours?
+	var inv lndInvoice
+	if err := l.call("GET", "/v1/invoice/"+hash, nil, &inv); err == nil {
+		status := PaymentStatus{
+			IsIncoming: true,
+			Status:     PaymentPending,
+			Msatoshi:   inv.ValueMsat,
+		}
+		switch inv.State {
+		case "SETTLED":
+			status.Status = PaymentComplete
+			status.Msatoshi = inv.AmtPaidMsat
+			status.Preimage = hex.EncodeToString(inv.RPreimage)
+		case "CANCELED":
+			status.Status = PaymentFailed
+		}
+		return status, nil
+	}
+
+	// otherwise it is an outgoing payment
+	resp, err := l.stream("GET", "/v2/router/track/"+
+		base64.URLEncoding.EncodeToString(bhash)+"?no_inflight_updates=true", nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "payment isn't initiated") {
+			// lnd doesn't know about it, so it has failed
+			return PaymentStatus{Status: PaymentFailed}, nil
+		}
+		return PaymentStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	var msg struct {
+		Result lndPayment `json:"result"`
+	}
+	done := make(chan error, 1)
+	go func() { done <- json.NewDecoder(resp.Body).Decode(&msg) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return PaymentStatus{}, err
+		}
+	case <-time.After(5 * time.Second):
+		// no final update yet, so it's still in flight
+		return PaymentStatus{Status: PaymentPending}, nil
+	}
+
+	status := PaymentStatus{
+		Status:      PaymentPending,
+		Msatoshi:    msg.Result.ValueMsat,
+		FeeMsatoshi: msg.Result.FeeMsat,
+		Preimage:    msg.Result.PaymentPreimage,
+	}
+	switch msg.Result.Status {
+	case "SUCCEEDED":
+		status.Status = PaymentComplete
+	case "FAILED":
+		status.Status = PaymentFailed
+	}
+	return status, nil
+}
+
+// ListSettledInvoices implements InvoiceLister.
+func (l *LNDBackend) ListSettledInvoices(since time.Time) ([]IncomingPayment, error) {
+	var settled []IncomingPayment
+
+	// walk backwards from the newest invoice until we reach invoices that
+	// had already expired by the time we are looking from
+	var offset uint64
+	for {
+		path := "/v1/invoices?reversed=true&num_max_invoices=500"
+		if offset > 0 {
+			path += fmt.Sprintf("&index_offset=%d", offset)
+		}
+
+		var page struct {
+			Invoices         []lndInvoice `json:"invoices"`
+			FirstIndexOffset uint64       `json:"first_index_offset,string"`
+		}
+		if err := l.call("GET", path, nil, &page); err != nil {
+			return nil, err
+		}
+
+		done := len(page.Invoices) == 0 || page.FirstIndexOffset <= 1
+		for _, inv := range page.Invoices {
+			if inv.CreationDate+inv.Expiry < since.Unix() {
+				done = true
+			}
+			if inv.State != "SETTLED" || inv.SettleDate < since.Unix() {
+				continue
+			}
+			settled = append(settled, IncomingPayment{
+				PaymentHash: hex.EncodeToString(inv.RHash),
+				Preimage:    hex.EncodeToString(inv.RPreimage),
+				Msatoshi:    inv.AmtPaidMsat,
+				PaidAt:      time.Unix(inv.SettleDate, 0),
+			})
+		}
+		if done {
+			break
+		}
+		offset = page.FirstIndexOffset
+	}
+
+	return settled, nil
+}
+
+func (l *LNDBackend) subscribeInvoices() {
+	var settleIndex uint64
+
+	for {
+		resp, err := l.stream("GET",
+			fmt.Sprintf("/v1/invoices/subscribe?settle_index=%d", settleIndex), nil)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to subscribe to lnd invoices")
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var msg struct {
+				Result *lndInvoice `json:"result"`
+			}
+			if err := dec.Decode(&msg); err != nil {
+				log.Warn().Err(err).Msg("lnd invoice subscription broken")
+				break
+			}
+			if msg.Result == nil || msg.Result.State != "SETTLED" {
+				continue
+			}
+
+			if msg.Result.SettleIndex > settleIndex {
+				settleIndex = msg.Result.SettleIndex
+			}
+			hash := hex.EncodeToString(msg.Result.RHash)
+			log.Debug().Str("hash", hash).Str("label", l.Label(hash)).
+				Msg("lnd invoice settled")
+			l.incoming <- IncomingPayment{
+				PaymentHash: hash,
+				Preimage:    hex.EncodeToString(msg.Result.RPreimage),
+				Msatoshi:    msg.Result.AmtPaidMsat,
+				PaidAt:      time.Unix(msg.Result.SettleDate, 0),
+			}
+		}
+		resp.Body.Close()
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Call performs a raw REST call, method is like "GET /v1/channels".
+func (l *LNDBackend) Call(method string, params map[string]interface{}) (json.RawMessage, error) {
+	spl := strings.SplitN(method, " ", 2)
+	if len(spl) != 2 {
+		return nil, errors.New("method must be like 'GET /v1/getinfo'")
+	}
+
+	var body interface{}
+	if len(params) > 0 {
+		body = params
+	}
+
+	var res json.RawMessage
+	err := l.call(strings.ToUpper(spl[0]), spl[1], body, &res)
+	return res, err
+}
+
+func (l *LNDBackend) IncomingPayments() <-chan IncomingPayment { return l.incoming }
+func (l *LNDBackend) PaymentSuccesses() <-chan PaymentSuccess  { return l.successes }
+func (l *LNDBackend) PaymentFailures() <-chan PaymentFailure   { return l.failures }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubLND answers the REST calls we make the way lnd does, including the
+// streaming endpoints, which send one json object per line.
+type stubLND struct {
+	sync.Mutex
+	t *testing.T
+
+	invoices map[string]map[string]interface{} // hash -> the body we got
+	fail     bool                              // payments fail instead of succeeding
+	closed   chan struct{}
+}
+
+func (stub *stubLND) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Grpc-Metadata-macaroon") != "cafe" {
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(map[string]string{"message": "no macaroon"})
+		return
+	}
+
+	stub.Lock()
+	defer stub.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/getinfo":
+		fmt.Fprint(w, `{"identity_pubkey":"02aa","block_height":100,"num_active_channels":3}`)
+	case r.URL.Path == "/v1/invoices" && r.Method == "POST":
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		preimage, _ := base64.StdEncoding.DecodeString(body["r_preimage"].(string))
+		hash := sha256.Sum256(preimage)
+		stub.invoices[hex.EncodeToString(hash[:])] = body
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"r_hash":          hash[:],
+			"payment_request": "lnbcrt1stub",
+		})
+	case strings.HasPrefix(r.URL.Path, "/v1/invoice/"):
+		hash := strings.TrimPrefix(r.URL.Path, "/v1/invoice/")
+		body, ok := stub.invoices[hash]
+		if !ok {
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"message":"unable to locate invoice"}`)
+			return
+		}
+		bhash, _ := hex.DecodeString(hash)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"r_hash":        bhash,
+			"r_preimage":    body["r_preimage"],
+			"value_msat":    fmt.Sprint(body["value_msat"]),
+			"amt_paid_msat": fmt.Sprint(body["value_msat"]),
+			"state":         "SETTLED",
+		})
+	case r.URL.Path == "/v2/router/send":
+		var body struct {
+			PaymentRequest string `json:"payment_request"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		inv, _ := decodeInvoiceAsLndHub(body.PaymentRequest)
+		status := `"status":"SUCCEEDED","payment_preimage":"00","fee_msat":"1000"`
+		if stub.fail {
+			status = `"status":"FAILED","failure_reason":"FAILURE_REASON_NO_ROUTE"`
+		}
+		fmt.Fprintf(w, `{"result":{"payment_hash":"%s","status":"IN_FLIGHT"}}`+"\n", inv.PaymentHash)
+		fmt.Fprintf(w, `{"result":{"payment_hash":"%s","value_msat":"%s000",%s}}`+"\n",
+			inv.PaymentHash, inv.NumSatoshis, status)
+	case strings.HasPrefix(r.URL.Path, "/v2/router/track/"):
+		if stub.fail {
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"error":{"message":"payment isn't initiated"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"result":{"status":"SUCCEEDED","value_msat":"5000","fee_msat":"1","payment_preimage":"00"}}`+"\n")
+	case r.URL.Path == "/v1/invoices/subscribe":
+		for hash, body := range stub.invoices {
+			bhash, _ := hex.DecodeString(hash)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"result": map[string]interface{}{
+					"r_hash":        bhash,
+					"r_preimage":    body["r_preimage"],
+					"amt_paid_msat": fmt.Sprint(body["value_msat"]),
+					"settle_index":  "1",
+					"state":         "SETTLED",
+				},
+			})
+		}
+		w.(http.Flusher).Flush()
+		stub.Unlock()
+		select {
+		case <-r.Context().Done():
+		case <-stub.closed:
+		}
+		stub.Lock()
+	default:
+		stub.t.Errorf("unexpected call %s %s", r.Method, r.URL)
+		w.WriteHeader(404)
+	}
+}
+
+func newStubLND(t *testing.T) (*stubLND, *LNDBackend) {
+	setupTestRedis(t)
+
+	stub := &stubLND{
+		t:        t,
+		invoices: make(map[string]map[string]interface{}),
+		closed:   make(chan struct{}),
+	}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(stub.closed) })
+
+	s.LNDRESTURL = server.URL + "/"
+	s.LNDMacaroonPath = ""
+	s.LNDTLSCertPath = ""
+	l := newLNDBackend()
+	l.macaroon = "cafe"
+	return stub, l
+}
+
+func TestLNDBackendInvoices(t *testing.T) {
+	stub, l := newStubLND(t)
+
+	info, err := l.GetInfo()
+	if err != nil {
+		t.Fatalf("getinfo failed: %s", err)
+	}
+	if info.Pubkey != "02aa" || info.Channels != 3 {
+		t.Errorf("unexpected info %v", info)
+	}
+
+	preimage := hex.EncodeToString(make([]byte, 32))
+	plain, err := l.CreateInvoice(CreateInvoiceParams{
+		Msatoshi:    5000,
+		Preimage:    preimage,
+		Description: "coffee",
+		Label:       "lntxbotuser=7",
+	})
+	if err != nil {
+		t.Fatalf("failed to create invoice: %s", err)
+	}
+	if memo := stub.invoices[plain.PaymentHash]["memo"]; memo != "coffee" {
+		t.Errorf("memo is %v, expected the description", memo)
+	}
+	if label := l.Label(plain.PaymentHash); label != "lntxbotuser=7" {
+		t.Errorf("label is %q", label)
+	}
+	if ttl := rds.TTL("lnd:label:" + plain.PaymentHash).Val(); ttl <= 0 || ttl > time.Hour+lndLabelRetention {
+		t.Errorf("label ttl is %s", ttl)
+	}
+
+	hashed, err := l.CreateInvoice(CreateInvoiceParams{
+		Msatoshi:        5000,
+		Preimage:        strings.Repeat("11", 32),
+		DescriptionHash: strings.Repeat("22", 32),
+		Label:           "lntxbotuser=8",
+	})
+	if err != nil {
+		t.Fatalf("failed to create invoice: %s", err)
+	}
+	if memo := stub.invoices[hashed.PaymentHash]["memo"]; memo != "lntxbotuser=8" {
+		t.Errorf("memo is %v, expected the label", memo)
+	}
+	if label := l.Label(hashed.PaymentHash); label != "lntxbotuser=8" {
+		t.Errorf("label is %q", label)
+	}
+
+	status, err := l.CheckPayment(plain.PaymentHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsIncoming || status.Status != PaymentComplete || status.Preimage != preimage {
+		t.Errorf("unexpected status %v", status)
+	}
+
+	l.Start()
+	seen := make(map[string]bool)
+	for len(seen) < 2 {
+		select {
+		case in := <-l.IncomingPayments():
+			seen[in.PaymentHash] = true
+			if in.Msatoshi != 5000 {
+				t.Errorf("incoming payment of %d", in.Msatoshi)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't get the settled invoices")
+		}
+	}
+}
+
+func TestLNDBackendPayments(t *testing.T) {
+	stub, l := newStubLND(t)
+	other := newFakeBackend()
+
+	inv, _ := other.CreateInvoice(CreateInvoiceParams{Msatoshi: 5000})
+	if err := l.PayInvoice(inv.Invoice, 5000); err != nil {
+		t.Fatalf("failed to pay: %s", err)
+	}
+	select {
+	case success := <-l.PaymentSuccesses():
+		if success.PaymentHash != inv.PaymentHash || success.FeeMsatoshi != 1000 {
+			t.Errorf("unexpected success %v", success)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("payment never succeeded")
+	}
+	if status, _ := l.CheckPayment(inv.PaymentHash); status.Status != PaymentComplete {
+		t.Errorf("payment is %s", status.Status)
+	}
+
+	stub.Lock()
+	stub.fail = true
+	stub.Unlock()
+
+	inv, _ = other.CreateInvoice(CreateInvoiceParams{Msatoshi: 7000})
+	if err := l.PayInvoice(inv.Invoice, 7000); err != nil {
+		t.Fatalf("failed to pay: %s", err)
+	}
+	select {
+	case failure := <-l.PaymentFailures():
+		if failure.PaymentHash != inv.PaymentHash {
+			t.Errorf("unexpected failure %v", failure)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("payment never failed")
+	}
+	if status, _ := l.CheckPayment(inv.PaymentHash); status.Status != PaymentFailed {
+		t.Errorf("payment is %s", status.Status)
+	}
+
+	// lnd errors come back as errors
+	l.macaroon = "wrong"
+	if _, err := l.GetInfo(); err == nil || !strings.Contains(err.Error(), "no macaroon") {
+		t.Errorf("expected the lnd error, got %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/docopt/docopt-go"
@@ -53,7 +54,7 @@ func registerBluewalletMethods() {
 		}{token, token})
 	})
 
-	router.Path("/addinvoice").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Path("/addinvoice").Handler(idempotent(func(w http.ResponseWriter, r *http.Request) {
 		ctx, user, permission, err := loadUserFromAPICall(r)
 		if err != nil {
 			errorBadAuth(w)
@@ -88,13 +89,16 @@ func registerBluewalletMethods() {
 			Msatoshi:        1000 * satoshi,
 			Description:     params.Memo,
 			DescriptionHash: params.DescriptionHash,
-			BlueWallet:      true,
 		})
 		if err != nil {
 			errorInternal(w)
 			return
 		}
 
+		var addIndex int64
+		pg.Get(&addIndex,
+			`SELECT add_index FROM lightning.invoice WHERE payment_hash = $1`, hash)
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(struct {
 			PayReq         string `json:"pay_req"`
@@ -102,10 +106,10 @@ func registerBluewalletMethods() {
 			AddIndex       string `json:"add_index"`
 			RHash          Buffer `json:"r_hash"`
 			Hash           string `json:"payment_hash"`
-		}{bolt11, bolt11, "1000", Buffer(hash), hash})
-	})
+		}{bolt11, bolt11, strconv.FormatInt(addIndex, 10), Buffer(hash), hash})
+	}))
 
-	router.Path("/payinvoice").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router.Path("/payinvoice").Handler(idempotent(func(w http.ResponseWriter, r *http.Request) {
 		ctx, user, permission, err := loadUserFromAPICall(r)
 		if err != nil {
 			errorBadAuth(w)
@@ -174,11 +178,11 @@ func registerBluewalletMethods() {
 			FeeMsat:         int64(tx.Fees * 1000),
 			Type:            "paid_invoice",
 			Fee:             tx.Fees,
-			Value:           tx.Amount,
+			Value:           -tx.Amount + tx.Fees,
 			Timestamp:       tx.Time.UTC().Unix(),
 			Memo:            tx.Description + " " + tx.PeerActionDescription(),
 		})
-	})
+	}))
 
 	router.Path("/balance").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, user, permission, err := loadUserFromAPICall(r)
@@ -216,33 +220,25 @@ func registerBluewalletMethods() {
 			return
 		}
 
-		limit, offset := getLimitAndOffset(r)
-		txs, err := user.listTransactions(limit, offset, 120, "", Out)
+		limit, offset, invalid := getLimitAndOffset(r)
+		if invalid != "" {
+			errorInvalidParams(w)
+			return
+		}
+		txns, err := user.listTransactionsFiltered(TransactionFilter{
+			Limit:     limit,
+			Offset:    offset,
+			Direction: Out,
+			Status:    "SENT",
+		})
 		if err != nil {
 			errorInternal(w)
 			return
 		}
 
-		payments := make([]LndHubPaymentResult, len(txs))
-		for i, tx := range txs {
-			preimage := tx.Preimage.String
-			if preimage == "" {
-				preimage = "0000000000000000000000000000000000000000000000000000000000000000"
-			}
-
-			payments[i] = LndHubPaymentResult{
-				PaymentError:    "",
-				PaymentPreimage: preimage,
-				PaymentRoute:    make(map[string]interface{}),
-				PaymentHash:     tx.Hash,
-				Decoded:         LndHubDecoded{},
-				FeeMsat:         int64(tx.Fees * 1000),
-				Type:            "paid_invoice",
-				Fee:             tx.Fees,
-				Value:           tx.Amount,
-				Timestamp:       tx.Time.UTC().Unix(),
-				Memo:            tx.Description + " " + tx.PeerActionDescription(),
-			}
+		payments := make([]LndHubPaymentResult, len(txns))
+		for i, tx := range txns {
+			payments[i] = lndhubPaymentFromTransaction(tx)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -250,8 +246,33 @@ func registerBluewalletMethods() {
 	})
 
 	router.Path("/getpending").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, user, permission, err := loadUserFromAPICall(r)
+		if err != nil {
+			errorBadAuth(w)
+			return
+		}
+		if permission < ReadOnlyPermissions {
+			errorInsufficientPermissions(w)
+			return
+		}
+
+		txns, err := user.listTransactionsFiltered(TransactionFilter{
+			Limit:     maxListLimit,
+			Direction: Out,
+			Status:    "PENDING",
+		})
+		if err != nil {
+			errorInternal(w)
+			return
+		}
+
+		payments := make([]LndHubPaymentResult, len(txns))
+		for i, tx := range txns {
+			payments[i] = lndhubPaymentFromTransaction(tx)
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]interface{}{})
+		json.NewEncoder(w).Encode(payments)
 	})
 
 	router.Path("/getuserinvoices").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -265,9 +286,65 @@ func registerBluewalletMethods() {
 			return
 		}
 
-		limit, offset := getLimitAndOffset(r)
-		txns, err := user.listTransactions(limit, offset, 120, "", In)
+		limit, offset, invalid := getLimitAndOffset(r)
+		if invalid != "" {
+			errorInvalidParams(w)
+			return
+		}
+
+		var invoices []struct {
+			Hash        string    `db:"payment_hash"`
+			Bolt11      string    `db:"bolt11"`
+			AddIndex    int64     `db:"add_index"`
+			Description string    `db:"description"`
+			Msatoshi    int64     `db:"msatoshi"`
+			Received    int64     `db:"received"`
+			IsPaid      bool      `db:"ispaid"`
+			CreatedAt   time.Time `db:"created_at"`
+			ExpiresAt   time.Time `db:"expires_at"`
+		}
+		// invoices created before lightning.invoice existed are only known by
+		// the incoming transactions that paid them
+		err = pg.Select(&invoices, `
+SELECT * FROM (
+    SELECT
+      i.payment_hash,
+      coalesce(i.bolt11, '') AS bolt11,
+      i.add_index,
+      coalesce(i.description, '') AS description,
+      i.msatoshi::bigint AS msatoshi,
+      coalesce(t.amount, 0)::bigint AS received,
+      t.amount IS NOT NULL AS ispaid,
+      i.created_at,
+      i.expires_at
+    FROM lightning.invoice AS i
+    LEFT JOIN lightning.transaction AS t
+      ON t.payment_hash = i.payment_hash AND t.to_id = i.account_id
+    WHERE i.account_id = $1
+  UNION ALL
+    SELECT
+      t.payment_hash,
+      '' AS bolt11,
+      0 AS add_index,
+      coalesce(t.description, '') AS description,
+      t.amount::bigint AS msatoshi,
+      t.amount::bigint AS received,
+      true AS ispaid,
+      t.time AS created_at,
+      t.time + interval '1 hour' AS expires_at
+    FROM lightning.transaction AS t
+    WHERE t.to_id = $1 AND t.from_id IS NULL AND NOT t.pending
+      AND t.label IS DISTINCT FROM 'aggregate'
+      AND NOT EXISTS (
+        SELECT 1 FROM lightning.invoice AS i WHERE i.payment_hash = t.payment_hash
+      )
+) AS invoices
+ORDER BY created_at DESC, add_index DESC
+LIMIT $2
+OFFSET $3
+        `, user.Id, limit, offset)
 		if err != nil {
+			log.Warn().Err(err).Stringer("user", user).Msg("failed to list lndhub invoices")
 			errorInternal(w)
 			return
 		}
@@ -284,46 +361,56 @@ func registerBluewalletMethods() {
 			ExpireTime     float64 `json:"expire_time"`
 			Timestamp      int64   `json:"timestamp"`
 			Type           string  `json:"type"`
+			Keysend        bool    `json:"keysend"`
 		}
 
-		invs := make([]Inv, len(txns))
-		for i, tx := range txns {
+		invs := make([]Inv, len(invoices))
+		for i, inv := range invoices {
+			amount := inv.Msatoshi
+			if inv.IsPaid {
+				amount = inv.Received
+			}
+
 			invs[i] = Inv{
-				Buffer(tx.Hash),
-				"",
-				"",
-				"1000",
-				tx.PeerActionDescription() + tx.Description,
-				tx.Hash,
-				true,
-				tx.Amount,
-				float64(s.InvoiceTimeout.Seconds()),
-				tx.Time.UTC().Unix(),
+				Buffer(inv.Hash),
+				inv.Bolt11,
+				inv.Bolt11,
+				strconv.FormatInt(inv.AddIndex, 10),
+				inv.Description,
+				inv.Hash,
+				inv.IsPaid,
+				float64(amount / 1000),
+				inv.ExpiresAt.Sub(inv.CreatedAt).Seconds(),
+				inv.CreatedAt.UTC().Unix(),
 				"user_invoice",
+				false,
 			}
 		}
 
-		iinv, err := rds.Get("justcreatedbluewalletinvoice:" + strconv.Itoa(user.Id)).Result()
-		if err == nil {
-			var inv map[string]interface{}
-			json.Unmarshal([]byte(iinv), &inv)
-			invs = append(invs, Inv{
-				Buffer(inv["hash"].(string)),
-				inv["bolt11"].(string),
-				inv["bolt11"].(string),
-				"1000",
-				inv["desc"].(string),
-				inv["hash"].(string),
-				false,
-				inv["amount"].(float64),
-				inv["expiry"].(float64),
-				time.Now().UTC().Unix(),
-				"user_invoice",
-			})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invs)
+	})
+
+	router.Path("/getbtc").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, user, permission, err := loadUserFromAPICall(r)
+		if err != nil {
+			errorBadAuth(w)
+			return
+		}
+		if permission < InvoicePermissions {
+			errorInsufficientPermissions(w)
+			return
+		}
+
+		deposit, err := user.getDeezyDepositAddress()
+		if err != nil {
+			log.Warn().Err(err).Stringer("user", user).Msg("lndhub /getbtc failed")
+			errorInternal(w)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(invs)
+		json.NewEncoder(w).Encode([]map[string]string{{"address": deposit.Address}})
 	})
 
 	router.Path("/decodeinvoice").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -404,13 +491,69 @@ func decodeInvoiceAsLndHub(bolt11 string) (LndHubDecoded, error) {
 	}, nil
 }
 
-func getLimitAndOffset(r *http.Request) (limit int, offset int) {
-	limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
-	if limit == 0 {
-		limit = 50
+func lndhubPaymentFromTransaction(tx APITransaction) LndHubPaymentResult {
+	preimage := "0000000000000000000000000000000000000000000000000000000000000000"
+	if tx.Preimage != nil && *tx.Preimage != "" {
+		preimage = *tx.Preimage
+	}
+
+	memo := tx.Description
+	if tx.Peer != nil {
+		memo = strings.TrimSpace(memo + " to @" + *tx.Peer)
+	}
+
+	// like lndhub, value is the total paid, fees included
+	sats := -tx.AmountMsat / 1000
+	fee := float64(tx.FeeMsat) / 1000
+
+	return LndHubPaymentResult{
+		PaymentError:    "",
+		PaymentPreimage: preimage,
+		PaymentRoute:    make(map[string]interface{}),
+		PaymentHash:     tx.PaymentHash,
+		Decoded: LndHubDecoded{
+			PaymentHash: tx.PaymentHash,
+			NumSatoshis: strconv.FormatInt(sats, 10),
+			Timestamp:   strconv.FormatInt(tx.Time.Unix(), 10),
+			Description: tx.Description,
+		},
+		FeeMsat:   tx.FeeMsat,
+		Type:      "paid_invoice",
+		Fee:       fee,
+		Value:     float64(sats) + fee,
+		Timestamp: tx.Time.UTC().Unix(),
+		Memo:      memo,
+	}
+}
+
+const maxListLimit = 500
+
+// getLimitAndOffset reads the pagination parameters, capping the limit. when
+// one is not a valid number its name is returned as invalid.
+func getLimitAndOffset(r *http.Request) (limit int, offset int, invalid string) {
+	qs := r.URL.Query()
+
+	limit = 50
+	if v := qs.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, "limit"
+		}
+		if n > 0 {
+			limit = n
+		}
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
 	}
 
-	offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+	if v := qs.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, "offset"
+		}
+		offset = n
+	}
 
 	return
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetLimitAndOffset(t *testing.T) {
+	for _, tc := range []struct {
+		query   string
+		limit   int
+		offset  int
+		invalid string
+	}{
+		{"", 50, 0, ""},
+		{"limit=0", 50, 0, ""},
+		{"limit=10&offset=20", 10, 20, ""},
+		{"limit=100000", maxListLimit, 0, ""},
+		{"limit=-1", 0, 0, "limit"},
+		{"limit=ten", 0, 0, "limit"},
+		{"offset=-5", 0, 0, "offset"},
+		{"limit=5&offset=x", 0, 0, "offset"},
+	} {
+		r := httptest.NewRequest("GET", "/gettxs?"+tc.query, nil)
+		limit, offset, invalid := getLimitAndOffset(r)
+		if limit != tc.limit || offset != tc.offset || invalid != tc.invalid {
+			t.Errorf("%q: got %d, %d, %q", tc.query, limit, offset, invalid)
+		}
+	}
+}
+
+// bluewalletSession is a sequence of requests as sent by BlueWallet's
+// LightningCustodianWallet, with the fields each response must have.
+// $LOGIN, $PASSWORD, $TOKEN and $INVOICE are replaced before sending.
+var bluewalletSession = []struct {
+	method string
+	path   string
+	body   string
+	fields []string
+}{
+	{"POST", "/auth?type=auth", `{"login":"$LOGIN","password":"$PASSWORD"}`,
+		[]string{"access_token", "refresh_token"}},
+	{"POST", "/auth?type=refresh_token", `{"refresh_token":"$TOKEN"}`,
+		[]string{"access_token", "refresh_token"}},
+	{"GET", "/getinfo", ``,
+		[]string{"alias"}},
+	{"GET", "/balance", ``,
+		[]string{"BTC"}},
+	{"POST", "/addinvoice", `{"amt":"21","memo":"from bluewallet"}`,
+		[]string{"pay_req", "payment_request", "add_index", "r_hash", "payment_hash"}},
+	{"GET", "/getuserinvoices?limit=10", ``,
+		[]string{"r_hash", "payment_request", "pay_req", "add_index", "description",
+			"payment_hash", "ispaid", "amt", "expire_time", "timestamp", "type"}},
+	{"GET", "/decodeinvoice?invoice=$INVOICE", ``,
+		[]string{"destination", "payment_hash", "num_satoshis", "timestamp",
+			"expiry", "description", "cltv_expiry"}},
+	{"POST", "/payinvoice", `{"invoice":"$INVOICE","amount":0}`,
+		[]string{"payment_error", "payment_preimage", "payment_hash", "decoded",
+			"fee", "value", "timestamp", "memo", "type"}},
+	{"GET", "/gettxs?limit=10&offset=0", ``,
+		[]string{"payment_preimage", "payment_hash", "decoded", "fee", "value",
+			"timestamp", "memo", "type"}},
+	{"GET", "/getpending", ``,
+		nil},
+}
+
+func TestBlueWalletContract(t *testing.T) {
+	setupTestBot(t)
+
+	u := testUser(t, "bluewallet")
+	fundTestUser(t, u, 100000)
+
+	payee := testUser(t, "bluewalletpayee")
+	ctx := context.WithValue(context.Background(), "initiator", payee)
+	invoice, _, err := payee.makeInvoice(ctx, &MakeInvoiceArgs{
+		IgnoreRateLimit: true,
+		Msatoshi:        5000,
+		Description:     "paid from bluewallet",
+	})
+	if err != nil {
+		t.Fatalf("failed to make invoice: %s", err)
+	}
+
+	var token string
+	replace := strings.NewReplacer(
+		"$LOGIN", fmt.Sprint(u.Id),
+		"$PASSWORD", u.Password,
+		"$INVOICE", invoice,
+	)
+
+	for _, step := range bluewalletSession {
+		path := replace.Replace(step.path)
+		body := strings.NewReplacer("$TOKEN", token).Replace(replace.Replace(step.body))
+
+		r := httptest.NewRequest(step.method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != 200 {
+			t.Fatalf("%s %s: got %d: %s", step.method, path, w.Code, w.Body.String())
+		}
+
+		// lists are checked by their first item
+		var res interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s %s: invalid json %q", step.method, path, w.Body.String())
+		}
+		if list, ok := res.([]interface{}); ok {
+			if len(list) == 0 {
+				if len(step.fields) > 0 {
+					t.Fatalf("%s %s: got an empty list", step.method, path)
+				}
+				continue
+			}
+			res = list[0]
+		}
+		obj, _ := res.(map[string]interface{})
+		for _, field := range step.fields {
+			if _, ok := obj[field]; !ok {
+				t.Errorf("%s %s: missing %q in %s", step.method, path, field, w.Body.String())
+			}
+		}
+
+		if step.path == "/auth?type=auth" {
+			token, _ = obj["access_token"].(string)
+		}
+	}
+}
+
+func TestBlueWalletInvoicesBeforeInvoiceTable(t *testing.T) {
+	setupTestBot(t)
+	u := testUser(t, "bluewalletold")
+
+	// received before invoices were kept on lightning.invoice
+	hash := fmt.Sprintf("%064d", u.Id)
+	if _, err := pg.Exec(`
+INSERT INTO lightning.transaction (time, to_id, amount, description, payment_hash, label)
+VALUES (now() - interval '2 years', $1, 7000, 'old invoice', $2, 'old')
+    `, u.Id, hash); err != nil {
+		t.Fatalf("failed to insert transaction: %s", err)
+	}
+	fundTestUser(t, u, 3000)
+
+	r := httptest.NewRequest("GET", "/getuserinvoices", nil)
+	r.Header.Set("Authorization", "Bearer "+apiToken(u))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	var invoices []struct {
+		PaymentHash string  `json:"payment_hash"`
+		IsPaid      bool    `json:"ispaid"`
+		Amount      float64 `json:"amt"`
+		Description string  `json:"description"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &invoices); err != nil {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if len(invoices) != 2 {
+		t.Fatalf("expected 2 invoices, got %v", invoices)
+	}
+	if invoices[0].Amount != 3 || !invoices[0].IsPaid {
+		t.Errorf("newest invoice is wrong: %v", invoices[0])
+	}
+	if old := invoices[1]; old.PaymentHash != hash || !old.IsPaid ||
+		old.Amount != 7 || old.Description != "old invoice" {
+		t.Errorf("old invoice is wrong: %v", old)
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"os"
+	"fmt"
 	"strings"
 	"time"
 
@@ -13,57 +13,175 @@ import (
 	"github.com/kballard/go-shellquote"
 )
 
-func setupCliche() {
-	ln = &cliche.Control{
-		BinaryPath: s.ClicheBinaryPath,
-		JARPath:    s.ClicheJARPath,
-		DataDir:    s.ClicheDataDir,
-	}
-	log.Info().Msg("starting cliche and waiting for a 'ready' event")
-	if err := ln.Start(); err != nil {
-		log.Fatal().Err(err).Msg("failed to start cliche")
+type ClicheBackend struct {
+	control *cliche.Control
+
+	incoming  chan IncomingPayment
+	successes chan PaymentSuccess
+	failures  chan PaymentFailure
+}
+
+func newClicheBackend() *ClicheBackend {
+	if s.ClicheDataDir == "" {
+		log.Fatal().Msg("CLICHE_DATADIR is required for the cliche backend")
 	}
-	log.Info().Msg("cliche is ready")
 
-	if nodeinfo, err := ln.GetInfo(); err != nil {
-		log.Fatal().Err(err).Msg("can't talk to cliche")
-	} else {
-		log.Info().
-			Int("blockHeight", nodeinfo.BlockHeight).
-			Int("channels", len(nodeinfo.Channels)).
-			Msg("cliche connected")
+	return &ClicheBackend{
+		control: &cliche.Control{
+			BinaryPath: s.ClicheBinaryPath,
+			JARPath:    s.ClicheJARPath,
+			DataDir:    s.ClicheDataDir,
+		},
+		incoming:  make(chan IncomingPayment),
+		successes: make(chan PaymentSuccess),
+		failures:  make(chan PaymentFailure),
 	}
 }
 
-func handleClicheEvents() {
-	ctx := context.WithValue(context.Background(), "origin", "cliche")
+func (c *ClicheBackend) Start() error {
+	log.Info().Msg("starting cliche and waiting for a 'ready' event")
+	if err := c.control.Start(); err != nil {
+		return err
+	}
+	log.Info().Msg("cliche is ready")
 
 	go func() {
-		for event := range ln.IncomingPayments {
-			go paymentReceived(ctx, event.PaymentHash, event.Msatoshi)
+		for event := range c.control.IncomingPayments {
+			c.incoming <- IncomingPayment{
+				PaymentHash: event.PaymentHash,
+				Preimage:    event.Preimage,
+				Msatoshi:    event.Msatoshi,
+			}
 		}
 	}()
 
 	go func() {
-		for event := range ln.PaymentSuccesses {
-			go paymentHasSucceeded(
-				ctx,
-				event.Msatoshi,
-				event.FeeMsatoshi,
-				event.Preimage,
-				"",
-				event.PaymentHash,
-			)
+		for event := range c.control.PaymentSuccesses {
+			c.successes <- PaymentSuccess{
+				PaymentHash: event.PaymentHash,
+				Preimage:    event.Preimage,
+				Msatoshi:    event.Msatoshi,
+				FeeMsatoshi: event.FeeMsatoshi,
+			}
 		}
 	}()
 
 	go func() {
-		for event := range ln.PaymentFailures {
-			go paymentHasFailed(ctx, event.PaymentHash, event.Failure)
+		for event := range c.control.PaymentFailures {
+			c.failures <- PaymentFailure{
+				PaymentHash: event.PaymentHash,
+				Failure:     event.Failure,
+			}
 		}
 	}()
+
+	return nil
+}
+
+func (c *ClicheBackend) GetInfo() (NodeInfo, error) {
+	info, err := c.control.GetInfo()
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return NodeInfo{
+		Pubkey:      info.MainPubkey,
+		BlockHeight: info.BlockHeight,
+		Channels:    len(info.Channels),
+	}, nil
+}
+
+func (c *ClicheBackend) CreateInvoice(params CreateInvoiceParams) (CreateInvoiceResult, error) {
+	// TODO: cliche doesn't support a custom expiry yet
+	inv, err := c.control.CreateInvoice(cliche.CreateInvoiceParams{
+		Msatoshi:        params.Msatoshi,
+		Preimage:        params.Preimage,
+		Description:     params.Description,
+		DescriptionHash: params.DescriptionHash,
+		Label:           params.Label,
+	})
+	if err != nil {
+		return CreateInvoiceResult{}, err
+	}
+	return CreateInvoiceResult{
+		Invoice:     inv.Invoice,
+		PaymentHash: inv.PaymentHash,
+	}, nil
+}
+
+func (c *ClicheBackend) PayInvoice(bolt11 string, msatoshi int64) error {
+	_, err := c.control.PayInvoice(cliche.PayInvoiceParams{
+		Invoice:  bolt11,
+		Msatoshi: msatoshi,
+	})
+	return err
 }
 
+func (c *ClicheBackend) CheckPayment(hash string) (PaymentStatus, error) {
+	info, err := c.control.CheckPayment(hash)
+	if err != nil {
+		if strings.Contains(err.Error(),
+			fmt.Sprintf("couldn't get payment '%s' from database", hash),
+		) {
+			// if it's not on cliche's database means it has failed, right?
+			return PaymentStatus{Status: PaymentFailed}, nil
+		}
+		return PaymentStatus{}, err
+	}
+
+	status := PaymentPending
+	switch info.Status {
+	case "complete":
+		status = PaymentComplete
+	case "failed":
+		status = PaymentFailed
+	}
+
+	return PaymentStatus{
+		Status:      status,
+		IsIncoming:  info.IsIncoming,
+		Msatoshi:    info.Msatoshi,
+		FeeMsatoshi: info.FeeMsatoshi,
+		Preimage:    info.Preimage,
+	}, nil
+}
+
+// ListSettledInvoices implements InvoiceLister.
+func (c *ClicheBackend) ListSettledInvoices(since time.Time) ([]IncomingPayment, error) {
+	// cliche can only give us the latest n payments, so we ask for a lot
+	payments, err := c.control.ListPayments(5000)
+	if err != nil {
+		return nil, err
+	}
+
+	var settled []IncomingPayment
+	for _, payment := range payments {
+		if !payment.IsIncoming || payment.Status != "complete" {
+			continue
+		}
+
+		// cliche timestamps are in milliseconds
+		if time.Unix(0, payment.UpdatedAt*int64(time.Millisecond)).Before(since) {
+			continue
+		}
+
+		settled = append(settled, IncomingPayment{
+			PaymentHash: payment.PaymentHash,
+			Preimage:    payment.Preimage,
+			Msatoshi:    payment.Msatoshi,
+			PaidAt:      time.Unix(0, payment.UpdatedAt*int64(time.Millisecond)),
+		})
+	}
+	return settled, nil
+}
+
+func (c *ClicheBackend) Call(method string, params map[string]interface{}) (json.RawMessage, error) {
+	return c.control.Call(method, params)
+}
+
+func (c *ClicheBackend) IncomingPayments() <-chan IncomingPayment { return c.incoming }
+func (c *ClicheBackend) PaymentSuccesses() <-chan PaymentSuccess  { return c.successes }
+func (c *ClicheBackend) PaymentFailures() <-chan PaymentFailure   { return c.failures }
+
 func handleClicheCommand(
 	ctx context.Context,
 	message *tgbotapi.Message,
@@ -118,42 +236,3 @@ func handleClicheCommand(
 
 	send(ctx, u, "<pre><code class=\"language-json\">\n"+string(pretty)+"\n</code></pre>")
 }
-
-func clicheCheckingRoutine() {
-	ctx := context.Background()
-
-	for {
-		time.Sleep(5 * time.Minute)
-
-		select {
-		case err := <-clichePing():
-			if err != nil {
-				log.Error().Err(err).Msg("cliche ping returned error")
-				break
-			} else {
-				log.Debug().Msg("cliche is fine")
-				continue
-			}
-		case <-time.After(3 * time.Minute):
-			log.Error().Msg("cliche is not responding after 3 minutes")
-			break
-		}
-
-		// message admin
-		if admin, err := loadUser(s.AdminAccount); err == nil {
-			send(ctx, admin, "cliche has failed, bot restarting")
-		}
-
-		// exit with a failure so systemd can restart us
-		os.Exit(7)
-	}
-}
-
-func clichePing() chan error {
-	ch := make(chan error)
-	go func() {
-		_, err := ln.Call("ping", map[string]interface{}{})
-		ch <- err
-	}()
-	return ch
-}
@@ -108,7 +108,23 @@ var methods = []def{
 	},
 	{
 		aliases: []string{"api"},
-		argstr:  "[full | invoice | readonly | url | refresh]",
+		argstr:  "[full | invoice | readonly | url | refresh | keys | key create <keyname> [--scope=<scope>] [--max-payment=<satoshis>] [--daily=<satoshis>] [--destinations=<destinations>] | key revoke <keyname>]",
+	},
+	{
+		aliases: []string{"logins"},
+		argstr:  "[export <domain> | block <domain> | unblock <domain>]",
+	},
+	{
+		aliases: []string{"lnaddress"},
+		argstr:  "[min <satoshis> | max <satoshis> | comment <characters> | description [<text>...] | image [<url>] | payerdata <field> <mode> | reset]",
+	},
+	{
+		aliases: []string{"nwc"},
+		argstr:  "[new <connection> [--daily=<satoshis>] | revoke <connection>]",
+	},
+	{
+		aliases: []string{"webhook", "webhooks"},
+		argstr:  "[add <url> [<event>...] | remove <id> | secret | log]",
 	},
 	{
 		aliases: []string{"lightningatm"},
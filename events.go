@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// PaymentEvent is what goes on the /payments/stream. they're all stored on
+// lightning.payment_event so clients can get what they missed by reconnecting
+// with Last-Event-ID. events may come out of order and be repeated after a
+// reconnection, clients must skip the ids they have already seen.
+type PaymentEvent struct {
+	Id        int64          `db:"id"`
+	AccountId int            `db:"account_id"`
+	Event     string         `db:"event"`
+	Data      types.JSONText `db:"data"`
+}
+
+const (
+	EventPaymentReceived  = "payment-received"
+	EventPaymentSent      = "payment-sent"
+	EventPaymentFailed    = "payment-failed"
+	EventInternalReceived = "internal-received"
+	EventBalanceChanged   = "balance-changed"
+)
+
+// events saved up to this long before the Last-Event-ID are replayed, as
+// they may have been published after it.
+const paymentEventReplayOverlap = time.Minute
+
+type paymentEventSubscriber struct {
+	events  chan PaymentEvent
+	dropped chan struct{} // closed when an event didn't fit on events
+}
+
+var (
+	paymentEventSubscribers     = make(map[int]map[*paymentEventSubscriber]bool)
+	paymentEventSubscribersLock sync.Mutex
+)
+
+func publishPaymentEvent(userId int, event string, data interface{}) {
+	j, err := json.Marshal(data)
+	if err != nil {
+		log.Error().Err(err).Interface("data", data).Msg("failed to encode payment event")
+		return
+	}
+
+	ev := PaymentEvent{AccountId: userId, Event: event, Data: types.JSONText(j)}
+	err = pg.Get(&ev.Id, `
+INSERT INTO lightning.payment_event (account_id, event, data)
+VALUES ($1, $2, $3)
+RETURNING id
+    `, userId, event, string(j))
+	if err != nil {
+		log.Error().Err(err).Int("user", userId).Str("event", event).
+			Msg("failed to save payment event")
+		return
+	}
+
+	deliverPaymentEvent(ev)
+}
+
+func deliverPaymentEvent(ev PaymentEvent) {
+	paymentEventSubscribersLock.Lock()
+	defer paymentEventSubscribersLock.Unlock()
+	for sub := range paymentEventSubscribers[ev.AccountId] {
+		select {
+		case sub.events <- ev:
+		default:
+			// slow consumers are disconnected and get this when they reconnect
+			select {
+			case <-sub.dropped:
+			default:
+				close(sub.dropped)
+			}
+		}
+	}
+}
+
+func publishBalanceChanged(userId int) {
+	publishPaymentEvent(userId, EventBalanceChanged, map[string]interface{}{
+		"balance": getBalance(pg, userId),
+	})
+}
+
+func subscribePaymentEvents(userId int) *paymentEventSubscriber {
+	sub := &paymentEventSubscriber{
+		events:  make(chan PaymentEvent, 100),
+		dropped: make(chan struct{}),
+	}
+
+	paymentEventSubscribersLock.Lock()
+	defer paymentEventSubscribersLock.Unlock()
+	if _, ok := paymentEventSubscribers[userId]; !ok {
+		paymentEventSubscribers[userId] = make(map[*paymentEventSubscriber]bool)
+	}
+	paymentEventSubscribers[userId][sub] = true
+
+	return sub
+}
+
+func unsubscribePaymentEvents(userId int, sub *paymentEventSubscriber) {
+	paymentEventSubscribersLock.Lock()
+	defer paymentEventSubscribersLock.Unlock()
+	delete(paymentEventSubscribers[userId], sub)
+	if len(paymentEventSubscribers[userId]) == 0 {
+		delete(paymentEventSubscribers, userId)
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, id int64, event string, data string) {
+	if id != 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	w.(http.Flusher).Flush()
+}
+
+func servePaymentStream(w http.ResponseWriter, r *http.Request, user *User) {
+	if _, ok := w.(http.Flusher); !ok {
+		errorInternal(w)
+		return
+	}
+
+	// subscribe before replaying so nothing falls between the two
+	sub := subscribePaymentEvents(user.Id)
+	defer unsubscribePaymentEvents(user.Id, sub)
+
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(200)
+
+	fmt.Fprintf(w, "retry: %d\n\n", 3000)
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+	lastId, _ := strconv.ParseInt(lastEventId, 10, 64)
+
+	// ids are given when events are saved but they are published in whatever
+	// order they finish, so we remember each one instead of the highest
+	delivered := make(map[int64]bool)
+
+	if lastId > 0 {
+		// for the same reason a client may have seen lastId before some lower
+		// ids, so everything saved shortly before it is replayed too and
+		// clients skip the ids they already have
+		var missed []PaymentEvent
+		err := pg.Select(&missed, `
+SELECT id, account_id, event, data FROM lightning.payment_event
+WHERE account_id = $1 AND id <> $2 AND (id > $2 OR created_at > (
+  SELECT created_at - make_interval(secs => $3)
+  FROM lightning.payment_event WHERE id = $2
+))
+ORDER BY id
+LIMIT 1000
+        `, user.Id, lastId, paymentEventReplayOverlap.Seconds())
+		if err != nil {
+			log.Warn().Err(err).Stringer("user", user).Int64("last", lastId).
+				Msg("failed to load missed payment events")
+		}
+		for _, ev := range missed {
+			writeServerSentEvent(w, ev.Id, ev.Event, string(ev.Data))
+			delivered[ev.Id] = true
+		}
+	}
+	w.(http.Flusher).Flush()
+
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+
+	// end before the server write timeout, clients reconnect with Last-Event-ID
+	end := time.After(4 * time.Minute)
+
+	for {
+		select {
+		case ev := <-sub.events:
+			if delivered[ev.Id] {
+				continue
+			}
+			writeServerSentEvent(w, ev.Id, ev.Event, string(ev.Data))
+			delivered[ev.Id] = true
+		case <-sub.dropped:
+			// we've missed something, the client will reconnect and replay it
+			return
+		case <-keepalive.C:
+			writeServerSentEvent(w, 0, "keepalive", "")
+		case <-end:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func paymentEventsCleanupRoutine() {
+	for {
+		if _, err := pg.Exec(`
+DELETE FROM lightning.payment_event WHERE created_at < now() - interval '30 days'
+        `); err != nil {
+			log.Error().Err(err).Msg("failed to cleanup old payment events")
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
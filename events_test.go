@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+func TestPaymentStream(t *testing.T) {
+	user := &User{Id: 987654}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			servePaymentStream(w, r, user)
+		}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "id: ") {
+				lines <- strings.TrimPrefix(line, "id: ")
+			}
+		}
+	}()
+
+	eventually(t, func() bool {
+		paymentEventSubscribersLock.Lock()
+		defer paymentEventSubscribersLock.Unlock()
+		return len(paymentEventSubscribers[user.Id]) == 1
+	})
+
+	publish := func(id int64) {
+		deliverPaymentEvent(PaymentEvent{
+			Id:        id,
+			AccountId: user.Id,
+			Event:     EventBalanceChanged,
+			Data:      types.JSONText(`{}`),
+		})
+	}
+	expect := func(ids ...string) {
+		t.Helper()
+		for _, id := range ids {
+			select {
+			case got := <-lines:
+				if got != id {
+					t.Fatalf("got event %s, expected %s", got, id)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("event %s never came", id)
+			}
+		}
+	}
+
+	// events published out of order are all delivered, but only once
+	publish(11)
+	publish(10)
+	publish(11)
+	publish(12)
+	expect("11", "10", "12")
+
+	// a consumer that can't keep up is disconnected
+	var sub *paymentEventSubscriber
+	paymentEventSubscribersLock.Lock()
+	for sub = range paymentEventSubscribers[user.Id] {
+	}
+	paymentEventSubscribersLock.Unlock()
+	dropped := false
+	for id := int64(100); id < 1000000 && !dropped; id++ {
+		publish(id)
+		select {
+		case <-sub.dropped:
+			dropped = true
+		default:
+		}
+	}
+	if !dropped {
+		t.Fatal("never dropped an event")
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-lines:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("stream wasn't closed after dropping an event")
+		}
+	}
+}
+
+func TestPaymentStreamReplay(t *testing.T) {
+	setupTestBot(t)
+	user := testUser(t, "eventreplay")
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		var id int64
+		if err := pg.Get(&id, `
+INSERT INTO lightning.payment_event (account_id, event, data)
+VALUES ($1, $2, '{}')
+RETURNING id
+        `, user.Id, EventBalanceChanged); err != nil {
+			t.Fatalf("failed to save event: %s", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// the client got the second event before the first one was published
+	r := httptest.NewRequest("GET", "/payments/stream", nil)
+	r.Header.Set("Last-Event-ID", strconv.FormatInt(ids[1], 10))
+	ctx, cancel := context.WithCancel(r.Context())
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		servePaymentStream(w, r.WithContext(ctx), user)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	<-done
+
+	body := w.Body.String()
+	for _, id := range []int64{ids[0], ids[2]} {
+		if !strings.Contains(body, fmt.Sprintf("id: %d\n", id)) {
+			t.Errorf("event %d wasn't replayed: %q", id, body)
+		}
+	}
+	if strings.Contains(body, fmt.Sprintf("id: %d\n", ids[1])) {
+		t.Errorf("event %d was replayed", ids[1])
+	}
+}
@@ -4,7 +4,10 @@ go 1.16
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.1
-	github.com/btcsuite/btcd v0.20.1-beta.0.20200515232429-9f0179fd2c46
+	github.com/alicebob/miniredis/v2 v2.14.1
+	github.com/btcsuite/btcd v0.22.1
+	github.com/btcsuite/btcd/btcec/v2 v2.3.4
+	github.com/btcsuite/btcutil v1.0.3-0.20201208143702-a53e38424cce
 	github.com/die-net/lrucache v0.0.0-20220628165024-20a71bc65bf1
 	github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
 	github.com/fiatjaf/go-cliche v0.3.1
@@ -37,8 +40,11 @@ require (
 	github.com/tuotoo/qrcode v0.0.0-20190222102259-ac9c44189bf2
 	github.com/willf/bitset v1.1.10 // indirect
 	golang.org/x/image v0.1.0 // indirect
-	gopkg.in/antage/eventsource.v1 v1.0.0-20150318155416-803f4c5af225
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b
 	gopkg.in/jmcvetta/napping.v3 v3.2.0
 	gopkg.in/redis.v5 v5.2.9
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
+
+// btcd v0.22.1 asks for a btcutil that breaks the btcwallet lnd v0.10 depends on
+replace github.com/btcsuite/btcutil => github.com/btcsuite/btcutil v1.0.2
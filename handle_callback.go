@@ -68,6 +68,9 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 	case strings.HasPrefix(cb.Data, "pay="):
 		handlePayCallback(ctx)
 		return
+	case strings.HasPrefix(cb.Data, "onchain="):
+		handleSendToAddressCallback(ctx, cb.Data[8:])
+		return
 	case strings.HasPrefix(cb.Data, "lnurlpay="):
 		defer removeKeyboardButtons(ctx)
 		msats, _ := strconv.ParseInt(cb.Data[9:], 10, 64)
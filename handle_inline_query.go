@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	decodepay "github.com/fiatjaf/ln-decodepay"
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/kballard/go-shellquote"
@@ -44,8 +45,40 @@ func handleInlineQuery(ctx context.Context, q *tgbotapi.InlineQuery) {
 		command = command[1:]
 	}
 
-	if len(argv) < 2 {
-		goto answerEmpty
+	// a payment request pasted alone is shared in the form the bot and
+	// wallets on the other side will recognize
+	if len(argv) == 1 {
+		req, ok := parsePaymentRequest(text)
+		if !ok {
+			goto answerEmpty
+		}
+
+		shared := req.String()
+		msats := req.AmountMsat
+		if req.Kind() == "onchain" {
+			shared = text
+		}
+		if req.Bolt11 != "" {
+			if inv, err := decodepay.Decodepay(req.Bolt11); err == nil {
+				msats = inv.MSatoshi
+			}
+		}
+
+		result := tgbotapi.NewInlineQueryResultArticleHTML(
+			"pr-"+hashString("%s", shared)[:16],
+			translateTemplate(ctx, t.INLINEPAYREQRESULT, t.T{
+				"Kind": req.Kind(),
+				"Sats": msats / 1000,
+			}),
+			"<code>"+escapeHTML(shared)+"</code>",
+		)
+
+		resp, err = bot.AnswerInlineQuery(tgbotapi.InlineConfig{
+			InlineQueryID: q.ID,
+			Results:       []interface{}{result},
+			IsPersonal:    true,
+		})
+		goto responded
 	}
 
 	switch command {
@@ -97,24 +97,26 @@ func handleTelegramMessage(ctx context.Context, message *tgbotapi.Message) {
 	// when receiving a forwarded invoice (from messages from other people?)
 	// or just the full text of a an invoice (shared from a phone wallet?)
 	if !strings.HasPrefix(messageText, "/") {
-		if bolt11, lnurltext, address, ok := searchForInvoice(ctx); ok {
-			if bolt11 != "" {
-				opts, _, err = parse("/pay " + bolt11)
+		if req, ok := searchForInvoice(ctx); ok {
+			switch req.Kind() {
+			case "bolt11":
+				opts, _, err = parse("/pay " + req.Bolt11)
 				if err != nil {
 					return
 				}
 				goto parsed
-			}
-			if lnurltext != "" {
-				opts, _, err = parse("/lnurl " + lnurltext)
+			case "lnurl", "lightning_address":
+				opts, _, err = parse("/lnurl " + req.String())
 				if err != nil {
 					return
 				}
 				goto parsed
-			}
-
-			if address != "" {
-				opts, _, err = parse("/lnurl " + address)
+			case "onchain":
+				if req.AmountMsat == 0 {
+					break
+				}
+				opts, _, err = parse(fmt.Sprintf("/send %d %s",
+					req.AmountMsat/1000, req.Onchain))
 				if err != nil {
 					return
 				}
@@ -187,6 +189,14 @@ parsed:
 		go handleBlueWallet(ctx, opts)
 	case opts["api"].(bool):
 		go handleAPI(ctx, opts)
+	case opts["logins"].(bool):
+		go handleLogins(ctx, opts)
+	case opts["lnaddress"].(bool):
+		go handleLightningAddress(ctx, opts)
+	case opts["nwc"].(bool):
+		go handleNWC(ctx, opts)
+	case opts["webhook"].(bool), opts["webhooks"].(bool):
+		go handleWebhook(ctx, opts)
 	case opts["lightningatm"].(bool):
 		go handleLightningATM(ctx)
 	case opts["triangles"].(bool):
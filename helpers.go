@@ -11,12 +11,14 @@ import (
 	"fmt"
 	"image"
 	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/fiatjaf/go-lnurl"
@@ -88,6 +90,8 @@ func parseAmountString(amt string) (msats int64, err error) {
 	return calculate(amt)
 }
 
+var implicitMultiplication = regexp.MustCompile(`([0-9.)])\s*([a-z]+)`)
+
 func calculate(expr string) (int64, error) {
 	// replace emojis
 	expr = strings.ReplaceAll(expr, "🍌", "banana")
@@ -105,6 +109,16 @@ func calculate(expr string) (int64, error) {
 	// lowercase
 	expr = strings.ToLower(expr)
 
+	// "10usd" or "2 beer" mean multiplication
+	expr = implicitMultiplication.ReplaceAllStringFunc(expr, func(match string) string {
+		parts := implicitMultiplication.FindStringSubmatch(match)
+		if _, ok := menuItems[parts[2]]; ok ||
+			stringIsIn(strings.ToUpper(parts[2]), CURRENCIES) {
+			return parts[1] + "*" + parts[2]
+		}
+		return match
+	})
+
 	// prepare mathcat
 	p := mathcat.New()
 
@@ -143,12 +157,12 @@ func getDollarPrice(msat int64) string {
 	return fmt.Sprintf("%.2f USD", float64(msat)/float64(rate))
 }
 
-func searchForInvoice(ctx context.Context) (bolt11, lnurltext, address string, ok bool) {
+func searchForInvoice(ctx context.Context) (req PaymentRequest, ok bool) {
 	var message interface{}
 	if imessage := ctx.Value("message"); imessage != nil {
 		message = imessage
 	} else {
-		return "", "", "", false
+		return PaymentRequest{}, false
 	}
 
 	var text string
@@ -161,17 +175,7 @@ func searchForInvoice(ctx context.Context) (bolt11, lnurltext, address string, o
 		}
 	}
 
-	if bolt11, ok = getBolt11(text); ok {
-		return
-	}
-
-	if lnurltext, ok = lnurl.FindLNURLInText(text); ok {
-		return
-	}
-
-	if name, domain, okW := lnurl.ParseInternetIdentifier(text); okW {
-		address = name + "@" + domain
-		ok = okW
+	if req, ok = parsePaymentRequest(text); ok {
 		return
 	}
 
@@ -201,13 +205,7 @@ func searchForInvoice(ctx context.Context) (bolt11, lnurltext, address string, o
 			Msg("got qr code data")
 		send(ctx, text)
 
-		if bolt11, ok = getBolt11(text); ok {
-			return
-		}
-
-		if lnurltext, ok = lnurl.FindLNURLInText(text); ok {
-			return
-		}
+		req, ok = parsePaymentRequest(text)
 	}
 
 	return
@@ -430,8 +428,23 @@ func getVariadicFieldOrReplyToContent(ctx context.Context, opts docopt.Opts, opt
 	return ""
 }
 
+// image URLs are given by users, so they are only fetched from public
+// addresses and only up to these sizes.
+var imageClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         publicDialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+const (
+	maxImageBytes  = 5 << 20
+	maxImagePixels = 4096 * 4096
+)
+
 func imageBytesFromURL(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+	resp, err := imageClient.Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -441,9 +454,34 @@ func imageBytesFromURL(url string) ([]byte, error) {
 		return nil, errors.New("image returned status " + strconv.Itoa(resp.StatusCode))
 	}
 
-	img, _, err := image.Decode(resp.Body)
+	b, err := thumbnailImage(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image from %s: %w", url, err)
+	}
+	return b, nil
+}
+
+func thumbnailImage(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("image is bigger than %d bytes", maxImageBytes)
+	}
+
+	// check the dimensions before decoding, a small file can be a huge image
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("image is %dx%d, too big", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image from %s: %w", url, err)
+		return nil, fmt.Errorf("failed to decode image: %w", err)
 	}
 
 	img = resize.Resize(160, 0, img, resize.NearestNeighbor)
@@ -460,9 +498,12 @@ type BalanceGetter interface {
 	Get(interface{}, string, ...interface{}) error
 }
 
+// getBalance reads lightning.account_balance, which is kept up to date by a
+// trigger on lightning.transaction, so it already includes whatever was
+// inserted on txn.
 func getBalance(txn BalanceGetter, userId int) int64 {
 	var balance int64
-	err := txn.Get(&balance, "SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1", userId)
+	err := txn.Get(&balance, "SELECT balance::numeric(13) FROM lightning.account_balance WHERE account_id = $1", userId)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.Warn().Err(err).Int("account", userId).Msg("failed to fetch balance")
@@ -475,7 +516,12 @@ func getBalance(txn BalanceGetter, userId int) int64 {
 func checkProxyBalance(txn BalanceGetter) error {
 	// check proxy balance (should be always zero)
 	var proxybalance int64
-	err := txn.Get(&proxybalance, "SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1", s.ProxyAccount)
+	err := txn.Get(&proxybalance, `
+SELECT coalesce(
+  (SELECT balance FROM lightning.account_balance WHERE account_id = $1),
+  0
+)::numeric(13)
+    `, s.ProxyAccount)
 	if err != nil {
 		return err
 	} else if proxybalance != 0 {
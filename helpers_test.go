@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestThumbnailImage(t *testing.T) {
+	encode := func(width, height int) []byte {
+		buf := &bytes.Buffer{}
+		jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, width, height)), &jpeg.Options{Quality: 1})
+		return buf.Bytes()
+	}
+
+	b, err := thumbnailImage(bytes.NewReader(encode(640, 480)))
+	if err != nil {
+		t.Fatalf("failed to make thumbnail: %s", err)
+	}
+	if config, err := jpeg.DecodeConfig(bytes.NewReader(b)); err != nil || config.Width != 160 {
+		t.Errorf("thumbnail is %v, %v", config, err)
+	}
+
+	if _, err := thumbnailImage(bytes.NewReader(encode(5000, 4000))); err == nil {
+		t.Error("accepted an image with too many pixels")
+	}
+	if _, err := thumbnailImage(strings.NewReader(strings.Repeat("x", maxImageBytes+1))); err == nil {
+		t.Error("accepted an image with too many bytes")
+	}
+	if _, err := thumbnailImage(strings.NewReader("not an image")); err == nil {
+		t.Error("accepted something that isn't an image")
+	}
+}
+
+func TestImageBytesFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("image was fetched from a local address")
+	}))
+	defer server.Close()
+
+	if _, err := imageBytesFromURL(server.URL + "/image.jpg"); err == nil {
+		t.Error("fetched an image from a local address")
+	}
+}
+
+// BenchmarkGetBalance compares reading a balance from the ledger kept by the
+// trigger with summing all transactions of the account.
+func BenchmarkGetBalance(b *testing.B) {
+	setupTestBot(b)
+
+	u := testUser(b, "busy")
+	other := testUser(b, "other")
+	if _, err := pg.Exec(`
+INSERT INTO lightning.transaction (time, from_id, to_id, amount, fees)
+SELECT now() - make_interval(mins => i),
+  CASE WHEN i % 3 = 0 THEN $1::int ELSE $2::int END,
+  CASE WHEN i % 3 = 0 THEN $2::int ELSE $1::int END,
+  1000 + i, CASE WHEN i % 3 = 0 THEN 10 ELSE 0 END
+FROM generate_series(1, 5000) AS i
+    `, u.Id, other.Id); err != nil {
+		b.Fatalf("failed to insert transactions: %s", err)
+	}
+
+	var recomputed int64
+	if err := pg.Get(&recomputed, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+    `, u.Id); err != nil {
+		b.Fatal(err)
+	}
+	if ledger := getBalance(pg, u.Id); ledger != recomputed {
+		b.Fatalf("ledger says %d, transactions say %d", ledger, recomputed)
+	}
+
+	b.Run("ledger", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			getBalance(pg, u.Id)
+		}
+	})
+
+	b.Run("transactions", func(b *testing.B) {
+		var balance int64
+		for i := 0; i < b.N; i++ {
+			pg.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+            `, u.Id)
+		}
+	})
+}
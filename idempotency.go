@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const idempotencyTTL = 24 * time.Hour
+
+// StoredResponse is what we keep on redis for each Idempotency-Key.
+// while the first request is still running only Fingerprint is set.
+type StoredResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Done        bool   `json:"done"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	done   bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = 200
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotentCall is on the context of calls going through idempotencyMiddleware
+// so the payment functions can tell it they have started.
+type idempotentCall struct {
+	paymentStarted int32
+}
+
+const idempotentCallKey = "idempotentcall"
+
+// markPaymentStarted is called before any money moves, after that a call
+// that panics can't be run again.
+func markPaymentStarted(ctx context.Context) {
+	if call, ok := ctx.Value(idempotentCallKey).(*idempotentCall); ok {
+		atomic.StoreInt32(&call.paymentStarted, 1)
+	}
+}
+
+// idempotencyMiddleware makes a mutating API call with an Idempotency-Key
+// header run only once per key and user. retries get the first response back,
+// whatever it was.
+func idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// only authenticated calls, so nobody can poison someone else's keys.
+		// the handler gets the same caller from the request context.
+		ctx, user, permission, err := authenticateAPICall(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		call := &idempotentCall{}
+		ctx = context.WithValue(ctx, idempotentCallKey, call)
+		r = r.WithContext(context.WithValue(r.Context(), apiCallAuthKey,
+			apiCallAuth{ctx, user, permission}))
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeAPIError(w, APIErrInvalidBody)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		rkey := fmt.Sprintf("idempotency:%d:%s", user.Id, hashString("%s", key))
+		fingerprint := hashString("%s %s?%s %s", r.Method, r.URL.Path, r.URL.RawQuery, body)
+
+		pending, _ := json.Marshal(StoredResponse{Fingerprint: fingerprint})
+		if ok, err := rds.SetNX(rkey, pending, idempotencyTTL).Result(); err != nil {
+			log.Error().Err(err).Stringer("user", user).Msg("failed to check idempotency key")
+			writeAPIError(w, APIErrInternal)
+			return
+		} else if !ok {
+			replayStoredResponse(w, rkey, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.done {
+				return
+			}
+
+			// the handler panicked
+			if atomic.LoadInt32(&call.paymentStarted) == 0 {
+				// nothing was done, don't block retries for 24h
+				rds.Del(rkey)
+				return
+			}
+
+			// a payment may be out, so retries must not pay again
+			body, _ := json.Marshal(struct {
+				Error *APIError `json:"error"`
+			}{APIErrInternal})
+			storeIdempotentResponse(rkey, StoredResponse{
+				Fingerprint: fingerprint,
+				Done:        true,
+				Status:      APIErrInternal.Status,
+				ContentType: "application/json",
+				Body:        body,
+			})
+		}()
+		next.ServeHTTP(rec, r)
+		rec.done = true
+
+		if err := storeIdempotentResponse(rkey, StoredResponse{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      rec.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		}); err != nil {
+			log.Error().Err(err).Stringer("user", user).Str("path", r.URL.Path).
+				Msg("failed to store idempotent response")
+		}
+	})
+}
+
+func storeIdempotentResponse(rkey string, stored StoredResponse) error {
+	b, _ := json.Marshal(stored)
+	return rds.Set(rkey, b, idempotencyTTL).Err()
+}
+
+// idempotent wraps mutating API calls, see idempotencyMiddleware.
+func idempotent(handler http.HandlerFunc) http.Handler {
+	return idempotencyMiddleware(handler)
+}
+
+func replayStoredResponse(w http.ResponseWriter, rkey string, fingerprint string) {
+	var stored StoredResponse
+	b, err := rds.Get(rkey).Result()
+	if err != nil || json.Unmarshal([]byte(b), &stored) != nil {
+		writeAPIError(w, APIErrInternal)
+		return
+	}
+
+	switch {
+	case stored.Fingerprint != fingerprint:
+		writeAPIError(w, apiError(422, "idempotency_key_reused",
+			"This Idempotency-Key was already used for a different request."))
+	case !stored.Done:
+		writeAPIError(w, apiError(409, "request_in_progress",
+			"A request with this Idempotency-Key is still being processed."))
+	default:
+		if stored.ContentType != "" {
+			w.Header().Set("Content-Type", stored.ContentType)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		if stored.Status == 0 {
+			stored.Status = 200
+		}
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	setupTestBot(t)
+	u := testUser(t, "idempotent")
+
+	calls := 0
+	status := 200
+	handler := idempotencyMiddleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// the caller was authenticated only once, by the middleware
+			if _, ok := r.Context().Value(apiCallAuthKey).(apiCallAuth); !ok {
+				t.Error("caller isn't on the request context")
+			}
+			_, user, _, err := loadUserFromAPICall(r)
+			if err != nil || user.Id != u.Id {
+				t.Errorf("got user %v, %v", user, err)
+			}
+
+			calls++
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "call %d", calls)
+		}))
+
+	token := base64.StdEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%d:%s", u.Id, u.Password)))
+	call := func(key string, target string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Basic "+token)
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	first := call("a", "/api/v2/send?x=1", `{}`)
+	retry := call("a", "/api/v2/send?x=1", `{}`)
+	if calls != 1 || retry.Body.String() != first.Body.String() ||
+		retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry wasn't replayed: %d calls, %q", calls, retry.Body.String())
+	}
+
+	if w := call("a", "/api/v2/send?x=2", `{}`); w.Code != 422 {
+		t.Errorf("a different query got %d", w.Code)
+	}
+	if w := call("a", "/api/v2/send?x=1", `{"other":1}`); w.Code != 422 {
+		t.Errorf("a different body got %d", w.Code)
+	}
+
+	// server failures are stored too, a payment may have gone out
+	status = 500
+	call("b", "/api/v2/send", `{}`)
+	status = 200
+	if w := call("b", "/api/v2/send", `{}`); w.Code != 500 || calls != 2 {
+		t.Errorf("retry after a failure got %d after %d calls", w.Code, calls)
+	}
+
+	// and so are client errors
+	status = 400
+	call("c", "/api/v2/send", `{}`)
+	status = 200
+	if w := call("c", "/api/v2/send", `{}`); w.Code != 400 || calls != 3 {
+		t.Errorf("retry after a client error got %d after %d calls", w.Code, calls)
+	}
+}
+
+func TestIdempotencyMiddlewarePanic(t *testing.T) {
+	setupTestBot(t)
+	u := testUser(t, "idempotentpanic")
+
+	calls := 0
+	pay := false
+	handler := idempotencyMiddleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if pay {
+				ctx, _, _, _ := loadUserFromAPICall(r)
+				markPaymentStarted(ctx)
+			}
+			panic("failed")
+		}))
+
+	call := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v2/send", strings.NewReader(`{}`))
+		r.Header.Set("Authorization", "Basic "+apiToken(u))
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		func() {
+			defer func() { recover() }()
+			handler.ServeHTTP(w, r)
+		}()
+		return w
+	}
+
+	// nothing was paid, so it can be tried again
+	call("a")
+	call("a")
+	if calls != 2 {
+		t.Errorf("panic before paying blocked the retry, %d calls", calls)
+	}
+
+	// a payment may be out, so it can't
+	pay = true
+	call("b")
+	if w := call("b"); w.Code != 500 || calls != 3 {
+		t.Errorf("retry after a panic while paying got %d after %d calls", w.Code, calls)
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
-	"strconv"
+	"fmt"
 	"time"
 
 	"github.com/docopt/docopt-go"
@@ -14,13 +14,13 @@ import (
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	cmap "github.com/orcaman/concurrent-map"
-	"gopkg.in/antage/eventsource.v1"
 )
 
 type InvoiceData struct {
 	UserId    int
 	MessageId interface{}
 	Preimage  string
+	Bolt11    string
 
 	*MakeInvoiceArgs
 }
@@ -37,14 +37,14 @@ func (inv InvoiceData) Hash() string {
 }
 
 type MakeInvoiceArgs struct {
-	IgnoreRateLimit bool
-	Description     string
-	DescriptionHash string
-	Msatoshi        int64
-	Expiry          *time.Duration
-	Tag             string
-	Extra           InvoiceExtra
-	BlueWallet      bool
+	IgnoreRateLimit   bool
+	Description       string
+	DescriptionHash   string
+	HashedDescription string // what DescriptionHash commits to, some backends need it
+	Msatoshi          int64
+	Expiry            *time.Duration
+	Tag               string
+	Extra             InvoiceExtra
 }
 
 type InvoiceExtra struct {
@@ -57,6 +57,12 @@ type InvoiceExtra struct {
 	// webhook
 	Webhook string
 
+	// nostr zap request (NIP-57), as received
+	ZapRequest string
+
+	// created on our lnurl-pay callback, so it can be checked with LUD-21
+	LNURLPay bool
+
 	// telegram message
 	Message *tgbotapi.Message
 }
@@ -131,13 +137,17 @@ func handleInvoice(ctx context.Context, opts docopt.Opts, desc string) {
 }
 
 // what happens when a payment is received
-var userPaymentStream = cmap.New() // make(map[int]eventsource.EventSource)
 
 func paymentReceived(
 	ctx context.Context,
 	hash string,
 	amount int64,
+	paidAt time.Time,
 ) (user *User, err error) {
+	if paidAt.Unix() <= 0 {
+		paidAt = time.Now()
+	}
+
 	data, err := loadInvoiceData(hash)
 	if err != nil {
 		log.Debug().Err(err).Interface("hash", hash).
@@ -154,11 +164,11 @@ func paymentReceived(
 
 	_, err = pg.Exec(`
 INSERT INTO lightning.transaction
-  (to_id, amount, description, payment_hash, preimage, tag)
-VALUES ($1, $2, $3, $4, $5, $6)
+  (to_id, amount, description, payment_hash, preimage, tag, time)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
 ON CONFLICT (payment_hash) DO UPDATE SET to_id = $1
     `, user.Id, amount, data.Description, hash,
-		data.Preimage, sql.NullString{String: data.Tag, Valid: data.Tag != ""})
+		data.Preimage, sql.NullString{String: data.Tag, Valid: data.Tag != ""}, paidAt)
 	if err != nil {
 		log.Error().Err(err).
 			Stringer("user", user).Str("hash", hash).
@@ -167,19 +177,41 @@ ON CONFLICT (payment_hash) DO UPDATE SET to_id = $1
 		return
 	}
 
+	// the transaction may be aggregated away later, this stays
+	if _, err := pg.Exec(`
+UPDATE lightning.invoice SET paid_at = $2
+WHERE payment_hash = $1 AND paid_at IS NULL
+    `, hash, paidAt); err != nil {
+		log.Warn().Err(err).Str("hash", hash).Msg("failed to mark invoice as paid")
+	}
+
 	go resolveWaitingInvoice(hash, data)
+	go notifyInvoiceWebhooks(user, hash, amount, data)
+	if data.Extra.ZapRequest != "" {
+		go publishZapReceipt(hash, data, paidAt)
+	}
+	go notifyUserWebhooks(user, WalletEventWebhook{
+		Event:       WebhookPaymentReceived,
+		PaymentHash: hash,
+		Msatoshi:    amount,
+		Preimage:    data.Preimage,
+		Description: data.Description,
+		Tag:         data.Tag,
+	})
 
 	user.track("got payment", map[string]interface{}{
 		"sats": amount / 1000,
 	})
 
-	// send to user stream if the user is listening
-	if ies, ok := userPaymentStream.Get(strconv.Itoa(user.Id)); ok {
-		go ies.(eventsource.EventSource).SendEventMessage(
-			`{"payment_hash": "`+hash+`", "msatoshi": `+
-				strconv.FormatInt(data.Msatoshi, 10)+`}`,
-			"payment-received", "")
-	}
+	// send to user stream
+	go func() {
+		publishPaymentEvent(user.Id, EventPaymentReceived, map[string]interface{}{
+			"payment_hash": hash,
+			"msatoshi":     amount,
+			"description":  data.Description,
+		})
+		publishBalanceChanged(user.Id)
+	}()
 
 	tmplParams := t.T{
 		"Sats": data.Msatoshi / 1000,
@@ -198,61 +230,167 @@ ON CONFLICT (payment_hash) DO UPDATE SET to_id = $1
 	return
 }
 
+// saveInvoiceData stores the invoice on postgres, which is the source of truth,
+// and caches it on redis until it expires.
 func saveInvoiceData(hash string, data InvoiceData) error {
 	b, _ := json.Marshal(data)
-	return rds.Set("invdata:"+hash, string(b), *data.Expiry).Err()
+
+	_, err := pg.Exec(`
+INSERT INTO lightning.invoice
+  (payment_hash, account_id, preimage, msatoshi, description, tag, expires_at, data, bolt11)
+VALUES ($1, $2, $3, $4, $5, $6, now() + make_interval(secs => $7), $8, $9)
+ON CONFLICT (payment_hash) DO NOTHING
+    `, hash, data.UserId, data.Preimage, data.Msatoshi, data.Description,
+		sql.NullString{String: data.Tag, Valid: data.Tag != ""},
+		data.Expiry.Seconds(), string(b),
+		sql.NullString{String: data.Bolt11, Valid: data.Bolt11 != ""})
+	if err != nil {
+		log.Error().Err(err).Str("hash", hash).Msg("failed to save invoice data")
+		return err
+	}
+
+	rds.Set("invdata:"+hash, string(b), *data.Expiry)
+	return nil
 }
 
 func loadInvoiceData(hash string) (data InvoiceData, err error) {
 	b, err := rds.Get("invdata:" + hash).Result()
 	if err != nil {
-		return
+		// not cached (or expired from the cache), so get it from postgres
+		err = pg.Get(&b, `SELECT data FROM lightning.invoice WHERE payment_hash = $1`, hash)
+		if err != nil {
+			return
+		}
 	}
 	err = json.Unmarshal([]byte(b), &data)
 	return
 }
 
-func checkAllIncomingPayments(ctx context.Context) {
-	// TODO
-	// from := time.Now().AddDate(0, 0, -7)
-
-	// var lastInvoiceTime time.Time
-	// err := pg.Get(&lastInvoiceTime, `
-	//   SELECT max(time) FROM lightning.transaction WHERE from_id IS NULL
-	// `)
-	// if err != nil {
-	// 	log.Error().Err(err).Msg("failed to get last invoice time from db")
-	// }
-
-	// if lastInvoiceTime.Before(from) {
-	// 	from = lastInvoiceTime
-	// }
-
-	// res, err := ln.Call("audit", eclair.Params{"from": from.Unix()})
-	// if err != nil {
-	// 	log.Error().Err(err).Msg("failed to call 'audit'")
-	// 	return
-	// }
-
-	// log.Debug().Time("from", from).Int64("n", res.Get("received.#").Int()).
-	// 	Msg("checking incoming payments")
-	// for _, recv := range res.Get("received").Array() {
-	// 	hash := recv.Get("paymentHash").String()
-	// 	var exists bool
-	// 	if err := pg.Get(&exists, `
-	//         SELECT true FROM lightning.transaction
-	//         WHERE payment_hash = $1
-	//     `, hash); err != nil && err != sql.ErrNoRows {
-	// 		log.Error().Err(err).Str("hash", hash).Msg("checking existence of invoice hash")
-	// 		continue
-	// 	}
-
-	// 	if !exists {
-	// 		var amount int64 = 0
-	// 		for _, part := range recv.Get("parts").Array() {
-	// 			amount += part.Get("amount").Int()
-	// 		}
-	// 		go paymentReceived(ctx, hash, amount)
-	// 	}
-	// }
+// importRedisInvoiceData copies invoices that only exist on redis (created
+// before lightning.invoice existed) to postgres. safe to run many times.
+func importRedisInvoiceData() (imported int, err error) {
+	var cursor uint64
+	for {
+		keys, next, err := rds.Scan(cursor, "invdata:*", 500).Result()
+		if err != nil {
+			return imported, fmt.Errorf("failed to scan invdata keys: %w", err)
+		}
+
+		for _, key := range keys {
+			hash := key[len("invdata:"):]
+
+			b, err := rds.Get(key).Result()
+			if err != nil {
+				continue
+			}
+			var data InvoiceData
+			if err := json.Unmarshal([]byte(b), &data); err != nil ||
+				data.MakeInvoiceArgs == nil {
+				log.Warn().Err(err).Str("hash", hash).Msg("invalid invdata on redis")
+				continue
+			}
+			// keys without an expiration (-1) or gone in the meantime (-2)
+			// get the expiry the invoice was made with
+			ttl, _ := rds.TTL(key).Result()
+			if ttl < 0 {
+				ttl = importedInvoiceExpiry
+				if data.Expiry != nil {
+					ttl = *data.Expiry
+				}
+			}
+
+			res, err := pg.Exec(`
+INSERT INTO lightning.invoice
+  (payment_hash, account_id, preimage, msatoshi, description, tag, expires_at, data)
+VALUES ($1, $2, $3, $4, $5, $6, now() + make_interval(secs => $7), $8)
+ON CONFLICT (payment_hash) DO NOTHING
+            `, hash, data.UserId, data.Preimage, data.Msatoshi, data.Description,
+				sql.NullString{String: data.Tag, Valid: data.Tag != ""},
+				ttl.Seconds(), b)
+			if err != nil {
+				log.Error().Err(err).Str("hash", hash).
+					Msg("failed to import invdata to postgres")
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				imported++
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return imported, nil
+}
+
+const importedInvoiceExpiry = time.Hour
+
+func incomingPaymentsCheckingRoutine(ctx context.Context) {
+	for {
+		if repaired := checkAllIncomingPayments(ctx); repaired > 0 {
+			log.Info().Int("n", repaired).Msg("credited missed incoming payments")
+			if admin, err := loadUser(s.AdminAccount); err == nil {
+				send(ctx, admin, fmt.Sprintf(
+					"credited %d incoming payments that were missed", repaired))
+			}
+		}
+
+		time.Sleep(30 * time.Minute)
+	}
+}
+
+// checkAllIncomingPayments credits invoices settled on the node that we
+// never saw an event for. returns how many were credited.
+func checkAllIncomingPayments(ctx context.Context) (repaired int) {
+	lister, ok := ln.(InvoiceLister)
+	if !ok {
+		log.Debug().Str("backend", s.LightningBackend).
+			Msg("backend can't list invoices, skipping incoming payments check")
+		return
+	}
+
+	from := time.Now().AddDate(0, 0, -7)
+
+	var lastInvoiceTime *time.Time
+	err := pg.Get(&lastInvoiceTime, `
+      SELECT max(time) FROM lightning.transaction WHERE from_id IS NULL
+    `)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get last invoice time from db")
+	}
+
+	if lastInvoiceTime != nil && lastInvoiceTime.Before(from) {
+		from = *lastInvoiceTime
+	}
+
+	settled, err := lister.ListSettledInvoices(from)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list settled invoices")
+		return
+	}
+
+	log.Debug().Time("from", from).Int("n", len(settled)).
+		Msg("checking incoming payments")
+	for _, recv := range settled {
+		var exists bool
+		if err := pg.Get(&exists, `
+            SELECT true FROM lightning.transaction
+            WHERE payment_hash = $1
+        `, recv.PaymentHash); err != nil && err != sql.ErrNoRows {
+			log.Error().Err(err).Str("hash", recv.PaymentHash).
+				Msg("checking existence of invoice hash")
+			continue
+		}
+
+		if !exists {
+			if _, err := paymentReceived(ctx, recv.PaymentHash, recv.Msatoshi, recv.PaidAt); err == nil {
+				repaired++
+			}
+		}
+	}
+
+	return repaired
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/go-lnurl"
+	"github.com/fiatjaf/lntxbot/t"
+)
+
+const (
+	defaultMinSendable    = 100000     // msat
+	defaultMaxSendable    = 1000000000 // msat
+	defaultCommentAllowed = 422
+	maxCommentAllowed     = 2000
+)
+
+// payer data fields from LUD-18 that can be asked for, and their default modes.
+var defaultPayerDataModes = map[string]string{
+	"name":       "optional",
+	"identifier": "optional",
+	"email":      "optional",
+	"pubkey":     "off",
+}
+
+// LightningAddressSettings is stored on the user appdata, zero values mean
+// the defaults.
+type LightningAddressSettings struct {
+	MinSendable    int64             `json:"min_sendable,omitempty"`
+	MaxSendable    int64             `json:"max_sendable,omitempty"`
+	CommentAllowed *int64            `json:"comment_allowed,omitempty"`
+	Description    string            `json:"description,omitempty"`
+	Image          []byte            `json:"image,omitempty"` // jpeg
+	PayerData      map[string]string `json:"payer_data,omitempty"`
+}
+
+func (u User) getLightningAddressSettings() (settings LightningAddressSettings, err error) {
+	err = u.getAppData("lnaddress", &settings)
+	return
+}
+
+func (u User) setLightningAddressSettings(settings LightningAddressSettings) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	return u.setAppData("lnaddress", settings)
+}
+
+func (settings LightningAddressSettings) validate() error {
+	if settings.minSendable() < 1000 {
+		return errors.New("The minimum can't be less than 1 satoshi.")
+	}
+	if settings.maxSendable() < settings.minSendable() {
+		return errors.New("The maximum can't be less than the minimum.")
+	}
+	if c := settings.commentAllowed(); c < 0 || c > maxCommentAllowed {
+		return fmt.Errorf("Comments can have between 0 and %d characters.", maxCommentAllowed)
+	}
+	if len(settings.Description) > 300 {
+		return errors.New("The description is too long.")
+	}
+	for field, mode := range settings.PayerData {
+		if _, ok := defaultPayerDataModes[field]; !ok {
+			return fmt.Errorf("Unknown payer data field '%s'.", field)
+		}
+		if mode != "off" && mode != "optional" && mode != "mandatory" {
+			return fmt.Errorf("Payer data fields can be off, optional or mandatory, not '%s'.", mode)
+		}
+	}
+	return nil
+}
+
+func (settings LightningAddressSettings) minSendable() int64 {
+	if settings.MinSendable == 0 {
+		return defaultMinSendable
+	}
+	return settings.MinSendable
+}
+
+func (settings LightningAddressSettings) maxSendable() int64 {
+	if settings.MaxSendable == 0 {
+		return defaultMaxSendable
+	}
+	return settings.MaxSendable
+}
+
+func (settings LightningAddressSettings) commentAllowed() int64 {
+	if settings.CommentAllowed == nil {
+		return defaultCommentAllowed
+	}
+	return *settings.CommentAllowed
+}
+
+func (settings LightningAddressSettings) payerDataMode(field string) string {
+	if mode, ok := settings.PayerData[field]; ok {
+		return mode
+	}
+	return defaultPayerDataModes[field]
+}
+
+func (settings LightningAddressSettings) payerDataModes() map[string]string {
+	modes := make(map[string]string, len(defaultPayerDataModes))
+	for field := range defaultPayerDataModes {
+		modes[field] = settings.payerDataMode(field)
+	}
+	return modes
+}
+
+func (settings LightningAddressSettings) payerDataSpec() *lnurl.PayerDataSpec {
+	item := func(field string) *lnurl.PayerDataItemSpec {
+		switch settings.payerDataMode(field) {
+		case "optional":
+			return &lnurl.PayerDataItemSpec{}
+		case "mandatory":
+			return &lnurl.PayerDataItemSpec{Mandatory: true}
+		}
+		return nil
+	}
+
+	spec := &lnurl.PayerDataSpec{
+		FreeName:         item("name"),
+		LightningAddress: item("identifier"),
+		Email:            item("email"),
+		PubKey:           item("pubkey"),
+	}
+	if spec.FreeName == nil && spec.LightningAddress == nil &&
+		spec.Email == nil && spec.PubKey == nil {
+		return nil
+	}
+	return spec
+}
+
+// missingPayerData returns the name of the first mandatory field missing.
+func missingPayerData(spec *lnurl.PayerDataSpec, payer lnurl.PayerDataValues) string {
+	if spec == nil {
+		return ""
+	}
+
+	for _, item := range []struct {
+		field string
+		spec  *lnurl.PayerDataItemSpec
+		value string
+	}{
+		{"name", spec.FreeName, payer.FreeName},
+		{"identifier", spec.LightningAddress, payer.LightningAddress},
+		{"email", spec.Email, payer.Email},
+		{"pubkey", spec.PubKey, payer.PubKey},
+	} {
+		if item.spec != nil && item.spec.Mandatory && item.value == "" {
+			return item.field
+		}
+	}
+	return ""
+}
+
+func handleLightningAddress(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+	go u.track("lnaddress", nil)
+
+	settings, err := u.getLightningAddressSettings()
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	changed := true
+	switch {
+	case opts["min"].(bool):
+		msats, err := parseSatoshis(opts)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		settings.MinSendable = msats
+	case opts["max"].(bool):
+		msats, err := parseSatoshis(opts)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		settings.MaxSendable = msats
+	case opts["comment"].(bool):
+		chars, err := strconv.ParseInt(opts["<characters>"].(string), 10, 64)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": "invalid number of characters."})
+			return
+		}
+		settings.CommentAllowed = &chars
+	case opts["description"].(bool):
+		// no text means back to the default
+		settings.Description = strings.Join(opts["<text>"].([]string), " ")
+	case opts["image"].(bool):
+		settings.Image = nil
+		if url, ok := opts["<url>"].(string); ok {
+			b, err := imageBytesFromURL(url)
+			if err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": "failed to load image."})
+				return
+			}
+			settings.Image = b
+		}
+	case opts["payerdata"].(bool):
+		if settings.PayerData == nil {
+			settings.PayerData = make(map[string]string)
+		}
+		settings.PayerData[opts["<field>"].(string)] = opts["<mode>"].(string)
+	case opts["reset"].(bool):
+		settings = LightningAddressSettings{}
+	default:
+		changed = false
+	}
+
+	if changed {
+		if err := u.setLightningAddressSettings(settings); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+	}
+
+	address := fmt.Sprintf("%d@%s", u.Id, getHost())
+	if u.Username != "" {
+		address = fmt.Sprintf("%s@%s", u.Username, getHost())
+	}
+
+	send(ctx, u, t.LNADDRESSSETTINGS, t.T{
+		"Address":        address,
+		"MinSendable":    settings.minSendable(),
+		"MaxSendable":    settings.maxSendable(),
+		"CommentAllowed": settings.commentAllowed(),
+		"Description":    settings.Description,
+		"HasImage":       settings.Image != nil,
+		"PayerData":      settings.payerDataModes(),
+	})
+}
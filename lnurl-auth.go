@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/lntxbot/t"
+)
+
+var ErrLNURLAuthBlocked = errors.New("Logins to this domain are blocked, see /logins.")
+
+type LNURLAuthLogin struct {
+	Domain    string    `db:"domain"`
+	PubKey    string    `db:"pubkey"`
+	Count     int       `db:"count"`
+	LastLogin time.Time `db:"last_login"`
+	Blocked   bool      `db:"blocked"`
+}
+
+// recordLNURLAuth keeps the domain exactly as it was signed with, as the
+// linking key depends on it.
+func (u User) recordLNURLAuth(domain string, pubkey string, origin string) {
+	_, err := pg.Exec(`
+INSERT INTO lnurlauth_login (account_id, domain, pubkey, origin)
+VALUES ($1, $2, $3, $4)
+    `, u.Id, domain, pubkey, origin)
+	if err != nil {
+		log.Warn().Err(err).Stringer("user", &u).Str("domain", domain).
+			Msg("failed to record lnurl-auth login")
+	}
+}
+
+// listLNURLAuthLogins has one entry per domain, blocked domains included even
+// if they were never logged in.
+func (u User) listLNURLAuthLogins() (logins []LNURLAuthLogin, err error) {
+	err = pg.Select(&logins, `
+SELECT
+  coalesce(l.domain, b.domain) AS domain,
+  coalesce(l.pubkey, '') AS pubkey,
+  coalesce(l.count, 0) AS count,
+  coalesce(l.last_login, b.created_at) AS last_login,
+  b.domain IS NOT NULL AS blocked
+FROM (
+  SELECT domain, max(pubkey) AS pubkey, count(*) AS count, max(time) AS last_login
+  FROM lnurlauth_login
+  WHERE account_id = $1
+  GROUP BY domain
+) AS l
+FULL OUTER JOIN (
+  SELECT domain, created_at FROM lnurlauth_blocked WHERE account_id = $1
+) AS b ON b.domain = lower(l.domain)
+ORDER BY last_login DESC
+    `, u.Id)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// lnurlAuthHost is the domain as it was last logged in with, which may differ
+// in case from what the user typed and gives a different linking key.
+func (u User) lnurlAuthHost(domain string) string {
+	var host string
+	err := pg.Get(&host, `
+SELECT domain FROM lnurlauth_login
+WHERE account_id = $1 AND lower(domain) = lower($2)
+ORDER BY time DESC
+LIMIT 1
+    `, u.Id, domain)
+	if err != nil {
+		return domain
+	}
+	return host
+}
+
+// isLNURLAuthBlocked is checked on every login. blocked domains are stored and
+// compared lowercased.
+func (u User) isLNURLAuthBlocked(domain string) bool {
+	domain = strings.ToLower(domain)
+	var blocked bool
+	err := pg.Get(&blocked, `
+SELECT EXISTS (
+  SELECT 1 FROM lnurlauth_blocked WHERE account_id = $1 AND domain = $2
+)
+    `, u.Id, domain)
+	if err != nil {
+		log.Warn().Err(err).Stringer("user", &u).Str("domain", domain).
+			Msg("failed to check lnurl-auth blocked domain")
+		return true
+	}
+	return blocked
+}
+
+func (u User) blockLNURLAuth(domain string) error {
+	domain = strings.ToLower(domain)
+	_, err := pg.Exec(`
+INSERT INTO lnurlauth_blocked (account_id, domain) VALUES ($1, $2)
+ON CONFLICT DO NOTHING
+    `, u.Id, domain)
+	return err
+}
+
+func (u User) unblockLNURLAuth(domain string) error {
+	domain = strings.ToLower(domain)
+	_, err := pg.Exec(`
+DELETE FROM lnurlauth_blocked WHERE account_id = $1 AND domain = $2
+    `, u.Id, domain)
+	return err
+}
+
+func handleLogins(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+	go u.track("logins", nil)
+
+	domain, _ := opts.String("<domain>")
+
+	switch {
+	case opts["export"].(bool):
+		host := u.lnurlAuthHost(domain)
+		sk, pk := u.LinkingKey(host)
+		send(ctx, u, t.LOGINSEXPORT, t.T{
+			"Domain":     host,
+			"PublicKey":  hex.EncodeToString(pk.SerializeCompressed()),
+			"PrivateKey": hex.EncodeToString(sk.Serialize()),
+		})
+	case opts["block"].(bool):
+		if err := u.blockLNURLAuth(domain); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, t.COMPLETED)
+	case opts["unblock"].(bool):
+		if err := u.unblockLNURLAuth(domain); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, t.COMPLETED)
+	default:
+		logins, err := u.listLNURLAuthLogins()
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, u, t.LOGINSLIST, t.T{"Logins": logins})
+	}
+}
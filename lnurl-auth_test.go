@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/go-lnurl"
+)
+
+func TestLNURLAuthBlocked(t *testing.T) {
+	setupTestBot(t)
+	u := testUser(t, "blocker")
+
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.Write([]byte(`{"status":"OK"}`))
+	}))
+	defer server.Close()
+
+	if err := u.blockLNURLAuth("Blocked.Example"); err != nil {
+		t.Fatalf("failed to block: %s", err)
+	}
+	if !u.isLNURLAuthBlocked("blocked.example") || !u.isLNURLAuthBlocked("BLOCKED.EXAMPLE") {
+		t.Error("blocked domain isn't blocked in another case")
+	}
+
+	// blocked logins don't go anywhere, even when asked for explicitly
+	ctx := context.WithValue(context.Background(), "initiator", u)
+	for _, opts := range []handleLNURLOpts{{}, {loginSilently: true}} {
+		handleLNURLAuth(ctx, u, opts, lnurl.LNURLAuthParams{
+			Host:     "BLOCKED.example",
+			Callback: server.URL,
+			K1:       strings.Repeat("ab", 32),
+		})
+	}
+	if called {
+		t.Error("logged in to a blocked domain")
+	}
+
+	if err := u.unblockLNURLAuth("BLOCKED.example"); err != nil {
+		t.Fatalf("failed to unblock: %s", err)
+	}
+	if u.isLNURLAuthBlocked("blocked.example") {
+		t.Error("domain is still blocked")
+	}
+}
+
+func TestLNURLAuthExport(t *testing.T) {
+	setupTestBot(t)
+	u := testUser(t, "exporter")
+
+	// the key is exported for the host as it was signed with
+	_, pk := u.LinkingKey("Mixed.Example")
+	u.recordLNURLAuth("Mixed.Example", hex.EncodeToString(pk.SerializeCompressed()), "telegram")
+	if host := u.lnurlAuthHost("mixed.example"); host != "Mixed.Example" {
+		t.Errorf("exporting for %q", host)
+	}
+	if host := u.lnurlAuthHost("never.example"); host != "never.example" {
+		t.Errorf("exporting a new domain for %q", host)
+	}
+
+	logins, err := u.listLNURLAuthLogins()
+	if err != nil || len(logins) != 1 {
+		t.Fatalf("got logins %v, %v", logins, err)
+	}
+	if logins[0].PubKey != hex.EncodeToString(pk.SerializeCompressed()) {
+		t.Errorf("recorded pubkey %s isn't the one signed with", logins[0].PubKey)
+	}
+
+	// blocking still matches it in any case
+	u.blockLNURLAuth("MIXED.example")
+	if logins, _ := u.listLNURLAuthLogins(); len(logins) != 1 || !logins[0].Blocked {
+		t.Errorf("blocked login is listed as %v", logins)
+	}
+}
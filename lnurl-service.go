@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -39,7 +40,12 @@ func handleCreateLNURLWithdraw(ctx context.Context, opts docopt.Opts) (enc strin
 
 	go u.track("lnurl generate", map[string]interface{}{"sats": maxSats})
 
-	challenge := hashString("%s:%d:%d", s.TelegramBotToken, u.Id, maxSats)
+	// each voucher is new, knowing the challenge is what allows a withdrawal
+	challenge, err := randomHex()
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
 	nexturl := fmt.Sprintf("%s/lnurl/withdraw?challenge=%s", s.ServiceURL, challenge)
 	rds.Set("lnurlwithdraw:"+challenge,
 		fmt.Sprintf(`%d-%d`, u.Id, maxSats), 30*time.Minute)
@@ -91,6 +97,12 @@ func serveLNURL() {
 			return
 		}
 
+		if used, _ := rds.Exists("lnurlwithdraw:spent:" + challenge).Result(); used {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse("This lnurl was already used."))
+			return
+		}
+
+		// vouchers are single-use, so there's no LUD-14 balanceCheck to offer
 		json.NewEncoder(w).Encode(lnurl.LNURLWithdrawResponse{
 			Callback:        fmt.Sprintf("%s/lnurl/withdraw/invoice", s.ServiceURL),
 			K1:              challenge,
@@ -100,6 +112,7 @@ func serveLNURL() {
 				"%s lnurl withdraw from %s", u.AtName(ctx), s.ServiceId),
 			Tag:           "withdrawRequest",
 			LNURLResponse: lnurl.OkResponse(),
+			PayLink:       lnurlPayLink(u),
 		})
 	})
 
@@ -140,32 +153,35 @@ func serveLNURL() {
 			Stringer("user", payer).
 			Msg("lnurl second request")
 
-		// double-check the challenge (it's a hash of the parameters + our secret)
-		if challenge != hashString("%s:%d:%d", s.TelegramBotToken, payer.Id, chMax) {
-			json.NewEncoder(w).Encode(
-				lnurl.ErrorResponse("Invalid amount for this lnurl."))
-			return
-		}
-
-		if err := rds.Del("lnurlwithdraw:" + challenge).Err(); err != nil {
-			// if error stop here to prevent extra withdrawals
-			log.Error().Err(err).Str("challenge", challenge).
-				Msg("error deleting used challenge on lnurl withdraw")
-			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Redis error. Please report."))
-			return
-		}
-
 		inv, err := decodepay.Decodepay(bolt11)
 		if err != nil {
 			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Invalid payment request."))
 			return
 		}
 
-		if inv.MSatoshi > int64(chMax)*1000 {
+		if inv.MSatoshi <= 0 || inv.MSatoshi > int64(chMax)*1000 {
 			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Amount too big."))
 			return
 		}
 
+		// vouchers are single-use: the first withdrawal spends all of it, and
+		// it is marked before paying so it can't be used twice at the same time
+		expiration, _ := rds.TTL("lnurlwithdraw:" + challenge).Result()
+		if expiration <= 0 {
+			expiration = 30 * time.Minute
+		}
+		spentKey := "lnurlwithdraw:spent:" + challenge
+		if ok, err := rds.SetNX(spentKey, int64(chMax)*1000, expiration).Result(); err != nil {
+			// if error stop here to prevent extra withdrawals
+			log.Error().Err(err).Str("challenge", challenge).
+				Msg("error marking used challenge on lnurl withdraw")
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Redis error. Please report."))
+			return
+		} else if !ok {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse("This lnurl was already used."))
+			return
+		}
+
 		// print the bolt11 just because
 		send(ctx, payer, bolt11, ctx.Value("message"))
 
@@ -179,7 +195,11 @@ func serveLNURL() {
 			"<invoice>": bolt11,
 			"now":       true,
 		}
-		handlePay(ctx, payer, opts)
+		if err := handlePay(ctx, payer, opts); err != nil {
+			rds.Del(spentKey)
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse(err.Error()))
+			return
+		}
 		json.NewEncoder(w).Encode(lnurl.OkResponse())
 	})
 
@@ -208,7 +228,7 @@ func serveLNURL() {
 		username := mux.Vars(r)["username"]
 		qs := r.URL.Query()
 
-		receiver, params, err := lnurlPayUserParams(ctx, username, "")
+		receiver, params, err := lnurlPayUserParams(ctx, username, qs.Get("kind"))
 		if err != nil {
 			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Invalid username or id."))
 			return
@@ -230,28 +250,56 @@ func serveLNURL() {
 				json.NewEncoder(w).Encode(lnurl.ErrorResponse("Invalid msatoshi amount."))
 				return
 			}
+			if msatoshi < params.MinSendable || msatoshi > params.MaxSendable {
+				json.NewEncoder(w).Encode(lnurl.ErrorResponse(fmt.Sprintf(
+					"Amount must be between %d and %d msatoshi.",
+					params.MinSendable, params.MaxSendable)))
+				return
+			}
+
+			// comment
+			comment := qs.Get("comment")
+			if int64(len([]rune(comment))) > params.CommentAllowed {
+				json.NewEncoder(w).Encode(lnurl.ErrorResponse(fmt.Sprintf(
+					"Comment can't be longer than %d characters.", params.CommentAllowed)))
+				return
+			}
 
 			// payer data
-			var hhash [32]byte
 			payerdata := qs.Get("payerdata")
-			if payerdata == "" {
-				hhash = sha256.Sum256([]byte(params.EncodedMetadata))
-			} else {
-				hhash = sha256.Sum256([]byte(params.EncodedMetadata + payerdata))
-			}
+			hashedDescription := params.EncodedMetadata + payerdata
 			var payerData lnurl.PayerDataValues
 			json.Unmarshal([]byte(payerdata), &payerData)
+			if missing := missingPayerData(params.PayerData, payerData); missing != "" {
+				json.NewEncoder(w).Encode(lnurl.ErrorResponse(fmt.Sprintf(
+					"Payer data '%s' is required.", missing)))
+				return
+			}
+
+			// zap request, if any, replaces the metadata in the description hash
+			zapRequest := qs.Get("nostr")
+			if zapRequest != "" {
+				if _, err := validateZapRequest(zapRequest, msatoshi); err != nil {
+					json.NewEncoder(w).Encode(lnurl.ErrorResponse(err.Error()))
+					return
+				}
+				hashedDescription = zapRequest
+			}
+			hhash := sha256.Sum256([]byte(hashedDescription))
 
 			// webhook
 			webhook := qs.Get("webhook")
 
-			bolt11, _, err := receiver.makeInvoice(ctx, &MakeInvoiceArgs{
-				Msatoshi:        msatoshi,
-				DescriptionHash: hex.EncodeToString(hhash[:]),
+			bolt11, hash, err := receiver.makeInvoice(ctx, &MakeInvoiceArgs{
+				Msatoshi:          msatoshi,
+				DescriptionHash:   hex.EncodeToString(hhash[:]),
+				HashedDescription: hashedDescription,
 				Extra: InvoiceExtra{
-					Comment:   qs.Get("comment"),
-					PayerData: &payerData,
-					Webhook:   webhook,
+					Comment:    comment,
+					PayerData:  &payerData,
+					Webhook:    webhook,
+					ZapRequest: zapRequest,
+					LNURLPay:   true,
 				},
 			})
 			if err != nil {
@@ -261,21 +309,95 @@ func serveLNURL() {
 				return
 			}
 
-			json.NewEncoder(w).Encode(lnurl.LNURLPayValues{
-				LNURLResponse: lnurl.OkResponse(),
-				PR:            bolt11,
-				Routes:        []struct{}{},
-				Disposable:    lnurl.FALSE,
+			json.NewEncoder(w).Encode(LNURLPayUserValues{
+				LNURLPayValues: lnurl.LNURLPayValues{
+					LNURLResponse: lnurl.OkResponse(),
+					PR:            bolt11,
+					Routes:        []struct{}{},
+					Disposable:    lnurl.FALSE,
+				},
+				Verify: fmt.Sprintf("%s/lnurlp/verify/%s", s.ServiceURL, hash),
 			})
 		}
 	})
+
+	// LUD-21, only for invoices we've made on the lnurl-pay callback
+	router.Path("/lnurlp/verify/{hash}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		hash := mux.Vars(r)["hash"]
+
+		data, err := loadInvoiceData(hash)
+		if err != nil || data.MakeInvoiceArgs == nil || !data.Extra.LNURLPay {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Not found."))
+			return
+		}
+
+		// old transactions are aggregated away, but their invoices keep paid_at
+		var settled bool
+		err = pg.Get(&settled, `
+SELECT EXISTS (
+  SELECT 1 FROM lightning.invoice
+  WHERE payment_hash = $1 AND account_id = $2 AND paid_at IS NOT NULL
+) OR EXISTS (
+  SELECT 1 FROM lightning.transaction
+  WHERE payment_hash = $1 AND to_id = $2
+)
+        `, hash, data.UserId)
+		if err != nil {
+			log.Warn().Err(err).Str("hash", hash).Msg("failed to check lnurl-pay invoice settlement")
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Database error."))
+			return
+		}
+
+		var preimage *string
+		if settled {
+			preimage = &data.Preimage
+		}
+
+		json.NewEncoder(w).Encode(LNURLPayVerification{
+			LNURLResponse: lnurl.OkResponse(),
+			Settled:       settled,
+			Preimage:      preimage,
+			PR:            data.Bolt11,
+		})
+	})
+}
+
+// LNURLPayUserValues is the lnurl-pay callback response plus LUD-21's verify.
+type LNURLPayUserValues struct {
+	lnurl.LNURLPayValues
+	Verify string `json:"verify"`
+}
+
+type LNURLPayVerification struct {
+	lnurl.LNURLResponse
+	Settled  bool    `json:"settled"`
+	Preimage *string `json:"preimage"`
+	PR       string  `json:"pr"`
+}
+
+// lnurlPayLink is the LUD-19 payLink, the user's lightning address as lnurlp://.
+func lnurlPayLink(u *User) string {
+	name := u.Username
+	if name == "" {
+		name = strconv.Itoa(u.Id)
+	}
+
+	link, err := url.Parse(fmt.Sprintf("%s/.well-known/lnurlp/%s", s.ServiceURL, name))
+	if err != nil {
+		return ""
+	}
+	link.Scheme = "lnurlp"
+	return link.String()
 }
 
 func lnurlPayUserParams(
 	ctx context.Context,
 	username string,
 	kind string,
-) (receiver *User, params lnurl.LNURLPayParams, err error) {
+) (receiver *User, params LNURLPayUserParams, err error) {
 	isTelegramUsername := false
 
 	if id, errx := strconv.Atoi(username); errx == nil {
@@ -305,16 +427,32 @@ func lnurlPayUserParams(
 	}
 
 	var metadata lnurl.Metadata
+	var settings LightningAddressSettings
 
 	if kind == "" {
+		settings, err = receiver.getLightningAddressSettings()
+		if err != nil {
+			return
+		}
+
 		metadata.Description = fmt.Sprintf("Fund %s account on t.me/%s.",
 			receiver.AtName(ctx), s.ServiceId)
+		if settings.Description != "" {
+			metadata.Description = settings.Description
+		}
+
+		if settings.Image != nil {
+			metadata.Image.Bytes = settings.Image
+			metadata.Image.Ext = "jpeg"
+		}
 
 		if isTelegramUsername {
 			// get user avatar from public t.me/ page
-			if b, err := getTelegramUserPicture(username); err == nil {
-				metadata.Image.Bytes = b
-				metadata.Image.Ext = "jpeg"
+			if metadata.Image.Bytes == nil {
+				if b, err := getTelegramUserPicture(username); err == nil {
+					metadata.Image.Bytes = b
+					metadata.Image.Ext = "jpeg"
+				}
 			}
 
 			// add internet identifier
@@ -329,23 +467,24 @@ func lnurlPayUserParams(
 		}
 	}
 
-	params = lnurl.LNURLPayParams{
+	params.LNURLPayParams = lnurl.LNURLPayParams{
 		LNURLResponse: lnurl.OkResponse(),
 		Tag:           "payRequest",
 		Callback: fmt.Sprintf("%s/.well-known/lnurlp/%s?kind=%s",
 			s.ServiceURL, username, kind),
-		MaxSendable:    1000000000,
-		MinSendable:    100000,
+		MaxSendable:    settings.maxSendable(),
+		MinSendable:    settings.minSendable(),
 		Metadata:       metadata,
-		CommentAllowed: 422,
-		PayerData: &lnurl.PayerDataSpec{
-			FreeName:         &lnurl.PayerDataItemSpec{},
-			LightningAddress: &lnurl.PayerDataItemSpec{},
-			Email:            &lnurl.PayerDataItemSpec{},
-		},
+		CommentAllowed: settings.commentAllowed(),
+		PayerData:      settings.payerDataSpec(),
 	}
 
 	params.EncodedMetadata = params.MetadataEncoded()
 
+	if kind == "" {
+		params.AllowsNostr = true
+		params.NostrPubkey = zapServicePubKey()
+	}
+
 	return
 }
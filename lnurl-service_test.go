@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/go-lnurl"
+)
+
+func TestLNURLWithdrawVoucher(t *testing.T) {
+	setupTestBot(t)
+
+	u := testUser(t, "voucher")
+	fundTestUser(t, u, 100000)
+	ctx := context.WithValue(context.Background(), "initiator", u)
+
+	create := func() *url.URL {
+		enc := handleCreateLNURLWithdraw(ctx, docopt.Opts{"<satoshis>": "50"})
+		decoded, err := lnurl.LNURLDecode(enc)
+		if err != nil {
+			t.Fatalf("invalid lnurl %q: %s", enc, err)
+		}
+		voucher, _ := url.Parse(decoded)
+		return voucher
+	}
+	get := func(target string, res interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Fatalf("%s: invalid response %q", target, w.Body.String())
+		}
+	}
+	withdraw := func(challenge string) lnurl.LNURLResponse {
+		payee := testUser(t, "voucherpayee")
+		bolt11, _, err := payee.makeInvoice(
+			context.WithValue(context.Background(), "initiator", payee),
+			&MakeInvoiceArgs{IgnoreRateLimit: true, Msatoshi: 50000, Description: "voucher"})
+		if err != nil {
+			t.Fatalf("failed to make invoice: %s", err)
+		}
+
+		var res lnurl.LNURLResponse
+		get("/lnurl/withdraw/invoice?"+url.Values{
+			"k1": {challenge},
+			"pr": {bolt11},
+		}.Encode(), &res)
+		return res
+	}
+
+	// the same amount gives a different voucher every time
+	voucher := create()
+	challenge := voucher.Query().Get("challenge")
+	if other := create(); other.Query().Get("challenge") == challenge {
+		t.Fatal("two vouchers have the same challenge")
+	}
+
+	var params lnurl.LNURLWithdrawResponse
+	get(voucher.RequestURI(), &params)
+	if params.MaxWithdrawable != 50000 || params.K1 != challenge {
+		t.Fatalf("got %+v", params)
+	}
+	if params.BalanceCheck != "" || params.PayLink == "" {
+		t.Errorf("single-use voucher has balanceCheck %q, payLink %q",
+			params.BalanceCheck, params.PayLink)
+	}
+
+	if res := withdraw(challenge); res.Status != "OK" {
+		t.Fatalf("withdrawal failed: %s", res.Reason)
+	}
+	if res := withdraw(challenge); res.Status == "OK" {
+		t.Error("voucher was withdrawn twice")
+	}
+
+	// and it isn't refilled when asking for the same amount again
+	create()
+	params = lnurl.LNURLWithdrawResponse{}
+	get(voucher.RequestURI(), &params)
+	if params.Status != "ERROR" {
+		t.Errorf("used voucher still offers %d", params.MaxWithdrawable)
+	}
+}
+
+func TestLNURLPayVerify(t *testing.T) {
+	setupTestBot(t)
+	u := testUser(t, "verify")
+	ctx := context.WithValue(context.Background(), "initiator", u)
+
+	verify := func(hash string) (code int, res LNURLPayVerification) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/lnurlp/verify/"+hash, nil))
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	// only invoices made on the lnurl-pay callback can be verified
+	_, plain, err := u.makeInvoice(ctx, &MakeInvoiceArgs{
+		IgnoreRateLimit: true,
+		Msatoshi:        1000,
+		Description:     "not lnurl",
+	})
+	if err != nil {
+		t.Fatalf("failed to make invoice: %s", err)
+	}
+	if code, _ := verify(plain); code != 404 {
+		t.Errorf("verify on a plain invoice got %d", code)
+	}
+
+	bolt11, hash, err := u.makeInvoice(ctx, &MakeInvoiceArgs{
+		IgnoreRateLimit: true,
+		Msatoshi:        21000,
+		Description:     "lnurl",
+		Extra:           InvoiceExtra{LNURLPay: true},
+	})
+	if err != nil {
+		t.Fatalf("failed to make invoice: %s", err)
+	}
+	if code, res := verify(hash); code != 200 || res.Settled || res.Preimage != nil || res.PR != bolt11 {
+		t.Errorf("unpaid invoice verifies as %d %v", code, res)
+	}
+
+	if err := testBot.fake.Settle(hash, 0); err != nil {
+		t.Fatalf("failed to settle: %s", err)
+	}
+	eventually(t, func() bool {
+		_, res := verify(hash)
+		return res.Settled
+	})
+	data, _ := loadInvoiceData(hash)
+	if _, res := verify(hash); res.Preimage == nil || *res.Preimage != data.Preimage {
+		t.Errorf("paid invoice has preimage %v", res.Preimage)
+	}
+
+	// still settled after its transaction is aggregated away
+	if _, err := pg.Exec(`
+DELETE FROM lightning.transaction WHERE payment_hash = $1
+    `, hash); err != nil {
+		t.Fatalf("failed to delete transaction: %s", err)
+	}
+	if _, res := verify(hash); !res.Settled || res.Preimage == nil {
+		t.Errorf("aggregated invoice verifies as %v", res)
+	}
+}
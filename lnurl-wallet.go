@@ -63,6 +63,10 @@ type handleLNURLOpts struct {
 func handleLNURL(ctx context.Context, lnurltext string, opts handleLNURLOpts) {
 	u := ctx.Value("initiator").(*User)
 
+	if req, ok := parsePaymentRequest(lnurltext); ok && req.Bolt11 == "" {
+		lnurltext = req.String()
+	}
+
 	_, iparams, err := lnurl.HandleLNURL(lnurltext)
 	if err != nil {
 		if lnurlerr, ok := err.(lnurl.LNURLErrorResponse); ok {
@@ -108,6 +112,11 @@ func handleLNURLAuth(
 	opts handleLNURLOpts,
 	params lnurl.LNURLAuthParams,
 ) {
+	if u.isLNURLAuthBlocked(params.Host) {
+		send(ctx, u, t.ERROR, t.T{"Err": ErrLNURLAuthBlocked.Error()})
+		return
+	}
+
 	key, sig, err := u.SignKeyAuth(params.Host, params.K1)
 	if err != nil {
 		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
@@ -131,6 +140,8 @@ func handleLNURLAuth(
 		return
 	}
 
+	go u.recordLNURLAuth(params.Host, key, "telegram")
+
 	if !opts.loginSilently {
 		send(ctx, u, t.LNURLAUTHSUCCESS, t.T{
 			"Host":      params.Host,
@@ -390,53 +401,78 @@ func lnurlpayAskForComment(
 	rds.Set(fmt.Sprintf("reply:%d:%d", u.Id, sentId), data, time.Hour*1)
 }
 
-func lnurlpayFinish(
-	ctx context.Context,
+// lnurlPayerData fills what the service asks for (LUD-18), the key is the one
+// generated for the pubkey field, if any.
+func lnurlPayerData(
 	u *User,
 	params lnurl.LNURLPayParams,
-	msats int64,
-	comment string,
 	anonymous bool,
-) {
-	var payerdata *lnurl.PayerDataValues
-	var proofOfPayerKey *btcec.PrivateKey
-
-	if params.PayerData != nil && params.PayerData.Exists() {
-		payerdata = &lnurl.PayerDataValues{}
-
-		// always include pubkey if possible, as it's still anonymous
-		if params.PayerData.PubKey != nil {
-			proofOfPayerKey, _ = btcec.NewPrivateKey(btcec.S256())
-			payerdata.PubKey = hex.EncodeToString(
-				proofOfPayerKey.PubKey().SerializeCompressed(),
-			)
-		}
+) (payerdata *lnurl.PayerDataValues, proofOfPayerKey *btcec.PrivateKey, err error) {
+	if params.PayerData == nil || !params.PayerData.Exists() {
+		return nil, nil, nil
+	}
 
-		// other non-anonymous data
-		if !anonymous {
-			if params.PayerData.LightningAddress != nil {
-				payerdata.LightningAddress = u.Username + "@" + getHost()
-			}
-			if params.PayerData.FreeName != nil {
-				payerdata.FreeName = u.Username
+	payerdata = &lnurl.PayerDataValues{}
+
+	// always include pubkey if possible, as it's still anonymous
+	if params.PayerData.PubKey != nil {
+		proofOfPayerKey, _ = btcec.NewPrivateKey(btcec.S256())
+		payerdata.PubKey = hex.EncodeToString(
+			proofOfPayerKey.PubKey().SerializeCompressed(),
+		)
+	}
+
+	// other non-anonymous data
+	if !anonymous {
+		if params.PayerData.LightningAddress != nil {
+			payerdata.LightningAddress = u.Username + "@" + getHost()
+		}
+		if params.PayerData.FreeName != nil {
+			payerdata.FreeName = u.Username
+		}
+		if params.PayerData.KeyAuth != nil &&
+			!u.isLNURLAuthBlocked(params.CallbackURL().Hostname()) {
+			key, sig, err := u.SignKeyAuth(
+				params.CallbackURL().Hostname(), params.PayerData.KeyAuth.K1)
+			if err != nil {
+				return nil, nil, err
 			}
-			if params.PayerData.KeyAuth != nil {
-				key, sig, err := u.SignKeyAuth(
-					params.CallbackURL().Hostname(), params.PayerData.KeyAuth.K1)
-				if err != nil {
-					send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
-					return
-				}
 
-				payerdata.KeyAuth = &lnurl.PayerDataKeyAuthValues{
-					K1:  params.PayerData.KeyAuth.K1,
-					Key: key,
-					Sig: sig,
-				}
+			payerdata.KeyAuth = &lnurl.PayerDataKeyAuthValues{
+				K1:  params.PayerData.KeyAuth.K1,
+				Key: key,
+				Sig: sig,
 			}
 		}
 	}
 
+	return payerdata, proofOfPayerKey, nil
+}
+
+func truncateLNURLComment(comment string, allowed int64) string {
+	if runes := []rune(comment); int64(len(runes)) > allowed {
+		return string(runes[:allowed])
+	}
+	return comment
+}
+
+func lnurlpayFinish(
+	ctx context.Context,
+	u *User,
+	params lnurl.LNURLPayParams,
+	msats int64,
+	comment string,
+	anonymous bool,
+) {
+	payerdata, proofOfPayerKey, err := lnurlPayerData(u, params, anonymous)
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	// longer comments would be rejected
+	comment = truncateLNURLComment(comment, params.CommentAllowed)
+
 	// call callback with params and get invoice (already verified)
 	res, err := params.Call(msats, comment, payerdata)
 	if err != nil {
@@ -450,6 +486,9 @@ func lnurlpayFinish(
 		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
 		return
 	}
+	if payerdata != nil && payerdata.KeyAuth != nil {
+		go u.recordLNURLAuth(params.CallbackURL().Hostname(), payerdata.KeyAuth.Key, "payerdata")
+	}
 
 	processingMessageId := send(ctx, u, res.PR+"\n\n"+translate(ctx, t.PROCESSING))
 
@@ -15,7 +15,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/fiatjaf/go-cliche"
 	"github.com/fiatjaf/go-lnurl"
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
@@ -39,9 +38,14 @@ type Settings struct {
 	TelegramBotToken string   `envconfig:"TELEGRAM_BOT_TOKEN" required:"true"`
 	PostgresURL      string   `envconfig:"DATABASE_URL" required:"true"`
 	RedisURL         string   `envconfig:"REDIS_URL" required:"true"`
+	LightningBackend string   `envconfig:"LIGHTNING_BACKEND" default:"cliche"` // cliche, lnd, cln or fake
 	ClicheJARPath    string   `envconfig:"CLICHE_JAR_PATH"`
 	ClicheBinaryPath string   `envconfig:"CLICHE_BINARY_PATH"`
-	ClicheDataDir    string   `envconfig:"CLICHE_DATADIR" required:"true"`
+	ClicheDataDir    string   `envconfig:"CLICHE_DATADIR"`
+	LNDRESTURL       string   `envconfig:"LND_REST_URL"`
+	LNDMacaroonPath  string   `envconfig:"LND_MACAROON_PATH"`
+	LNDTLSCertPath   string   `envconfig:"LND_TLS_CERT_PATH"`
+	CLNSocketPath    string   `envconfig:"CLN_SOCKET_PATH"`
 
 	// account in the database named '@'
 	ProxyAccount int `envconfig:"PROXY_ACCOUNT" required:"true"`
@@ -49,6 +53,9 @@ type Settings struct {
 
 	AmplitudeKey string `envconfig:"AMPLITUDE_KEY"`
 
+	// nostr wallet connect is disabled when this is empty
+	NWCRelayURL string `envconfig:"NWC_RELAY_URL"`
+
 	InvoiceTimeout       time.Duration `envconfig:"INVOICE_TIMEOUT" default:"480h"`
 	PayConfirmTimeout    time.Duration `envconfig:"PAY_CONFIRM_TIMEOUT" default:"10m"`
 	GiveAwayTimeout      time.Duration `envconfig:"GIVE_AWAY_TIMEOUT" default:"5h"`
@@ -69,7 +76,7 @@ type Settings struct {
 var (
 	s                       Settings
 	pg                      *sqlx.DB
-	ln                      *cliche.Control
+	ln                      LightningBackend
 	rds                     *redis.Client
 	bot                     *tgbotapi.BotAPI
 	amp                     *amplitude.Client
@@ -87,6 +94,23 @@ var tmpl = template.Must(template.ParseFS(templates, "templates/*"))
 var static embed.FS
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "--migrate", "--migrate-status":
+			handleMigrateCommand(os.Args[1])
+			return
+		case "--aggregate-transactions":
+			handleAggregateCommand(os.Args[2:])
+			return
+		case "--check-balances":
+			handleCheckBalancesCommand()
+			return
+		case "--import-redis-invoices":
+			handleImportInvoicesCommand()
+			return
+		}
+	}
+
 	err := envconfig.Process("", &s)
 	if err != nil {
 		log.Fatal().Err(err).Msg("couldn't process envconfig.")
@@ -119,16 +143,16 @@ func main() {
 	// seed the random generator
 	rand.Seed(time.Now().UnixNano())
 
-	// setup cliche
-	setupCliche()
-	go handleClicheEvents()
-	go clicheCheckingRoutine()
-
 	// postgres connection
 	pg, err = sqlx.Connect("postgres", s.PostgresURL)
 	if err != nil {
 		log.Fatal().Err(err).Msg("couldn't connect to postgres")
 	}
+	if applied, err := runMigrations(); err != nil {
+		log.Fatal().Err(err).Msg("failed to apply database migrations")
+	} else if applied > 0 {
+		log.Info().Int("n", applied).Msg("applied database migrations")
+	}
 
 	// redis connection
 	rurl, _ := url.Parse(s.RedisURL)
@@ -142,6 +166,11 @@ func main() {
 			Msg("failed to connect to redis")
 	}
 
+	// setup lightning backend
+	setupLightningBackend()
+	go handleBackendEvents()
+	go backendCheckingRoutine()
+
 	// amplitude client
 	if s.AmplitudeKey != "" {
 		amp = amplitude.New(s.AmplitudeKey)
@@ -180,7 +209,11 @@ func main() {
 	go sats4adsCleanupRoutine()
 	go lnurlBalanceCheckRoutine()
 	go checkAllOutgoingPayments(routineCtx)
-	go checkAllIncomingPayments(routineCtx)
+	go webhookRetryRoutine()
+	go paymentEventsCleanupRoutine()
+	go incomingPaymentsCheckingRoutine(routineCtx)
+	go nwcRoutine()
+	go onchainSwapRoutine()
 
 	// routes
 	//
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/jmoiron/sqlx"
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/redis.v5"
+)
+
+// tests that need the whole bot run it against the fake lightning backend, a
+// real postgres and a real redis. they are skipped unless these are given:
+//
+//   TEST_DATABASE_URL=postgres://... TEST_REDIS_URL=redis://... go test ./...
+//
+// the database is migrated, never dropped, so use a throwaway one.
+
+var testBot struct {
+	sync.Once
+	fake *FakeBackend
+}
+
+func setupTestBot(tb testing.TB) *FakeBackend {
+	pgurl := os.Getenv("TEST_DATABASE_URL")
+	rdsurl := os.Getenv("TEST_REDIS_URL")
+	if pgurl == "" || rdsurl == "" {
+		tb.Skip("TEST_DATABASE_URL and TEST_REDIS_URL are needed to run the bot")
+	}
+
+	testBot.Do(func() {
+		for k, v := range map[string]string{
+			"SERVICE_URL":        "http://lntxbot.test",
+			"PORT":               "0",
+			"TELEGRAM_BOT_TOKEN": "test",
+			"DATABASE_URL":       pgurl,
+			"REDIS_URL":          rdsurl,
+			"PROXY_ACCOUNT":      "1",
+			"LIGHTNING_BACKEND":  "fake",
+		} {
+			os.Setenv(k, v)
+		}
+		if err := envconfig.Process("", &s); err != nil {
+			tb.Fatalf("settings: %s", err)
+		}
+
+		var err error
+		if bundle, err = createLocalizerBundle(); err != nil {
+			tb.Fatalf("bundle: %s", err)
+		}
+
+		pg = sqlx.MustConnect("postgres", s.PostgresURL)
+		if _, err := runMigrations(); err != nil {
+			tb.Fatalf("migrations: %s", err)
+		}
+
+		rurl, _ := url.Parse(s.RedisURL)
+		pw, _ := rurl.User.Password()
+		rds = redis.NewClient(&redis.Options{Addr: rurl.Host, Password: pw})
+
+		// telegram calls all succeed without going anywhere
+		bot = &tgbotapi.BotAPI{
+			Token:  s.TelegramBotToken,
+			Client: &http.Client{Transport: fakeTelegram{}},
+		}
+
+		setupLightningBackend()
+		go handleBackendEvents()
+		setupCommands()
+		registerAPIMethods()
+		serveLNURL()
+
+		testBot.fake = ln.(*FakeBackend)
+	})
+
+	if testBot.fake == nil {
+		tb.Fatal("bot setup has failed before")
+	}
+	return testBot.fake
+}
+
+var testRedis sync.Once
+
+// setupTestRedis gives tests that need nothing but redis an in-memory one, unless
+// the whole bot is already running against a real one.
+func setupTestRedis(tb testing.TB) {
+	testRedis.Do(func() {
+		if rds != nil {
+			return
+		}
+		mr, err := miniredis.Run()
+		if err != nil {
+			tb.Fatalf("miniredis: %s", err)
+		}
+		rds = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	})
+	if rds == nil {
+		tb.Fatal("redis setup has failed before")
+	}
+}
+
+type fakeTelegram struct{}
+
+func (fakeTelegram) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body: ioutil.NopCloser(strings.NewReader(
+			`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`)),
+		Request: r,
+	}, nil
+}
+
+// testUser creates a fresh account with no telegram chat.
+func testUser(tb testing.TB, name string) *User {
+	u, err := ensureTelegramUsername(fmt.Sprintf("%s%d", name, time.Now().UnixNano()))
+	if err != nil {
+		tb.Fatalf("failed to create user: %s", err)
+	}
+	return &u
+}
+
+// apiToken is what the user would get from /api or /bluewallet.
+func apiToken(u *User) string {
+	return base64.StdEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%d:%s", u.Id, u.Password)))
+}
+
+// fundTestUser pays an invoice of the user from outside, as if someone had
+// sent them money.
+func fundTestUser(tb testing.TB, u *User, msats int64) {
+	ctx := context.WithValue(context.Background(), "initiator", u)
+	_, hash, err := u.makeInvoice(ctx, &MakeInvoiceArgs{
+		IgnoreRateLimit: true,
+		Msatoshi:        msats,
+		Description:     "test funding",
+	})
+	if err != nil {
+		tb.Fatalf("failed to make invoice: %s", err)
+	}
+	if err := testBot.fake.Settle(hash, 0); err != nil {
+		tb.Fatalf("failed to settle invoice: %s", err)
+	}
+
+	eventually(tb, func() bool {
+		info, err := u.getInfo()
+		return err == nil && info.BalanceMsat >= msats
+	})
+}
+
+func eventually(tb testing.TB, condition func() bool) {
+	for i := 0; i < 50; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	tb.Fatal("condition not met after 5 seconds")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads the embedded migrations, named like "0002_invoice.sql".
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		filename := entry.Name()
+		spl := strings.SplitN(strings.TrimSuffix(filename, ".sql"), "_", 2)
+		if len(spl) != 2 {
+			return nil, fmt.Errorf("invalid migration filename '%s'", filename)
+		}
+		version, err := strconv.Atoi(spl[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version on '%s': %w", filename, err)
+		}
+
+		content, err := migrationFiles.ReadFile("migrations/" + filename)
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    spl[1],
+			SQL:     string(content),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicated migration version %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// ensureSchemaVersion creates the schema_version table. databases created by
+// hand from the old postgres.sql before this existed are marked as being at
+// the initial migration.
+func ensureSchemaVersion() error {
+	var exists bool
+	if err := pg.Get(&exists, `SELECT to_regclass('schema_version') IS NOT NULL`); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	var legacy bool
+	if err := pg.Get(&legacy, `SELECT to_regclass('account') IS NOT NULL`); err != nil {
+		return err
+	}
+
+	txn, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if _, err := txn.Exec(`
+CREATE TABLE schema_version (
+  version int PRIMARY KEY,
+  name text NOT NULL,
+  applied_at timestamptz NOT NULL DEFAULT now()
+)
+    `); err != nil {
+		return err
+	}
+
+	if legacy {
+		log.Info().Msg("existing database without schema_version, assuming initial schema")
+		if _, err := txn.Exec(`
+INSERT INTO schema_version (version, name) VALUES (1, 'initial')
+        `); err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+func migrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureSchemaVersion(); err != nil {
+		return nil, fmt.Errorf("failed to create schema_version: %w", err)
+	}
+
+	var applied []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	if err := pg.Select(&applied,
+		`SELECT version, applied_at FROM schema_version`); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	appliedAt := make(map[int]time.Time, len(applied))
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i].Migration = m
+		if at, ok := appliedAt[m.Version]; ok {
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
+
+// runMigrations applies all pending migrations in order, each on its own
+// database transaction. returns how many were applied.
+func runMigrations() (applied int, err error) {
+	statuses, err := migrationStatus()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			continue
+		}
+
+		log.Info().Int("version", status.Version).Str("name", status.Name).
+			Msg("applying migration")
+
+		txn, err := pg.Beginx()
+		if err != nil {
+			return applied, err
+		}
+		if _, err := txn.Exec(status.SQL); err != nil {
+			txn.Rollback()
+			return applied, fmt.Errorf("migration %04d_%s failed: %w",
+				status.Version, status.Name, err)
+		}
+		if _, err := txn.Exec(`
+INSERT INTO schema_version (version, name) VALUES ($1, $2)
+        `, status.Version, status.Name); err != nil {
+			txn.Rollback()
+			return applied, err
+		}
+		if err := txn.Commit(); err != nil {
+			return applied, err
+		}
+
+		applied++
+	}
+
+	return applied, nil
+}
+
+// handleMigrateCommand implements --migrate and --migrate-status,
+// which only need DATABASE_URL.
+func handleMigrateCommand(command string) {
+	var err error
+	pg, err = sqlx.Connect("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't connect to postgres")
+	}
+
+	switch command {
+	case "--migrate":
+		applied, err := runMigrations()
+		if err != nil {
+			log.Fatal().Err(err).Int("applied", applied).Msg("failed to migrate")
+		}
+		fmt.Printf("applied %d migrations\n", applied)
+	case "--migrate-status":
+		statuses, err := migrationStatus()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to get migration status")
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied at " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s: %s\n", status.Version, status.Name, applied)
+		}
+	}
+}
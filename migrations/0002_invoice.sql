@@ -0,0 +1,14 @@
+-- invoice data used to live only on redis, now redis is just a cache
+CREATE TABLE IF NOT EXISTS lightning.invoice (
+  payment_hash text PRIMARY KEY,
+  account_id int NOT NULL REFERENCES account (id),
+  preimage text NOT NULL,
+  msatoshi numeric(13) NOT NULL DEFAULT 0, -- 0 for "any amount" invoices
+  description text,
+  tag text,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  expires_at timestamptz NOT NULL,
+  data jsonb NOT NULL -- the full InvoiceData, redis only caches this
+);
+
+CREATE INDEX IF NOT EXISTS invoice_account_id_idx ON lightning.invoice (account_id);
@@ -0,0 +1,7 @@
+-- older databases were created before these group settings existed
+ALTER TABLE groupchat ADD COLUMN IF NOT EXISTS spammy boolean NOT NULL DEFAULT false;
+ALTER TABLE groupchat ADD COLUMN IF NOT EXISTS ticket int NOT NULL DEFAULT 0;
+ALTER TABLE groupchat ADD COLUMN IF NOT EXISTS renamable int NOT NULL DEFAULT 0;
+ALTER TABLE groupchat ADD COLUMN IF NOT EXISTS coinflips bool NOT NULL DEFAULT true;
+ALTER TABLE groupchat ADD COLUMN IF NOT EXISTS expensive_price int NOT NULL DEFAULT 0;
+ALTER TABLE groupchat ADD COLUMN IF NOT EXISTS expensive_pattern text NOT NULL DEFAULT '';
@@ -0,0 +1,14 @@
+-- what was collapsed by the aggregation of old transactions
+CREATE TABLE lightning.aggregation (
+  account_id int NOT NULL REFERENCES account (id),
+  year int NOT NULL,
+  txn_count int NOT NULL, -- how many transactions were collapsed
+  amount_in numeric(13) NOT NULL, -- in msatoshis
+  amount_out numeric(13) NOT NULL,
+  fees numeric(13) NOT NULL,
+  first_time timestamptz NOT NULL,
+  last_time timestamptz NOT NULL,
+  aggregated_at timestamptz NOT NULL DEFAULT now(),
+
+  PRIMARY KEY (account_id, year)
+);
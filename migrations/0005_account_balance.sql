@@ -0,0 +1,47 @@
+-- balances used to be computed from lightning.balance (which aggregates the
+-- lightning.account_txn view) every time, now they're kept up to date by a
+-- trigger on every change to lightning.transaction, on the same transaction.
+CREATE TABLE lightning.account_balance (
+  account_id int PRIMARY KEY REFERENCES account (id),
+  balance numeric(13) NOT NULL DEFAULT 0 -- in msatoshis
+);
+
+CREATE FUNCTION lightning.apply_to_account_balance(tx lightning.transaction, sign int) RETURNS void AS $$
+BEGIN
+  -- outgoing amounts and fees count even when pending
+  IF tx.from_id IS NOT NULL THEN
+    INSERT INTO lightning.account_balance AS b (account_id, balance)
+    VALUES (tx.from_id, -sign * (tx.amount + tx.fees))
+    ON CONFLICT (account_id) DO UPDATE SET balance = b.balance + excluded.balance;
+  END IF;
+
+  -- incoming amounts only when settled
+  IF tx.to_id IS NOT NULL AND NOT tx.pending THEN
+    INSERT INTO lightning.account_balance AS b (account_id, balance)
+    VALUES (tx.to_id, sign * tx.amount)
+    ON CONFLICT (account_id) DO UPDATE SET balance = b.balance + excluded.balance;
+  END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION lightning.update_account_balance() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'UPDATE' OR TG_OP = 'DELETE' THEN
+    PERFORM lightning.apply_to_account_balance(OLD, -1);
+  END IF;
+  IF TG_OP = 'UPDATE' OR TG_OP = 'INSERT' THEN
+    PERFORM lightning.apply_to_account_balance(NEW, 1);
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- no transactions can happen between filling the table and creating the trigger
+LOCK TABLE lightning.transaction IN SHARE ROW EXCLUSIVE MODE;
+
+INSERT INTO lightning.account_balance (account_id, balance)
+SELECT account_id, balance FROM lightning.balance;
+
+CREATE TRIGGER update_account_balance
+  AFTER INSERT OR UPDATE OR DELETE ON lightning.transaction
+  FOR EACH ROW EXECUTE PROCEDURE lightning.update_account_balance();
@@ -0,0 +1,18 @@
+-- every webhook we send and what happened to it
+CREATE TABLE lightning.webhook_delivery (
+  id serial PRIMARY KEY,
+  account_id int NOT NULL REFERENCES account (id),
+  url text NOT NULL,
+  event text NOT NULL,
+  payload jsonb NOT NULL,
+  status text NOT NULL DEFAULT 'pending', -- pending, delivered or failed
+  attempts int NOT NULL DEFAULT 0,
+  response_status int, -- http status of the last attempt
+  last_error text,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  next_attempt_at timestamptz NOT NULL DEFAULT now(),
+  delivered_at timestamptz
+);
+
+CREATE INDEX ON lightning.webhook_delivery (account_id, created_at);
+CREATE INDEX ON lightning.webhook_delivery (next_attempt_at) WHERE status = 'pending';
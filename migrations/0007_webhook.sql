@@ -0,0 +1,10 @@
+-- webhooks users register to be notified of their wallet events
+CREATE TABLE lightning.webhook (
+  id serial PRIMARY KEY,
+  account_id int NOT NULL REFERENCES account (id),
+  url text NOT NULL,
+  events text[] NOT NULL, -- payment-received, payment-sent, payment-failed, tip-received
+  created_at timestamptz NOT NULL DEFAULT now(),
+
+  UNIQUE (account_id, url)
+);
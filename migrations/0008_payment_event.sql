@@ -0,0 +1,11 @@
+-- log of events sent on /payments/stream, so reconnecting clients can catch up
+CREATE TABLE lightning.payment_event (
+  id bigserial PRIMARY KEY,
+  account_id int NOT NULL REFERENCES account (id),
+  event text NOT NULL,
+  data jsonb NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON lightning.payment_event (account_id, id);
+CREATE INDEX ON lightning.payment_event (created_at);
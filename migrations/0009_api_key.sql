@@ -0,0 +1,16 @@
+-- named API keys, besides the three tokens derived from account.password
+CREATE TABLE api_key (
+  id serial PRIMARY KEY,
+  account_id int NOT NULL REFERENCES account (id),
+  name text NOT NULL,
+  secret_hash text UNIQUE NOT NULL, -- sha256 of the secret, the secret itself is never stored
+  permission int NOT NULL, -- same levels as the legacy tokens: 10 full, 7 invoice, 3 readonly
+  max_payment_msat bigint, -- null means no limit
+  daily_budget_msat bigint,
+  allowed_destinations text[], -- node ids or usernames, null means anywhere
+  created_at timestamptz NOT NULL DEFAULT now(),
+  last_used_at timestamptz,
+  revoked_at timestamptz
+);
+
+CREATE UNIQUE INDEX ON api_key (account_id, name) WHERE revoked_at IS NULL;
@@ -0,0 +1,5 @@
+-- lndhub clients need the payment request and a stable add_index for each invoice
+ALTER TABLE lightning.invoice ADD COLUMN IF NOT EXISTS bolt11 text;
+ALTER TABLE lightning.invoice ADD COLUMN IF NOT EXISTS add_index bigserial;
+
+CREATE INDEX IF NOT EXISTS invoice_add_index_idx ON lightning.invoice (account_id, add_index);
@@ -0,0 +1,14 @@
+-- nostr wallet connect (NIP-47) connections, each one a client keypair
+CREATE TABLE nwc_connection (
+  id serial PRIMARY KEY,
+  account_id int NOT NULL REFERENCES account (id),
+  name text NOT NULL,
+  pubkey text NOT NULL UNIQUE, -- the client's, requests are signed by it
+  daily_budget_msat bigint, -- null means no limit
+  created_at timestamptz NOT NULL DEFAULT now(),
+  last_used_at timestamptz,
+  revoked_at timestamptz
+);
+
+CREATE UNIQUE INDEX nwc_connection_name_idx ON nwc_connection (account_id, name)
+  WHERE revoked_at IS NULL;
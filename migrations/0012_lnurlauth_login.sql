@@ -0,0 +1,19 @@
+-- every successful lnurl-auth login, with the linking key used
+CREATE TABLE lnurlauth_login (
+  id serial PRIMARY KEY,
+  account_id int NOT NULL REFERENCES account (id),
+  domain text NOT NULL,
+  pubkey text NOT NULL,
+  origin text NOT NULL, -- telegram, api or payerdata
+  time timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX lnurlauth_login_account_idx ON lnurlauth_login (account_id, domain);
+
+-- domains that can't log in without the user explicitly asking for it
+CREATE TABLE lnurlauth_blocked (
+  account_id int NOT NULL REFERENCES account (id),
+  domain text NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (account_id, domain)
+);
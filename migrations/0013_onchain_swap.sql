@@ -0,0 +1,20 @@
+-- onchain sends, done by paying a lightning invoice to a swap provider
+CREATE TABLE onchain_swap (
+  id serial PRIMARY KEY,
+  account_id int NOT NULL REFERENCES account (id),
+  provider text NOT NULL,
+  address text NOT NULL,
+  amount_sat bigint NOT NULL,
+  sat_per_vbyte int NOT NULL,
+  bolt11 text NOT NULL UNIQUE,
+  payment_hash text NOT NULL,
+  status text NOT NULL DEFAULT 'pending', -- pending, sent, failed or expired
+  txid text,
+  tx_hex text,
+  message_id int, -- the telegram message we edit with the result
+  created_at timestamptz NOT NULL DEFAULT now(),
+  sent_at timestamptz
+);
+
+CREATE INDEX onchain_swap_account_idx ON onchain_swap (account_id, created_at);
+CREATE INDEX onchain_swap_pending_idx ON onchain_swap (created_at) WHERE status = 'pending';
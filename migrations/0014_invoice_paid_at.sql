@@ -0,0 +1,8 @@
+-- when each invoice was paid, kept after its transaction is aggregated away
+ALTER TABLE lightning.invoice ADD COLUMN IF NOT EXISTS paid_at timestamptz;
+
+UPDATE lightning.invoice AS i
+SET paid_at = t.time
+FROM lightning.transaction AS t
+WHERE t.payment_hash = i.payment_hash AND t.to_id = i.account_id
+  AND i.paid_at IS NULL;
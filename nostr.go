@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"golang.org/x/net/websocket"
+)
+
+// just enough nostr for the NWC service and zaps: events, BIP-340 signatures,
+// NIP-04 encryption and a relay client.
+
+type NostrEvent struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+type NostrFilter struct {
+	Kinds   []int    `json:"kinds,omitempty"`
+	Authors []string `json:"authors,omitempty"`
+	PTags   []string `json:"#p,omitempty"`
+	Since   int64    `json:"since,omitempty"`
+}
+
+func (filter NostrFilter) Matches(evt NostrEvent) bool {
+	if len(filter.Kinds) > 0 {
+		found := false
+		for _, kind := range filter.Kinds {
+			if kind == evt.Kind {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(filter.Authors) > 0 && !stringIsIn(evt.PubKey, filter.Authors) {
+		return false
+	}
+	if len(filter.PTags) > 0 && !stringIsIn(evt.Tag("p"), filter.PTags) {
+		return false
+	}
+	if filter.Since > 0 && evt.CreatedAt < filter.Since {
+		return false
+	}
+	return true
+}
+
+// NostrRelay is the transport, so the NWC service doesn't care if events
+// come from a websocket or from somewhere else.
+type NostrRelay interface {
+	Publish(ctx context.Context, evt NostrEvent) error
+	// Subscribe returns a channel that is closed when the relay goes away.
+	Subscribe(ctx context.Context, filter NostrFilter) (<-chan NostrEvent, error)
+	Close() error
+}
+
+// connectRelay is what everybody should call to get a relay, the fake
+// lightning backend replaces it with connectMemoryRelay.
+var connectRelay = connectNostrRelay
+
+func (evt NostrEvent) Tag(name string) string {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+func (evt NostrEvent) hash() []byte {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	tags := evt.Tags
+	if tags == nil {
+		tags = [][]string{}
+	}
+	enc.Encode([]interface{}{0, evt.PubKey, evt.CreatedAt, evt.Kind, tags, evt.Content})
+	h := sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}))
+	return h[:]
+}
+
+func (evt *NostrEvent) Sign(sk *btcec.PrivateKey) error {
+	evt.PubKey = hex.EncodeToString(schnorrPubKey(sk))
+	if evt.CreatedAt == 0 {
+		evt.CreatedAt = time.Now().Unix()
+	}
+	if evt.Tags == nil {
+		evt.Tags = [][]string{}
+	}
+	id := evt.hash()
+	sig, err := schnorrSign(sk, id)
+	if err != nil {
+		return err
+	}
+	evt.ID = hex.EncodeToString(id)
+	evt.Sig = hex.EncodeToString(sig)
+	return nil
+}
+
+func (evt NostrEvent) CheckSignature() bool {
+	id := evt.hash()
+	if hex.EncodeToString(id) != evt.ID {
+		return false
+	}
+	pubkey, err1 := hex.DecodeString(evt.PubKey)
+	sig, err2 := hex.DecodeString(evt.Sig)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return schnorrVerify(pubkey, id, sig)
+}
+
+// BIP-340 signatures and the NIP-04 shared secret come from btcec/v2, btcec v1
+// used elsewhere doesn't have schnorr.
+
+func schnorrPubKey(sk *btcec.PrivateKey) []byte {
+	return schnorr.SerializePubKey(sk.PubKey())
+}
+
+func schnorrSign(sk *btcec.PrivateKey, msg []byte) ([]byte, error) {
+	sig, err := schnorr.Sign(sk, msg)
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+func schnorrVerify(pubkey []byte, msg []byte, sig []byte) bool {
+	pk, err := schnorr.ParsePubKey(pubkey)
+	if err != nil {
+		return false
+	}
+	signature, err := schnorr.ParseSignature(sig)
+	if err != nil {
+		return false
+	}
+	return signature.Verify(msg, pk)
+}
+
+// NIP-04
+
+func nip04SharedSecret(sk *btcec.PrivateKey, pubkey string) ([]byte, error) {
+	b, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := schnorr.ParsePubKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return btcec.GenerateSharedSecret(sk, pk), nil
+}
+
+func nip04Encrypt(sk *btcec.PrivateKey, pubkey string, plaintext string) (string, error) {
+	key, err := nip04SharedSecret(sk, pubkey)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, 16)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append([]byte(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return base64.StdEncoding.EncodeToString(ciphertext) + "?iv=" +
+		base64.StdEncoding.EncodeToString(iv), nil
+}
+
+func nip04Decrypt(sk *btcec.PrivateKey, pubkey string, content string) (string, error) {
+	parts := strings.Split(content, "?iv=")
+	if len(parts) != 2 {
+		return "", errors.New("invalid nip04 content")
+	}
+	ciphertext, err1 := base64.StdEncoding.DecodeString(parts[0])
+	iv, err2 := base64.StdEncoding.DecodeString(parts[1])
+	if err1 != nil || err2 != nil || len(iv) != aes.BlockSize ||
+		len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return "", errors.New("invalid nip04 content")
+	}
+
+	key, err := nip04SharedSecret(sk, pubkey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(plaintext) {
+		return "", errors.New("invalid nip04 padding")
+	}
+	return string(plaintext[:len(plaintext)-padding]), nil
+}
+
+// websocket relay
+
+type websocketRelay struct {
+	url  string
+	conn *websocket.Conn
+
+	sync.Mutex
+	subscriptions map[string]chan NostrEvent
+	closed        bool
+}
+
+func connectNostrRelay(url string) (NostrRelay, error) {
+	conn, err := websocket.Dial(url, "", s.ServiceURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", url, err)
+	}
+
+	relay := &websocketRelay{
+		url:           url,
+		conn:          conn,
+		subscriptions: make(map[string]chan NostrEvent),
+	}
+	go relay.readLoop()
+	return relay, nil
+}
+
+func (relay *websocketRelay) readLoop() {
+	defer relay.Close()
+
+	for {
+		var msg []json.RawMessage
+		if err := websocket.JSON.Receive(relay.conn, &msg); err != nil {
+			log.Warn().Err(err).Str("relay", relay.url).Msg("nostr relay connection closed")
+			return
+		}
+		if len(msg) < 2 {
+			continue
+		}
+
+		var typ string
+		json.Unmarshal(msg[0], &typ)
+		switch typ {
+		case "EVENT":
+			if len(msg) < 3 {
+				continue
+			}
+			var subId string
+			var evt NostrEvent
+			json.Unmarshal(msg[1], &subId)
+			if err := json.Unmarshal(msg[2], &evt); err != nil {
+				continue
+			}
+
+			relay.Lock()
+			ch, ok := relay.subscriptions[subId]
+			if ok {
+				select {
+				case ch <- evt:
+				default:
+					log.Warn().Str("relay", relay.url).Msg("nostr subscription is full")
+				}
+			}
+			relay.Unlock()
+		case "NOTICE", "OK", "CLOSED":
+			log.Debug().Str("relay", relay.url).Str("type", typ).
+				Str("msg", string(msg[len(msg)-1])).Msg("nostr relay message")
+		}
+	}
+}
+
+func (relay *websocketRelay) send(msg []interface{}) error {
+	relay.Lock()
+	defer relay.Unlock()
+	if relay.closed {
+		return errors.New("relay connection is closed")
+	}
+	return websocket.JSON.Send(relay.conn, msg)
+}
+
+func (relay *websocketRelay) Publish(ctx context.Context, evt NostrEvent) error {
+	return relay.send([]interface{}{"EVENT", evt})
+}
+
+func (relay *websocketRelay) Subscribe(ctx context.Context, filter NostrFilter) (<-chan NostrEvent, error) {
+	subId, _ := randomHex()
+	subId = subId[:16]
+
+	ch := make(chan NostrEvent, 100)
+	relay.Lock()
+	relay.subscriptions[subId] = ch
+	relay.Unlock()
+
+	// Close may have closed it already
+	unsubscribe := func() {
+		relay.Lock()
+		if _, ok := relay.subscriptions[subId]; ok {
+			delete(relay.subscriptions, subId)
+			close(ch)
+		}
+		relay.Unlock()
+	}
+
+	if err := relay.send([]interface{}{"REQ", subId, filter}); err != nil {
+		unsubscribe()
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		relay.send([]interface{}{"CLOSE", subId})
+		unsubscribe()
+	}()
+
+	return ch, nil
+}
+
+func (relay *websocketRelay) Close() error {
+	relay.Lock()
+	defer relay.Unlock()
+	if relay.closed {
+		return nil
+	}
+	relay.closed = true
+	for subId, ch := range relay.subscriptions {
+		delete(relay.subscriptions, subId)
+		close(ch)
+	}
+	return relay.conn.Close()
+}
+
+// in-memory relay, shared by everybody, for running without the network
+
+type memoryRelay struct {
+	sync.Mutex
+	events        []NostrEvent
+	subscriptions map[chan NostrEvent]NostrFilter
+}
+
+var sharedMemoryRelay = &memoryRelay{
+	subscriptions: make(map[chan NostrEvent]NostrFilter),
+}
+
+func connectMemoryRelay(url string) (NostrRelay, error) {
+	return sharedMemoryRelay, nil
+}
+
+func (relay *memoryRelay) Publish(ctx context.Context, evt NostrEvent) error {
+	if !evt.CheckSignature() {
+		return errors.New("invalid signature")
+	}
+
+	relay.Lock()
+	defer relay.Unlock()
+	relay.events = append(relay.events, evt)
+	for ch, filter := range relay.subscriptions {
+		if filter.Matches(evt) {
+			select {
+			case ch <- evt:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (relay *memoryRelay) Subscribe(ctx context.Context, filter NostrFilter) (<-chan NostrEvent, error) {
+	ch := make(chan NostrEvent, 100)
+
+	relay.Lock()
+	for _, evt := range relay.events {
+		if filter.Matches(evt) {
+			select {
+			case ch <- evt:
+			default:
+			}
+		}
+	}
+	relay.subscriptions[ch] = filter
+	relay.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		relay.Lock()
+		delete(relay.subscriptions, ch)
+		close(ch)
+		relay.Unlock()
+	}()
+
+	return ch, nil
+}
+
+// Close does nothing, subscriptions end when their context is done.
+func (relay *memoryRelay) Close() error { return nil }
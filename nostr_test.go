@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"golang.org/x/net/websocket"
+)
+
+// the official BIP-340 test vectors, from bip-0340/test-vectors.csv.
+var bip340Vectors = []struct {
+	secretKey string
+	publicKey string
+	auxRand   string
+	message   string
+	signature string
+	valid     bool
+}{
+	{
+		"0000000000000000000000000000000000000000000000000000000000000003",
+		"F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0",
+		true,
+	},
+	{
+		"B7E151628AED2A6ABF7158809CF4F3C762E7160F38B4DA56A784D9045190CFEF",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"0000000000000000000000000000000000000000000000000000000000000001",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A",
+		true,
+	},
+	{
+		"C90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B14E5C9",
+		"DD308AFEC5777E13121FA72B9CC1B7CC0139715309B086C960E18FD969774EB8",
+		"C87AA53824B4D7AE2EB035A2B5BBBCCC080E76CDC6D1692C4B0B62D798E6D906",
+		"7E2D58D8B3BCDF1ABADEC7829054F90DDA9805AAB56C77333024B9D0A508B75C",
+		"5831AAEED7B44BB74E5EAB94BA9D4294C49BCF2A60728D8B4C200F50DD313C1BAB745879A5AD954A72C45A91C3A51D3C7ADEA98D82F8481E0E1E03674A6F3FB7",
+		true,
+	},
+	{
+		"0B432B2677937381AEF05BB02A66ECD012773062CF3FA2549E44F58ED2401710",
+		"25D1DFF95105F5253C4022F628A996AD3A0D95FBF21D468A1B33F8C160D8F517",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+		"7EB0509757E246F19449885651611CB965ECC1A187DD51B64FDA1EDC9637D5EC97582B9CB13DB3933705B32BA982AF5AF25FD78881EBB32771FC5922EFC66EA3",
+		true,
+	},
+	{
+		"",
+		"D69C3509BB99E412E68B0FE8544E72837DFA30746D8BE2AA65975F29D22DC7B9",
+		"",
+		"4DF3C3F68FCC83B27E9D42C90431A72499F17875C81A599B566C9889B9696703",
+		"00000000000000000000003B78CE563F89A0ED9414F5AA28AD0D96D6795F9C6376AFB1548AF603B3EB45C9F8207DEE1060CB71C04E80F593060B07D28308D7F4",
+		true,
+	},
+	{ // public key not on the curve
+		"",
+		"EEFDEA4CDB677750A420FEE807EACF21EB9898AE79B9768766E4FAA04A2D4A34",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E17776969E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B",
+		false,
+	},
+	{ // has_even_y(R) is false
+		"",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"FFF97BD5755EEEA420453A14355235D382F6472F8568A18B2F057A14602975563CC27944640AC607CD107AE10923D9EF7A73C643E166BE5EBEAFA34B1AC553E2",
+		false,
+	},
+	{ // negated message
+		"",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"1FA62E331EDBC21C394792D2AB1100A7B432B013DF3F6FF4F99FCB33E0E1515F28890B3EDB6E7189B630448B515CE4F8622A954CFE545735AAEA5134FCCDB2BD",
+		false,
+	},
+	{ // negated s value
+		"",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E177769961764B3AA9B2FFCB6EF947B6887A226E8D7C93E00C5ED0C1834FF0D0C2E6DA6",
+		false,
+	},
+	{ // sG - eP is infinite, x(inf) taken as 0
+		"",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"0000000000000000000000000000000000000000000000000000000000000000123DDA8328AF9C23A94C1FEECFD123BA4FB73476F0D594DCB65C6425BD186051",
+		false,
+	},
+	{ // sG - eP is infinite, x(inf) taken as 1
+		"",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"00000000000000000000000000000000000000000000000000000000000000017615FBAF5AE28864013C099742DEADB4DBA87F11AC6754F93780D5A1837CF197",
+		false,
+	},
+	{ // sig[0:32] is not an x coordinate on the curve
+		"",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"4A298DACAE57395A15D0795DDBFD1DCB564DA82B0F269BC70A74F8220429BA1D69E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B",
+		false,
+	},
+	{ // sig[0:32] is equal to the field size
+		"",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F69E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B",
+		false,
+	},
+	{ // sig[32:64] is equal to the curve order
+		"",
+		"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E177769FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141",
+		false,
+	},
+	{ // public key exceeds the field size
+		"",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC30",
+		"",
+		"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+		"6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E17776969E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B",
+		false,
+	},
+}
+
+func TestBIP340Vectors(t *testing.T) {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatalf("bad vector %q", s)
+		}
+		return b
+	}
+
+	for i, v := range bip340Vectors {
+		pubkey := unhex(v.publicKey)
+		msg := unhex(v.message)
+		sig := unhex(v.signature)
+
+		if v.secretKey != "" {
+			sk, _ := btcec.PrivKeyFromBytes(unhex(v.secretKey))
+			if got := schnorrPubKey(sk); !bytes.Equal(got, pubkey) {
+				t.Errorf("vector %d: got pubkey %x", i, got)
+			}
+
+			var aux [32]byte
+			copy(aux[:], unhex(v.auxRand))
+			got, err := schnorr.Sign(sk, msg, schnorr.CustomNonce(aux))
+			if err != nil || !bytes.Equal(got.Serialize(), sig) {
+				t.Errorf("vector %d: got signature %x, %v", i, got.Serialize(), err)
+			}
+		}
+
+		if got := schnorrVerify(pubkey, msg, sig); got != v.valid {
+			t.Errorf("vector %d: verify got %v", i, got)
+		}
+	}
+}
+
+func TestNostrEventSignature(t *testing.T) {
+	sk, _ := btcec.NewPrivateKey()
+
+	evt := NostrEvent{
+		Kind:    1,
+		Tags:    [][]string{{"p", strings.Repeat("ab", 32)}},
+		Content: "<hello> \"nostr\" & ⚡",
+	}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	if !evt.CheckSignature() {
+		t.Fatal("signed event doesn't check")
+	}
+
+	tampered := evt
+	tampered.Content = "something else"
+	if tampered.CheckSignature() {
+		t.Error("tampered content checks")
+	}
+
+	tampered = evt
+	tampered.ID = hex.EncodeToString(tampered.hash())
+	tampered.CreatedAt++
+	if tampered.CheckSignature() {
+		t.Error("tampered created_at checks")
+	}
+}
+
+func TestNIP04(t *testing.T) {
+	alice, _ := btcec.NewPrivateKey()
+	bob, _ := btcec.NewPrivateKey()
+	alicePub := hex.EncodeToString(schnorrPubKey(alice))
+	bobPub := hex.EncodeToString(schnorrPubKey(bob))
+
+	for _, plaintext := range []string{
+		"",
+		"a",
+		"exactly sixteen!",
+		`{"method":"pay_invoice","params":{"invoice":"lnbc1..."}}`,
+		strings.Repeat("⚡", 100),
+	} {
+		content, err := nip04Encrypt(alice, bobPub, plaintext)
+		if err != nil {
+			t.Fatalf("failed to encrypt %q: %s", plaintext, err)
+		}
+		if got, err := nip04Decrypt(bob, alicePub, content); err != nil || got != plaintext {
+			t.Errorf("bob got %q, %v for %q", got, err, plaintext)
+		}
+
+		// and the same shared secret works the other way
+		content, _ = nip04Encrypt(bob, alicePub, plaintext)
+		if got, err := nip04Decrypt(alice, bobPub, content); err != nil || got != plaintext {
+			t.Errorf("alice got %q, %v for %q", got, err, plaintext)
+		}
+	}
+
+	eve, _ := btcec.NewPrivateKey()
+	content, _ := nip04Encrypt(alice, bobPub, "secret message")
+	if got, err := nip04Decrypt(eve, alicePub, content); err == nil && got == "secret message" {
+		t.Error("a third key could decrypt")
+	}
+
+	for _, invalid := range []string{
+		"",
+		"no iv",
+		"AAAA?iv=short",
+		content[:strings.Index(content, "?iv=")] + "?iv=",
+	} {
+		if _, err := nip04Decrypt(bob, alicePub, invalid); err == nil {
+			t.Errorf("decrypted %q", invalid)
+		}
+	}
+}
+
+func TestMemoryRelay(t *testing.T) {
+	relay, err := connectMemoryRelay("wss://relay.test")
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	sk, _ := btcec.NewPrivateKey()
+	author := hex.EncodeToString(schnorrPubKey(sk))
+	publish := func(kind int, content string) NostrEvent {
+		evt := NostrEvent{Kind: kind, Content: content}
+		if err := evt.Sign(sk); err != nil {
+			t.Fatalf("failed to sign: %s", err)
+		}
+		if err := relay.Publish(context.Background(), evt); err != nil {
+			t.Fatalf("failed to publish: %s", err)
+		}
+		return evt
+	}
+	receive := func(ch <-chan NostrEvent) NostrEvent {
+		select {
+		case evt := <-ch:
+			return evt
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+			return NostrEvent{}
+		}
+	}
+
+	// stored events are delivered on subscription
+	before := publish(23194, "before")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := relay.Subscribe(ctx, NostrFilter{Kinds: []int{23194}, Authors: []string{author}})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	if evt := receive(ch); evt.ID != before.ID {
+		t.Errorf("got %s instead of the stored event", evt.Content)
+	}
+
+	// then new ones, only if they match
+	publish(1, "other kind")
+	after := publish(23194, "after")
+	if evt := receive(ch); evt.ID != after.ID {
+		t.Errorf("got %s instead of the new event", evt.Content)
+	}
+
+	// forged events are refused
+	forged := after
+	forged.Content = "forged"
+	if err := relay.Publish(context.Background(), forged); err == nil {
+		t.Error("forged event was accepted")
+	}
+
+	cancel()
+	select {
+	case evt, ok := <-ch:
+		if ok {
+			t.Errorf("got %s after closing", evt.Content)
+		}
+	case <-time.After(time.Second):
+		t.Error("subscription wasn't closed")
+	}
+}
+
+func TestWebsocketRelaySubscriptions(t *testing.T) {
+	received := make(chan []interface{}, 10)
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		for {
+			var msg []interface{}
+			if err := websocket.JSON.Receive(conn, &msg); err != nil {
+				return
+			}
+			received <- msg
+		}
+	}))
+	defer server.Close()
+
+	if s.ServiceURL == "" {
+		s.ServiceURL = "http://lntxbot.test"
+	}
+	relay, err := connectNostrRelay("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	ws := relay.(*websocketRelay)
+	subscriptions := func() int {
+		ws.Lock()
+		defer ws.Unlock()
+		return len(ws.subscriptions)
+	}
+	expect := func(typ string) {
+		t.Helper()
+		select {
+		case msg := <-received:
+			if msg[0] != typ {
+				t.Errorf("relay got %v, expected %s", msg, typ)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("relay never got %s", typ)
+		}
+	}
+
+	// a subscription is closed and forgotten when its context ends
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := relay.Subscribe(ctx, NostrFilter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	expect("REQ")
+	cancel()
+	expect("CLOSE")
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("got an event instead of the channel closing")
+		}
+	case <-time.After(time.Second):
+		t.Error("subscription channel wasn't closed")
+	}
+	if n := subscriptions(); n != 0 {
+		t.Errorf("%d subscriptions left", n)
+	}
+
+	// closing the relay first doesn't close them twice
+	ctx, cancel = context.WithCancel(context.Background())
+	if _, err := relay.Subscribe(ctx, NostrFilter{Kinds: []int{1}}); err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	expect("REQ")
+	relay.Close()
+	cancel()
+
+	// and subscribing to a closed relay leaves nothing behind
+	if _, err := relay.Subscribe(context.Background(), NostrFilter{}); err == nil {
+		t.Error("subscribed to a closed relay")
+	}
+	if n := subscriptions(); n != 0 {
+		t.Errorf("%d subscriptions left", n)
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/docopt/docopt-go"
+	decodepay "github.com/fiatjaf/ln-decodepay"
+	"github.com/fiatjaf/lntxbot/t"
+	"github.com/lib/pq"
+)
+
+// NIP-47, nostr wallet connect. there is one service key for the whole bot,
+// each connection is a client key that is allowed to send requests on behalf
+// of one user.
+
+const (
+	NWCInfoKind     = 13194
+	NWCRequestKind  = 23194
+	NWCResponseKind = 23195
+)
+
+const nwcMethods = "pay_invoice make_invoice get_balance lookup_invoice list_transactions"
+
+type NWCConnection struct {
+	Id              int           `db:"id"`
+	AccountId       int           `db:"account_id"`
+	Name            string        `db:"name"`
+	PubKey          string        `db:"pubkey"`
+	DailyBudgetMsat sql.NullInt64 `db:"daily_budget_msat"`
+	CreatedAt       time.Time     `db:"created_at"`
+	LastUsedAt      *time.Time    `db:"last_used_at"`
+	RevokedAt       *time.Time    `db:"revoked_at"`
+}
+
+type NWCRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type NWCResponse struct {
+	ResultType string      `json:"result_type"`
+	Error      *NWCError   `json:"error,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+}
+
+type NWCError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *NWCError) Error() string { return e.Message }
+
+func nwcError(code string, message string) *NWCError {
+	return &NWCError{Code: code, Message: message}
+}
+
+// NWCTransaction is the transaction object from NIP-47.
+type NWCTransaction struct {
+	Type        string `json:"type"` // incoming or outgoing
+	Invoice     string `json:"invoice,omitempty"`
+	Description string `json:"description,omitempty"`
+	Preimage    string `json:"preimage,omitempty"`
+	PaymentHash string `json:"payment_hash"`
+	Amount      int64  `json:"amount"`
+	FeesPaid    int64  `json:"fees_paid"`
+	CreatedAt   int64  `json:"created_at"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+	SettledAt   int64  `json:"settled_at,omitempty"`
+}
+
+var ErrNWCNameNotUnique = errors.New("There's already a connection with this name.")
+
+func nwcServiceKey() *btcec.PrivateKey {
+	seedhash := sha256.Sum256([]byte("nwcservicekey:" + s.TelegramBotToken))
+	sk, _ := btcec.PrivKeyFromBytes(seedhash[:])
+	return sk
+}
+
+func (u User) createNWCConnection(
+	name string,
+	dailyBudgetMsat int64,
+) (conn NWCConnection, connectionString string, err error) {
+	clientKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		return
+	}
+
+	err = pg.Get(&conn, `
+INSERT INTO nwc_connection (account_id, name, pubkey, daily_budget_msat)
+VALUES ($1, $2, $3, $4)
+RETURNING *
+    `, u.Id, name, hex.EncodeToString(schnorrPubKey(clientKey)),
+		sql.NullInt64{Int64: dailyBudgetMsat, Valid: dailyBudgetMsat > 0})
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+			err = ErrNWCNameNotUnique
+		}
+		return
+	}
+
+	qs := url.Values{}
+	qs.Set("relay", s.NWCRelayURL)
+	qs.Set("secret", hex.EncodeToString(clientKey.Serialize()))
+	if u.Username != "" {
+		qs.Set("lud16", u.Username+"@"+getHost())
+	}
+	connectionString = fmt.Sprintf("nostr+walletconnect://%s?%s",
+		hex.EncodeToString(schnorrPubKey(nwcServiceKey())), qs.Encode())
+
+	return
+}
+
+func (u User) listNWCConnections() (conns []NWCConnection, err error) {
+	err = pg.Select(&conns, `
+SELECT * FROM nwc_connection
+WHERE account_id = $1 AND revoked_at IS NULL
+ORDER BY id
+    `, u.Id)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (u User) revokeNWCConnection(name string) error {
+	res, err := pg.Exec(`
+UPDATE nwc_connection SET revoked_at = now()
+WHERE account_id = $1 AND name = $2 AND revoked_at IS NULL
+    `, u.Id, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func loadNWCConnection(pubkey string) (conn NWCConnection, err error) {
+	err = pg.Get(&conn, `
+SELECT * FROM nwc_connection
+WHERE pubkey = $1 AND revoked_at IS NULL
+    `, pubkey)
+	if err != nil {
+		return
+	}
+
+	go pg.Exec(`UPDATE nwc_connection SET last_used_at = now() WHERE id = $1`, conn.Id)
+	return
+}
+
+// spend consumes from the connection's daily budget, refund gives it back.
+func (conn NWCConnection) spend(msatoshi int64) error {
+	if !conn.DailyBudgetMsat.Valid {
+		return nil
+	}
+
+	rkey := conn.budgetKey()
+	spent, err := rds.IncrBy(rkey, msatoshi).Result()
+	if err != nil {
+		return err
+	}
+	rds.Expire(rkey, 48*time.Hour)
+	if spent > conn.DailyBudgetMsat.Int64 {
+		rds.DecrBy(rkey, msatoshi)
+		return nwcError("QUOTA_EXCEEDED", "This connection's daily budget is exhausted.")
+	}
+	return nil
+}
+
+// trackSpending remembers what a payment has taken from the budget so it can be
+// given back with releaseNWCSpendingFor, also by paymentHasFailed.
+func (conn NWCConnection) trackSpending(hash string, msatoshi int64) {
+	if conn.DailyBudgetMsat.Valid {
+		rds.Set("nwc:payment:"+hash,
+			fmt.Sprintf("%d %s", msatoshi, conn.budgetKey()), 48*time.Hour)
+	}
+}
+
+func releaseNWCSpendingFor(hash string) {
+	releaseReservedSpending("nwc:payment:" + hash)
+}
+
+func (conn NWCConnection) budgetKey() string {
+	return fmt.Sprintf("nwc:spent:%d:%s", conn.Id, time.Now().UTC().Format("2006-01-02"))
+}
+
+func nwcRoutine() {
+	if s.NWCRelayURL == "" {
+		return
+	}
+
+	for {
+		relay, err := connectRelay(s.NWCRelayURL)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to connect to nwc relay")
+		} else {
+			serveNWC(relay)
+			relay.Close()
+		}
+
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// serveNWC answers NWC requests that come through the relay until it
+// disconnects.
+func serveNWC(relay NostrRelay) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sk := nwcServiceKey()
+	servicePubKey := hex.EncodeToString(schnorrPubKey(sk))
+
+	info := NostrEvent{Kind: NWCInfoKind, Content: nwcMethods}
+	if err := info.Sign(sk); err == nil {
+		if err := relay.Publish(ctx, info); err != nil {
+			log.Warn().Err(err).Msg("failed to publish nwc info event")
+		}
+	}
+
+	events, err := relay.Subscribe(ctx, NostrFilter{
+		Kinds: []int{NWCRequestKind},
+		PTags: []string{servicePubKey},
+		Since: time.Now().Add(-1 * time.Minute).Unix(),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to subscribe to nwc requests")
+		return
+	}
+
+	log.Info().Str("pubkey", servicePubKey).Str("relay", s.NWCRelayURL).
+		Msg("serving nwc")
+	for evt := range events {
+		go func(evt NostrEvent) {
+			response, conn, ok := handleNWCEvent(evt)
+			if !ok {
+				return
+			}
+
+			content, _ := json.Marshal(response)
+			encrypted, err := nip04Encrypt(sk, evt.PubKey, string(content))
+			if err != nil {
+				return
+			}
+
+			reply := NostrEvent{
+				Kind:    NWCResponseKind,
+				Content: encrypted,
+				Tags:    [][]string{{"p", evt.PubKey}, {"e", evt.ID}},
+			}
+			if err := reply.Sign(sk); err != nil {
+				return
+			}
+			if err := relay.Publish(ctx, reply); err != nil {
+				log.Warn().Err(err).Int("connection", conn.Id).
+					Msg("failed to publish nwc response")
+			}
+		}(evt)
+	}
+}
+
+func handleNWCEvent(evt NostrEvent) (response NWCResponse, conn NWCConnection, ok bool) {
+	if evt.Kind != NWCRequestKind || !evt.CheckSignature() {
+		return
+	}
+
+	// relays may send the same event more than once
+	if fresh, err := rds.SetNX("nwc:req:"+evt.ID, "1", 24*time.Hour).Result(); err != nil || !fresh {
+		return
+	}
+
+	plaintext, err := nip04Decrypt(nwcServiceKey(), evt.PubKey, evt.Content)
+	if err != nil {
+		return
+	}
+	var req NWCRequest
+	if err := json.Unmarshal([]byte(plaintext), &req); err != nil {
+		return
+	}
+	response.ResultType = req.Method
+
+	conn, err = loadNWCConnection(evt.PubKey)
+	if err != nil {
+		response.Error = nwcError("UNAUTHORIZED", "Unknown or revoked connection.")
+		return response, conn, true
+	}
+
+	user, err := loadUser(conn.AccountId)
+	if err != nil {
+		response.Error = nwcError("UNAUTHORIZED", "Account not found.")
+		return response, conn, true
+	}
+
+	ctx := context.WithValue(context.Background(), "origin", "nwc")
+	ctx = context.WithValue(ctx, "initiator", user)
+
+	log.Debug().Stringer("user", user).Int("connection", conn.Id).
+		Str("method", req.Method).Msg("nwc request")
+
+	var nwcerr *NWCError
+	switch req.Method {
+	case "pay_invoice":
+		response.Result, nwcerr = nwcPayInvoice(ctx, user, conn, req.Params)
+	case "make_invoice":
+		response.Result, nwcerr = nwcMakeInvoice(ctx, user, req.Params)
+	case "get_balance":
+		response.Result, nwcerr = nwcGetBalance(user)
+	case "lookup_invoice":
+		response.Result, nwcerr = nwcLookupInvoice(user, req.Params)
+	case "list_transactions":
+		response.Result, nwcerr = nwcListTransactions(user, req.Params)
+	default:
+		nwcerr = nwcError("NOT_IMPLEMENTED", "Unknown method.")
+	}
+	if nwcerr != nil {
+		response.Result = nil
+		response.Error = nwcerr
+	}
+
+	return response, conn, true
+}
+
+func nwcErrorFrom(err error) *NWCError {
+	switch err {
+	case ErrInsufficientBalance:
+		return nwcError("INSUFFICIENT_BALANCE", err.Error())
+	case ErrDatabase:
+		return nwcError("INTERNAL", err.Error())
+	}
+	if nwcerr, ok := err.(*NWCError); ok {
+		return nwcerr
+	}
+	return nwcError("OTHER", err.Error())
+}
+
+func nwcPayInvoice(
+	ctx context.Context,
+	user *User,
+	conn NWCConnection,
+	raw json.RawMessage,
+) (interface{}, *NWCError) {
+	var params struct {
+		Invoice string `json:"invoice"`
+		Amount  int64  `json:"amount"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, nwcError("OTHER", "Invalid params.")
+	}
+
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return nil, nwcError("OTHER", "Invalid invoice.")
+	}
+	amount := inv.MSatoshi
+	if amount == 0 {
+		amount = params.Amount
+	}
+
+	if err := conn.spend(amount); err != nil {
+		return nil, nwcErrorFrom(err)
+	}
+	conn.trackSpending(inv.PaymentHash, amount)
+
+	success := waitPaymentSuccess(inv.PaymentHash)
+	if _, err := user.payInvoice(ctx, params.Invoice, params.Amount); err != nil {
+		releaseNWCSpendingFor(inv.PaymentHash)
+		return nil, nwcErrorFrom(err)
+	}
+
+	select {
+	case preimage := <-success:
+		return map[string]interface{}{"preimage": preimage}, nil
+	case <-time.After(60 * time.Second):
+		return nil, nwcError("OTHER", "Payment is still pending.")
+	}
+}
+
+func nwcMakeInvoice(ctx context.Context, user *User, raw json.RawMessage) (interface{}, *NWCError) {
+	var params struct {
+		Amount          int64  `json:"amount"`
+		Description     string `json:"description"`
+		DescriptionHash string `json:"description_hash"`
+		Expiry          int64  `json:"expiry"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, nwcError("OTHER", "Invalid params.")
+	}
+
+	args := &MakeInvoiceArgs{
+		Msatoshi:        params.Amount,
+		Description:     params.Description,
+		DescriptionHash: params.DescriptionHash,
+	}
+	if params.Expiry > 0 {
+		expiry := time.Duration(params.Expiry) * time.Second
+		args.Expiry = &expiry
+	}
+
+	bolt11, hash, err := user.makeInvoice(ctx, args)
+	if err != nil {
+		return nil, nwcErrorFrom(err)
+	}
+
+	now := time.Now()
+	return NWCTransaction{
+		Type:        "incoming",
+		Invoice:     bolt11,
+		Description: params.Description,
+		PaymentHash: hash,
+		Amount:      params.Amount,
+		CreatedAt:   now.Unix(),
+		ExpiresAt:   now.Add(*args.Expiry).Unix(),
+	}, nil
+}
+
+func nwcGetBalance(user *User) (interface{}, *NWCError) {
+	info, err := user.getInfo()
+	if err != nil {
+		return nil, nwcError("INTERNAL", "Failed to get balance.")
+	}
+	return map[string]interface{}{"balance": info.BalanceMsat}, nil
+}
+
+func nwcLookupInvoice(user *User, raw json.RawMessage) (interface{}, *NWCError) {
+	var params struct {
+		PaymentHash string `json:"payment_hash"`
+		Invoice     string `json:"invoice"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, nwcError("OTHER", "Invalid params.")
+	}
+	hash := params.PaymentHash
+	if hash == "" {
+		inv, err := decodepay.Decodepay(params.Invoice)
+		if err != nil {
+			return nil, nwcError("OTHER", "Invalid invoice.")
+		}
+		hash = inv.PaymentHash
+	}
+
+	// our own invoices, paid or not
+	var inv struct {
+		Bolt11      string     `db:"bolt11"`
+		Description string     `db:"description"`
+		Preimage    string     `db:"preimage"`
+		Msatoshi    int64      `db:"msatoshi"`
+		Received    *int64     `db:"received"`
+		CreatedAt   time.Time  `db:"created_at"`
+		ExpiresAt   time.Time  `db:"expires_at"`
+		SettledAt   *time.Time `db:"settled_at"`
+	}
+	err := pg.Get(&inv, `
+SELECT
+  coalesce(i.bolt11, '') AS bolt11,
+  coalesce(i.description, '') AS description,
+  i.preimage,
+  i.msatoshi::bigint AS msatoshi,
+  t.amount::bigint AS received,
+  i.created_at,
+  i.expires_at,
+  t.time AS settled_at
+FROM lightning.invoice AS i
+LEFT JOIN lightning.transaction AS t
+  ON t.payment_hash = i.payment_hash AND t.to_id = i.account_id
+WHERE i.account_id = $1 AND i.payment_hash = $2
+    `, user.Id, hash)
+	if err == nil {
+		tx := NWCTransaction{
+			Type:        "incoming",
+			Invoice:     inv.Bolt11,
+			Description: inv.Description,
+			PaymentHash: hash,
+			Amount:      inv.Msatoshi,
+			CreatedAt:   inv.CreatedAt.Unix(),
+			ExpiresAt:   inv.ExpiresAt.Unix(),
+		}
+		if inv.SettledAt != nil {
+			tx.Preimage = inv.Preimage
+			tx.Amount = *inv.Received
+			tx.SettledAt = inv.SettledAt.Unix()
+		}
+		return tx, nil
+	}
+
+	// or payments we've made
+	txns, err := user.listTransactionsFiltered(TransactionFilter{Limit: 500, Direction: Out})
+	if err == nil {
+		for _, txn := range txns {
+			if txn.PaymentHash == hash {
+				return nwcTransactionFromAPI(txn), nil
+			}
+		}
+	}
+
+	return nil, nwcError("NOT_FOUND", "Invoice not found.")
+}
+
+func nwcListTransactions(user *User, raw json.RawMessage) (interface{}, *NWCError) {
+	var params struct {
+		From   int64  `json:"from"`
+		Until  int64  `json:"until"`
+		Limit  int    `json:"limit"`
+		Offset int    `json:"offset"`
+		Type   string `json:"type"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, nwcError("OTHER", "Invalid params.")
+		}
+	}
+
+	filter := TransactionFilter{Limit: params.Limit, Offset: params.Offset}
+	if filter.Limit <= 0 || filter.Limit > 500 {
+		filter.Limit = 50
+	}
+	switch params.Type {
+	case "incoming":
+		filter.Direction = In
+	case "outgoing":
+		filter.Direction = Out
+	}
+	if params.From > 0 {
+		from := time.Unix(params.From, 0)
+		filter.Since = &from
+	}
+	if params.Until > 0 {
+		until := time.Unix(params.Until, 0)
+		filter.Until = &until
+	}
+
+	txns, err := user.listTransactionsFiltered(filter)
+	if err != nil {
+		return nil, nwcError("INTERNAL", "Failed to list transactions.")
+	}
+
+	res := make([]NWCTransaction, len(txns))
+	for i, txn := range txns {
+		res[i] = nwcTransactionFromAPI(txn)
+	}
+	return map[string]interface{}{"transactions": res}, nil
+}
+
+func nwcTransactionFromAPI(txn APITransaction) NWCTransaction {
+	tx := NWCTransaction{
+		Type:        "incoming",
+		Description: txn.Description,
+		PaymentHash: txn.PaymentHash,
+		Amount:      txn.AmountMsat,
+		FeesPaid:    txn.FeeMsat,
+		CreatedAt:   txn.Time.Unix(),
+	}
+	if txn.AmountMsat < 0 {
+		tx.Type = "outgoing"
+		tx.Amount = -txn.AmountMsat
+	}
+	if txn.Status != "PENDING" {
+		tx.SettledAt = txn.Time.Unix()
+		if txn.Preimage != nil {
+			tx.Preimage = *txn.Preimage
+		}
+	}
+	return tx
+}
+
+func handleNWC(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+	go u.track("nwc", nil)
+
+	if s.NWCRelayURL == "" {
+		send(ctx, u, t.ERROR, t.T{"Err": "Nostr Wallet Connect is not available."})
+		return
+	}
+
+	switch {
+	case opts["new"].(bool):
+		name, _ := opts.String("<connection>")
+
+		var dailyBudget int64
+		if v, ok := opts["--daily"].(string); ok {
+			msats, err := parseAmountString(v)
+			if err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": "invalid --daily."})
+				return
+			}
+			dailyBudget = msats
+		}
+
+		conn, connectionString, err := u.createNWCConnection(name, dailyBudget)
+		if err != nil {
+			log.Warn().Err(err).Stringer("user", u).Msg("failed to create nwc connection")
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.NWCCREATED, t.T{"Connection": conn})
+		send(ctx, qrURL(connectionString), "<code>"+connectionString+"</code>")
+	case opts["revoke"].(bool):
+		name, _ := opts.String("<connection>")
+		if err := u.revokeNWCConnection(name); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": "connection not found."})
+			return
+		}
+		send(ctx, t.COMPLETED)
+	default:
+		conns, err := u.listNWCConnections()
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, u, t.NWCLIST, t.T{"Connections": conns})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestNWCSpending(t *testing.T) {
+	setupTestRedis(t)
+
+	conn := NWCConnection{
+		Id:              4343,
+		DailyBudgetMsat: sql.NullInt64{Int64: 100000, Valid: true},
+	}
+	rds.Del(conn.budgetKey())
+	spent := func() int64 {
+		v, _ := rds.Get(conn.budgetKey()).Int64()
+		return v
+	}
+
+	// reserved for payments that fail later, given back only once
+	for _, hash := range []string{"aa", "bb"} {
+		if err := conn.spend(50000); err != nil {
+			t.Fatal(err)
+		}
+		conn.trackSpending(hash, 50000)
+	}
+	if err := conn.spend(1000); err == nil {
+		t.Error("expected the budget to be exhausted")
+	}
+	releaseNWCSpendingFor("aa")
+	releaseNWCSpendingFor("aa")
+	releaseNWCSpendingFor("unknown")
+	if spent() != 50000 {
+		t.Errorf("spent %d after a failure", spent())
+	}
+
+	// connections without a budget don't track anything
+	unlimited := NWCConnection{Id: 4344}
+	unlimited.trackSpending("cc", 1000)
+	if rds.Exists("nwc:payment:cc").Val() {
+		t.Error("tracked a payment without a budget")
+	}
+}
@@ -3,15 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/die-net/lrucache"
 	decodepay "github.com/fiatjaf/ln-decodepay"
 	"github.com/fiatjaf/lntxbot/t"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/gregjones/httpcache"
 )
 
@@ -23,9 +26,16 @@ var depositDeezyHttpClient = &http.Client{
 	),
 }
 
-func handleDepositOnchain(ctx context.Context) {
-	u := ctx.Value("initiator").(*User)
-	code := createLNURLPayCode(u, "deezy")
+type DeezyDeposit struct {
+	Address    string `json:"address"`
+	Commitment string `json:"commitment"`
+	Signature  string `json:"signature"`
+}
+
+// getDeezyDepositAddress asks deezy.io for an onchain address that forwards
+// everything sent to it to this user's lnurl-pay.
+func (u User) getDeezyDepositAddress() (deposit DeezyDeposit, err error) {
+	code := createLNURLPayCode(&u, "deezy")
 
 	params, _ := json.Marshal(struct {
 		Code string `json:"lnurl_or_lnaddress"`
@@ -33,110 +43,171 @@ func handleDepositOnchain(ctx context.Context) {
 
 	resp, err := depositDeezyHttpClient.Post("https://api.deezy.io/v1/source", "application/json", bytes.NewBuffer(params))
 	if err != nil {
-		send(ctx, u, t.ERROR, t.T{
-			"Err": fmt.Sprintf("failed to call deezy.io API: %s", err.Error()),
-		})
-		return
+		return deposit, fmt.Errorf("failed to call deezy.io API: %w", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		b, _ := ioutil.ReadAll(resp.Body)
 		text := string(b)
-		send(ctx, u, t.ERROR, t.T{
-			"Err": fmt.Sprintf("deezy.io API returned an error (%d): %s", resp.StatusCode, text),
-		})
-		return
+		return deposit, fmt.Errorf("deezy.io API returned an error (%d): %s", resp.StatusCode, text)
 	}
 
-	var val struct {
-		Address    string `json:"address"`
-		Commitment string `json:"commitment"`
-		Signature  string `json:"signature"`
+	if err := json.NewDecoder(resp.Body).Decode(&deposit); err != nil || deposit.Address == "" {
+		return deposit, fmt.Errorf("deezy.io API returned a broken response")
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&val); err != nil {
-		send(ctx, u, t.ERROR, t.T{
-			"Err": fmt.Sprintf("deezy.io API returned a broken response"),
-		})
+
+	return deposit, nil
+}
+
+func handleDepositOnchain(ctx context.Context) {
+	u := ctx.Value("initiator").(*User)
+
+	deposit, err := u.getDeezyDepositAddress()
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
 		return
 	}
 
 	send(ctx, u, t.ONCHAINDEPOSIT, t.T{
 		"ServiceId":  s.ServiceId,
-		"Address":    val.Address,
-		"Commitment": escapeHTML(val.Commitment),
-		"Signature":  val.Signature,
+		"Address":    deposit.Address,
+		"Commitment": escapeHTML(deposit.Commitment),
+		"Signature":  deposit.Signature,
 	})
 }
 
+type onchainSendPrompt struct {
+	Address   string      `json:"address"`
+	AmountSat int64       `json:"amount_sat"`
+	Quotes    []SwapQuote `json:"quotes"`
+}
+
+// handleSendToAddress shows the fee tiers for sending to an onchain address,
+// the swap only happens after the user picks one in handleSendToAddressCallback.
 func handleSendToAddress(ctx context.Context, address string, msats int64) {
 	u := ctx.Value("initiator").(*User)
 
-	params, _ := json.Marshal(struct {
-		AmountSats          int64  `json:"amount_sats"`
-		OnChainAddress      string `json:"on_chain_address"`
-		OnChainSatsPerVByte int    `json:"on_chain_sats_per_vbyte"`
-	}{msats / 1000, address, 2})
+	amountSat := msats / 1000
+	go u.track("onchain send prompt", map[string]interface{}{"sats": amountSat})
 
-	resp, err := http.Post("https://api.deezy.io/v1/swap", "application/json", bytes.NewBuffer(params))
+	quotes, err := swaps.Quote(amountSat)
 	if err != nil {
-		send(ctx, u, t.ERROR, t.T{
-			"Err": fmt.Sprintf("failed to call deezy.io API: %s", err.Error()),
-		})
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
 		return
 	}
-	if resp.StatusCode != 200 {
-		b, _ := ioutil.ReadAll(resp.Body)
-		text := string(b)
-		send(ctx, u, t.ERROR, t.T{
-			"Err": fmt.Sprintf("deezy.io API returned an error (%d): %s", resp.StatusCode, text),
-		})
+
+	random, err := randomHex()
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
 		return
 	}
+	id := random[:16]
+
+	data, _ := json.Marshal(onchainSendPrompt{address, amountSat, quotes})
+	rds.Set("onchainsend:"+id, data, s.PayConfirmTimeout)
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, quote := range quotes {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				translateTemplate(ctx, t.ONCHAINFEETIER, t.T{
+					"Tier":     quote.Tier,
+					"TotalSat": quote.TotalSat,
+				}),
+				fmt.Sprintf("onchain=%s-%d", id, i)),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(
+			translate(ctx, t.CANCEL),
+			fmt.Sprintf("cancel=%d", u.Id)),
+	))
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+
+	send(ctx, u, t.ONCHAINSENDCONFIRM, t.T{
+		"Address":  address,
+		"Sats":     amountSat,
+		"Quotes":   quotes,
+		"Provider": swaps.Name(),
+	}, &keyboard)
+}
 
-	var val struct {
-		Bolt11Invoice string `json:"bolt11_invoice"`
+func handleSendToAddressCallback(ctx context.Context, data string) {
+	u := ctx.Value("initiator").(*User)
+	defer removeKeyboardButtons(ctx)
+
+	parts := strings.Split(data, "-")
+	if len(parts) != 2 {
+		return
+	}
+	idx, _ := strconv.Atoi(parts[1])
+
+	key := "onchainsend:" + parts[0]
+	raw, err := rds.Get(key).Result()
+	if err != nil || rds.Del(key).Val() == 0 {
+		// expired or already clicked
+		send(ctx, t.CALLBACKEXPIRED)
+		return
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&val); err != nil || val.Bolt11Invoice == "" {
-		send(ctx, u, t.ERROR, t.T{
-			"Err": fmt.Sprintf("deezy.io API returned a broken response"),
-		})
+	var prompt onchainSendPrompt
+	if err := json.Unmarshal([]byte(raw), &prompt); err != nil ||
+		idx < 0 || idx >= len(prompt.Quotes) {
+		send(ctx, t.CALLBACKEXPIRED)
 		return
 	}
+	quote := prompt.Quotes[idx]
 
-	processingMessageId := send(ctx, u, val.Bolt11Invoice+"\n\n"+translate(ctx, t.PROCESSING))
+	go u.track("onchain send", map[string]interface{}{
+		"sats": prompt.AmountSat,
+		"tier": quote.Tier,
+	})
+
+	send(ctx, t.CALLBACKSENDING)
+
+	bolt11, err := swaps.CreateSwap(prompt.Address, prompt.AmountSat, quote.SatPerVByte)
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
 
-	if inv, err := decodepay.Decodepay(val.Bolt11Invoice); err != nil {
-		send(ctx, u, t.ERROR,
-			t.T{"Err": fmt.Errorf("error parsing invoice: %w", err)},
-			processingMessageId)
+	inv, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": fmt.Errorf("error parsing invoice: %w", err)})
 		return
-	} else if inv.MSatoshi > (msats + 1000000) {
-		send(ctx, u, t.ERROR,
-			t.T{"Err": "The invoice we got from deezy.io is too expensive, so we're stopping here just in case, let us know if this is wrong. You can also pay the invoice manually."},
-			processingMessageId)
+	} else if inv.MSatoshi > (quote.TotalSat+1000)*1000 {
+		send(ctx, u, t.ERROR, t.T{"Err": fmt.Sprintf("The invoice we got from %s is too expensive, so we're stopping here just in case, let us know if this is wrong. You can also pay the invoice manually: %s", swaps.Name(), bolt11)})
 		return
 	}
 
-	if hash, err := u.payInvoice(ctx, val.Bolt11Invoice, 0); err != nil {
+	processingMessageId := send(ctx, u, bolt11+"\n\n"+translate(ctx, t.PROCESSING))
+
+	swap := OnchainSwap{
+		Provider:    swaps.Name(),
+		Address:     prompt.Address,
+		AmountSat:   prompt.AmountSat,
+		SatPerVByte: quote.SatPerVByte,
+		Bolt11:      bolt11,
+		PaymentHash: inv.PaymentHash,
+	}
+	if id, ok := processingMessageId.(int); ok {
+		swap.MessageId = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	// the record must exist before paying so we don't lose track of the swap,
+	// it stays 'unpaid' until payInvoice has created our transaction
+	swapId, err := u.saveOnchainSwap(swap)
+	if err != nil {
+		log.Error().Err(err).Stringer("user", u).Str("bolt11", bolt11).
+			Msg("failed to save onchain swap")
+		send(ctx, u, t.ERROR, t.T{"Err": "failed to save swap."}, processingMessageId)
+		return
+	}
+
+	// the txid will be sent by onchainSwapRoutine
+	if _, err := u.payInvoice(ctx, bolt11, 0); err != nil {
+		setOnchainSwapStatus(swapId, "failed")
 		send(ctx, u, t.ERROR, t.T{"Err": err.Error()}, processingMessageId)
-	} else {
-		// wait until invoice is paid
-		go func() {
-			<-waitPaymentSuccess(hash)
-			time.Sleep(5 * time.Second)
-			if resp, err := http.Get("https://api.deezy.io/v1/swap/lookup?bolt11_invoice=" + val.Bolt11Invoice); err == nil {
-				var val struct {
-					Txid string `json:"on_chain_txid"`
-					Hex  string `json:"tx_hex"`
-				}
-				if err := json.NewDecoder(resp.Body).Decode(&val); err != nil {
-					send(ctx, u, t.ERROR, t.T{
-						"Err": fmt.Sprintf("deezy.io API returned a broken response from status check"),
-					})
-					return
-				}
-
-				send(ctx, u, processingMessageId, t.ONCHAINSTATUS, t.T{"Txid": val.Txid, "Hex": val.Hex})
-			}
-		}()
+		return
 	}
+	setOnchainSwapStatus(swapId, "pending")
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var pathParamRegex = regexp.MustCompile(`\{(\w+)\}`)
+
+// generateOpenAPIDocument builds the OpenAPI 3 description of /api/v2 from
+// the route table and the Go types of each request and response.
+func generateOpenAPIDocument(routes []apiV2Route) map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+
+	for _, route := range routes {
+		var parameters []interface{}
+		for _, match := range pathParamRegex.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, param := range route.Query {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        param.Name,
+				"in":          "query",
+				"description": param.Description,
+				"schema":      map[string]interface{}{"type": param.Type},
+			})
+		}
+
+		operation := map[string]interface{}{
+			"summary":      route.Summary,
+			"operationId":  operationId(route),
+			"x-permission": route.Permission.Scope(),
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": openAPISchema(reflect.TypeOf(route.Response)),
+						},
+					},
+				},
+				"default": map[string]interface{}{
+					"$ref": "#/components/responses/Error",
+				},
+			},
+		}
+		if route.Method != "GET" {
+			parameters = append(parameters, map[string]interface{}{
+				"name": "Idempotency-Key",
+				"in":   "header",
+				"description": "Retries with the same key get the first response " +
+					"back for 24 hours instead of running again.",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": openAPISchema(reflect.TypeOf(route.Request)),
+					},
+				},
+			}
+		}
+
+		if _, ok := paths[route.Path]; !ok {
+			paths[route.Path] = make(map[string]interface{})
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "lntxbot API",
+			"version": "2",
+			"description": "Use the tokens from /api or an API key from /api key create " +
+				"as a Bearer token. Each operation lists the scope it needs " +
+				"on x-permission.",
+		},
+		"servers":  []interface{}{map[string]interface{}{"url": s.ServiceURL + "/api/v2"}},
+		"security": []interface{}{map[string]interface{}{"token": []string{}}},
+		"paths":    paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"token": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": openAPISchema(reflect.TypeOf(struct {
+								Error APIError `json:"error"`
+							}{})),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func operationId(route apiV2Route) string {
+	id := strings.ToLower(route.Method)
+	for _, part := range strings.Split(route.Path, "/") {
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, "{") {
+			part = "by-" + strings.Trim(part, "{}")
+		}
+		for _, word := range strings.Split(part, "-") {
+			id += strings.Title(word)
+		}
+	}
+	return id
+}
+
+func openAPISchema(typ reflect.Type) map[string]interface{} {
+	if typ == nil {
+		return map[string]interface{}{}
+	}
+
+	if typ == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch typ.Kind() {
+	case reflect.Ptr:
+		schema := openAPISchema(typ.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": openAPISchema(typ.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": openAPISchema(typ.Elem()),
+		}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" || field.PkgPath != "" {
+				continue
+			}
+
+			name := strings.Split(tag, ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = openAPISchema(field.Type)
+			if !strings.Contains(tag, "omitempty") && field.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return map[string]interface{}{}
+	}
+}
@@ -4,13 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/docopt/docopt-go"
-	"github.com/fiatjaf/go-cliche"
 	decodepay "github.com/fiatjaf/ln-decodepay"
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
@@ -25,6 +25,34 @@ func handlePay(ctx context.Context, payer *User, opts docopt.Opts) error {
 
 	bolt11, _ := opts.String("<invoice>")
 
+	req, _ := parsePaymentRequest(bolt11)
+	if req.Bolt11 != "" {
+		// strips lightning: and bitcoin: URIs
+		bolt11 = req.Bolt11
+	}
+
+	// an lnurl or a lightning address. /decode only decodes invoices, and the
+	// amount is only paid right away with /paynow or /pay now, otherwise we ask
+	if req.Bolt11 == "" && (req.LNURL != "" || req.Address != "") {
+		if decode, _ := opts["decode"].(bool); decode {
+			err := errors.New("not an invoice")
+			send(ctx, payer, t.FAILEDDECODE, t.T{"Err": err.Error()})
+			return err
+		}
+
+		var lnurlOpts handleLNURLOpts
+		if _, ok := opts["<satoshis>"].(string); ok && !askConfirmation {
+			msats, err := parseSatoshis(opts)
+			if err != nil {
+				send(ctx, payer, t.ERROR, t.T{"Err": err.Error()})
+				return err
+			}
+			lnurlOpts.payAmountWithoutPrompt = &msats
+		}
+		handleLNURL(ctx, req.String(), lnurlOpts)
+		return nil
+	}
+
 	// decode invoice
 	inv, err := decodepay.Decodepay(bolt11)
 	if err != nil {
@@ -225,6 +253,25 @@ RETURNING from_id, trigger_message
 		"sats": msatoshi / 1000,
 	})
 
+	go func() {
+		publishPaymentEvent(user.Id, EventPaymentSent, map[string]interface{}{
+			"payment_hash": hash,
+			"msatoshi":     msatoshi,
+			"fee_msatoshi": feesPaid,
+			"preimage":     preimage,
+		})
+		publishBalanceChanged(user.Id)
+	}()
+
+	go notifyUserWebhooks(user, WalletEventWebhook{
+		Event:       WebhookPaymentSent,
+		PaymentHash: hash,
+		Msatoshi:    msatoshi,
+		FeeMsatoshi: feesPaid,
+		Preimage:    preimage,
+		Tag:         tag,
+	})
+
 	send(ctx, user, res.TriggerMessage, t.PAIDMESSAGE, t.T{
 		"Sats":      float64(msatoshi) / 1000,
 		"Fee":       feesPaid / 1000,
@@ -252,6 +299,8 @@ RETURNING from_id, trigger_message
 	}
 
 	rds.Set("hash:"+strconv.Itoa(res.UserId)+":"+hash[0:5], hash, time.Hour*24*2)
+	releaseAPIKeySpendingFor(hash)
+	releaseNWCSpendingFor(hash)
 
 	user, err := loadUser(res.UserId)
 	if err != nil {
@@ -271,6 +320,20 @@ RETURNING from_id, trigger_message
 		finalFailures = finalFailures[:7]
 	}
 
+	go func() {
+		publishPaymentEvent(user.Id, EventPaymentFailed, map[string]interface{}{
+			"payment_hash": hash,
+			"failures":     finalFailures,
+		})
+		publishBalanceChanged(user.Id)
+	}()
+
+	go notifyUserWebhooks(user, WalletEventWebhook{
+		Event:       WebhookPaymentFailed,
+		PaymentHash: hash,
+		Failures:    finalFailures,
+	})
+
 	send(ctx, user, res.TriggerMessage,
 		t.PAYMENTFAILED, t.T{
 			"Hash":          hash,
@@ -282,19 +345,8 @@ RETURNING from_id, trigger_message
 func checkOutgoingPayment(ctx context.Context, hash string) {
 	info, err := ln.CheckPayment(hash)
 	if err != nil {
-		if strings.Contains(err.Error(),
-			fmt.Sprintf("couldn't get payment '%s' from database", hash),
-		) {
-			// if it's not on cliche's database means it has failed, right?
-			// make sure we only do this check for recent payments otherwise we could be
-			//   checking for stuff from other node backends
-			info = cliche.CheckPaymentResult{
-				PaymentInfo: cliche.PaymentInfo{Status: "failed"},
-			}
-		} else {
-			log.Error().Err(err).Str("hash", hash).Msg("failed to check-payment")
-			return
-		}
+		log.Error().Err(err).Str("hash", hash).Msg("failed to check-payment")
+		return
 	}
 	if info.IsIncoming {
 		log.Error().Err(err).Str("hash", hash).
@@ -303,7 +355,7 @@ func checkOutgoingPayment(ctx context.Context, hash string) {
 	}
 
 	switch info.Status {
-	case "complete":
+	case PaymentComplete:
 		go paymentHasSucceeded(
 			ctx,
 			info.Msatoshi,
@@ -312,7 +364,7 @@ func checkOutgoingPayment(ctx context.Context, hash string) {
 			"",
 			hash,
 		)
-	case "failed":
+	case PaymentFailed:
 		go paymentHasFailed(ctx, hash, []string{})
 	}
 }
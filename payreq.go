@@ -0,0 +1,215 @@
+package main
+
+import (
+	"math/big"
+	"net/url"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/fiatjaf/go-lnurl"
+)
+
+// PaymentRequest is anything we can pay or act upon that people may send us
+// as text, in a QR code or through the API: bolt11 invoices, bech32 lnurls,
+// LUD-17 lnurlp://, lnurlw://, lnurlc:// and keyauth:// URLs, lightning
+// addresses, lightning: URIs and BIP21 bitcoin: URIs.
+type PaymentRequest struct {
+	Bolt11  string
+	LNURL   string // bech32 or an http(s) URL, LUD-17 schemes are converted
+	Address string // lightning address
+
+	// from BIP21 URIs, these may come together with a bolt11 or an lnurl
+	// taken from the lightning= parameter
+	Onchain    string
+	AmountMsat int64
+	Label      string
+	Message    string
+}
+
+func (req PaymentRequest) Kind() string {
+	switch {
+	case req.Bolt11 != "":
+		return "bolt11"
+	case req.LNURL != "":
+		return "lnurl"
+	case req.Address != "":
+		return "lightning_address"
+	case req.Onchain != "":
+		return "onchain"
+	}
+	return ""
+}
+
+// String is what can be passed along to /pay, /lnurl or lnurl.HandleLNURL.
+func (req PaymentRequest) String() string {
+	switch {
+	case req.Bolt11 != "":
+		return req.Bolt11
+	case req.LNURL != "":
+		return req.LNURL
+	case req.Address != "":
+		return req.Address
+	}
+	return req.Onchain
+}
+
+var lud17Schemes = map[string]bool{
+	"lnurlp":  true,
+	"lnurlw":  true,
+	"lnurlc":  true,
+	"keyauth": true,
+}
+
+// parsePaymentRequest returns the first payment request found in the text.
+// lightning addresses look like any email, so they only count when they are
+// the whole text.
+func parsePaymentRequest(text string) (req PaymentRequest, ok bool) {
+	words := strings.Fields(text)
+	for _, word := range words {
+		if req, ok = parsePaymentRequestWord(word); ok {
+			if req.Kind() == "lightning_address" && len(words) > 1 {
+				continue
+			}
+			return req, true
+		}
+	}
+	return PaymentRequest{}, false
+}
+
+func parsePaymentRequestWord(word string) (req PaymentRequest, ok bool) {
+	word = strings.Trim(word, `"'<>()[]{},;`)
+	word = strings.TrimRight(word, ".!")
+	lower := strings.ToLower(word)
+
+	scheme := ""
+	if i := strings.Index(lower, ":"); i != -1 {
+		scheme = lower[:i]
+	}
+
+	switch {
+	case scheme == "lightning":
+		rest := strings.TrimPrefix(word[len("lightning:"):], "//")
+		if inner, ok := parsePaymentRequestWord(rest); ok && inner.Onchain == "" {
+			return inner, true
+		}
+		// query params after a bolt11 or a bech32 lnurl
+		if i := strings.Index(rest, "?"); i != -1 {
+			if inner, ok := parsePaymentRequestWord(rest[:i]); ok &&
+				inner.Onchain == "" {
+				return inner, true
+			}
+		}
+		return
+	case scheme == "bitcoin":
+		return parseBIP21(word)
+	case lud17Schemes[scheme]:
+		return PaymentRequest{LNURL: lud17ToURL(word)}, true
+	case scheme == "http" || scheme == "https":
+		// LUD-01 fallback scheme, https://service.com/?lightning=lnurl1...
+		if parsed, err := url.Parse(word); err == nil {
+			if inner := parsed.Query().Get("lightning"); inner != "" {
+				return parsePaymentRequestWord(inner)
+			}
+		}
+		return
+	}
+
+	if bolt11, ok := getBolt11(lower); ok && bolt11 == lower {
+		return PaymentRequest{Bolt11: bolt11}, true
+	}
+
+	if strings.HasPrefix(lower, "lnurl1") {
+		if _, err := lnurl.LNURLDecode(lower); err == nil {
+			return PaymentRequest{LNURL: lower}, true
+		}
+		return
+	}
+
+	// some wallets show addresses prefixed with the bitcoin sign
+	address := strings.TrimPrefix(lower, "₿")
+	if name, domain, ok := lnurl.ParseInternetIdentifier(address); ok &&
+		!strings.ContainsAny(address, "/:?") {
+		return PaymentRequest{Address: name + "@" + domain}, true
+	}
+
+	return
+}
+
+// lud17ToURL turns lnurlp://domain/path into https://domain/path, or http for
+// onion services. unlike the bech32 ones these URLs are case-sensitive.
+func lud17ToURL(lud17 string) string {
+	location := strings.SplitN(lud17, ":", 2)[1]
+
+	host := strings.TrimPrefix(location, "//")
+	if i := strings.IndexAny(host, "/?#"); i != -1 {
+		host = host[:i]
+	}
+	if strings.HasSuffix(strings.ToLower(host), ".onion") {
+		return "http:" + location
+	}
+	return "https:" + location
+}
+
+func parseBIP21(uri string) (req PaymentRequest, ok bool) {
+	rest := uri[len("bitcoin:"):]
+	query := ""
+	if i := strings.Index(rest, "?"); i != -1 {
+		rest, query = rest[:i], rest[i+1:]
+	}
+
+	// uppercase URIs are common in QR codes, so keys are case-insensitive
+	qs, _ := url.ParseQuery(query)
+	get := func(key string) string {
+		for k, v := range qs {
+			if strings.ToLower(k) == key && len(v) > 0 {
+				return v[0]
+			}
+		}
+		return ""
+	}
+
+	if lightning := get("lightning"); lightning != "" {
+		if inner, ok := parsePaymentRequestWord(lightning); ok && inner.Onchain == "" {
+			req = inner
+		}
+	}
+
+	if rest != "" && isOnchainAddress(rest) {
+		req.Onchain = rest
+		if lower := strings.ToLower(rest); strings.HasPrefix(lower, "bc1") ||
+			strings.HasPrefix(lower, "tb1") || strings.HasPrefix(lower, "bcrt1") {
+			req.Onchain = lower
+		}
+	}
+
+	if amount := get("amount"); amount != "" {
+		btc, valid := new(big.Rat).SetString(amount)
+		if !valid || btc.Sign() <= 0 {
+			return PaymentRequest{}, false
+		}
+		msat := btc.Mul(btc, big.NewRat(100000000000, 1))
+		if !msat.IsInt() || !msat.Num().IsInt64() {
+			return PaymentRequest{}, false
+		}
+		req.AmountMsat = msat.Num().Int64()
+	}
+
+	req.Label = get("label")
+	req.Message = get("message")
+
+	return req, req.Kind() != ""
+}
+
+func isOnchainAddress(address string) bool {
+	for _, params := range []*chaincfg.Params{
+		&chaincfg.MainNetParams,
+		&chaincfg.TestNet3Params,
+		&chaincfg.RegressionNetParams,
+	} {
+		if _, err := btcutil.DecodeAddress(address, params); err == nil {
+			return true
+		}
+	}
+	return false
+}
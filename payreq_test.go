@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/go-lnurl"
+)
+
+const testBolt11 = "lnbc1u1pwvmypepp5kjydaerr6rawl9zt7t2zzl9q0rf6rkpx7splhjlfnjr869we3gfqdq6gpkxuarcvfhhggr90psk6urvv5cqp2rzjqtqkejjy2c44jrwj08y5ygqtmn8af7vscwnflttzpsgw7tuz9r407zyusgqq44sqqqqqqqqqqqqqqqgqpcxuncdelh5mtthgwmkrum2u5m6n3fcjkw6vdnffzh85hpr4tem3k3u0mq3k5l3hpy32ls2pkqakpkuv5z7yms2jhdestzn8k3hlr437cpajsnqm"
+
+func TestParsePaymentRequest(t *testing.T) {
+	bech32, err := lnurl.LNURLEncode("https://service.com/api?q=3fc3645b439ce8e7")
+	if err != nil {
+		t.Fatalf("failed to encode lnurl: %s", err)
+	}
+	bech32 = strings.ToLower(bech32)
+
+	for _, tc := range []struct {
+		text string
+		ok   bool
+		kind string
+		req  PaymentRequest
+	}{
+		// bolt11
+		{testBolt11, true, "bolt11", PaymentRequest{Bolt11: testBolt11}},
+		{strings.ToUpper(testBolt11), true, "bolt11", PaymentRequest{Bolt11: testBolt11}},
+		{"please pay " + testBolt11 + " thanks", true, "bolt11", PaymentRequest{Bolt11: testBolt11}},
+		{"lightning:" + testBolt11, true, "bolt11", PaymentRequest{Bolt11: testBolt11}},
+		{"LIGHTNING:" + strings.ToUpper(testBolt11), true, "bolt11", PaymentRequest{Bolt11: testBolt11}},
+		{"lightning://" + testBolt11, true, "bolt11", PaymentRequest{Bolt11: testBolt11}},
+		{"lightning:" + testBolt11 + "?amount=100&label=x", true, "bolt11", PaymentRequest{Bolt11: testBolt11}},
+
+		// bech32 lnurl
+		{bech32, true, "lnurl", PaymentRequest{LNURL: bech32}},
+		{strings.ToUpper(bech32), true, "lnurl", PaymentRequest{LNURL: bech32}},
+		{"lightning:" + strings.ToUpper(bech32), true, "lnurl", PaymentRequest{LNURL: bech32}},
+		{"lightning:" + bech32 + "?x=y", true, "lnurl", PaymentRequest{LNURL: bech32}},
+		{"https://service.com/?lightning=" + bech32, true, "lnurl", PaymentRequest{LNURL: bech32}},
+		{"lnurl1notvalid", false, "", PaymentRequest{}},
+
+		// LUD-17
+		{"lnurlp://service.com/pay/Abc?x=1", true, "lnurl", PaymentRequest{LNURL: "https://service.com/pay/Abc?x=1"}},
+		{"lnurlw://service.com/withdraw", true, "lnurl", PaymentRequest{LNURL: "https://service.com/withdraw"}},
+		{"lnurlc://service.com/channel", true, "lnurl", PaymentRequest{LNURL: "https://service.com/channel"}},
+		{"keyauth://service.com/auth?tag=login&k1=ab", true, "lnurl", PaymentRequest{LNURL: "https://service.com/auth?tag=login&k1=ab"}},
+		{"LNURLP://service.com/pay", true, "lnurl", PaymentRequest{LNURL: "https://service.com/pay"}},
+		{"lnurlp://hidden.onion/pay", true, "lnurl", PaymentRequest{LNURL: "http://hidden.onion/pay"}},
+
+		// lightning addresses, only alone
+		{"alice@example.com", true, "lightning_address", PaymentRequest{Address: "alice@example.com"}},
+		{"Alice@Example.com", true, "lightning_address", PaymentRequest{Address: "alice@example.com"}},
+		{"₿alice@example.com", true, "lightning_address", PaymentRequest{Address: "alice@example.com"}},
+		{"lightning:alice@example.com", true, "lightning_address", PaymentRequest{Address: "alice@example.com"}},
+		{"  alice@example.com\n", true, "lightning_address", PaymentRequest{Address: "alice@example.com"}},
+		{"write to alice@example.com about it", false, "", PaymentRequest{}},
+		{"alice@example.com " + testBolt11, true, "bolt11", PaymentRequest{Bolt11: testBolt11}},
+
+		// BIP21
+		{"bitcoin:bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq?amount=0.0001&label=shop", true, "onchain",
+			PaymentRequest{Onchain: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", AmountMsat: 10000000, Label: "shop"}},
+		{"BITCOIN:BC1QAR0SRRR7XFKVY5L643LYDNW9RE59GTZZWF5MDQ?AMOUNT=0.0001&LIGHTNING=" + strings.ToUpper(testBolt11), true, "bolt11",
+			PaymentRequest{Bolt11: testBolt11, Onchain: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", AmountMsat: 10000000}},
+		{"bitcoin:1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2?message=hello%20world", true, "onchain",
+			PaymentRequest{Onchain: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", Message: "hello world"}},
+		{"bitcoin:?lightning=" + testBolt11, true, "bolt11", PaymentRequest{Bolt11: testBolt11}},
+		{"bitcoin:?lightning=" + bech32, true, "lnurl", PaymentRequest{LNURL: bech32}},
+		{"bitcoin:bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq?amount=-1", false, "", PaymentRequest{}},
+		{"bitcoin:bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq?amount=0.000000000001", false, "", PaymentRequest{}},
+		{"bitcoin:bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq?amount=99999999999999999999", false, "", PaymentRequest{}},
+		{"bitcoin:notanaddress", false, "", PaymentRequest{}},
+
+		// nothing
+		{"", false, "", PaymentRequest{}},
+		{"just some words", false, "", PaymentRequest{}},
+		{"https://example.com/page", false, "", PaymentRequest{}},
+	} {
+		req, ok := parsePaymentRequest(tc.text)
+		if ok != tc.ok || req.Kind() != tc.kind || req != tc.req {
+			t.Errorf("%q: got %v %+v", tc.text, ok, req)
+		}
+	}
+}
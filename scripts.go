@@ -1,36 +1,292 @@
 package main
 
-func RunAggregateOldTransactions() {
-	//	twoMonthsAgo := time.Now().AddDate(0, -2, 0)
-	//	yearBegin := time.Date(twoMonthsAgo.Year(), 1, 0, 0, 0, 0, 0, time.FixedZone("UTC", 0))
-	//
-	//	var users []int
-	//	if err := pg.Select(&users, "SELECT id FROM accounts"); err != nil {
-	//		log.Fatal().Err(err).Msg("failed to get users")
-	//	}
-	//
-	//	txn, err := pg.BeginTxx(ctx, &sql.TxOptions{ Isolation: sql.LevelSerializable })()
-	//	if err != nil {
-	//		log.Fatal().Err(err).Msg("failed to start transaction")
-	//	}
-	//
-	//	for _, user := range users {
-	//		log.Printf("user %d", user)
-	//
-	//		var agg struct {
-	//			Balance int64 `db:"amount"`
-	//			Fees    int64 `db:"fees"`
-	//		}
-	//		if err := txn.Get(&agg, `
-	//        SELECT
-	//          coalesce(sum(amount), 0) AS amount,
-	//          coalesce(sum(fees), 0) AS fees
-	//        FROM lightning.account_txn
-	//        WHERE account_id = $1
-	//          AND pending = false
-	//        `, user); err != nil {
-	//			log.Fatal().Err(err).Msg("failed to query user")
-	//		}
-	//
-	//	}
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/redis.v5"
+)
+
+// RunAggregateOldTransactions collapses all settled transactions older than
+// the given number of months into one signed "aggregate" row per account and
+// year: incoming for a positive net amount, outgoing for a negative one.
+// balances are checked to be exactly the same before anything is committed and
+// what was collapsed is recorded on lightning.aggregation. running it again
+// merges into the existing rows.
+func RunAggregateOldTransactions(months int) (collapsed int, err error) {
+	cutoff := time.Now().AddDate(0, -months, 0)
+
+	txn, err := pg.BeginTxx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+
+	// both sides of each transaction, like lightning.account_txn. the net
+	// amount includes previous aggregates, the totals only what is new.
+	if _, err := txn.Exec(`
+CREATE TEMPORARY TABLE collapsing ON COMMIT DROP AS
+  SELECT
+    account_id,
+    extract(year FROM time AT TIME ZONE 'UTC')::int AS year,
+    sum(amount_in - amount_out - fees) AS net,
+    coalesce(sum(amount_in) FILTER (WHERE NOT aggregate), 0) AS amount_in,
+    coalesce(sum(amount_out) FILTER (WHERE NOT aggregate), 0) AS amount_out,
+    coalesce(sum(fees) FILTER (WHERE NOT aggregate), 0) AS fees,
+    count(*) FILTER (WHERE NOT aggregate) AS txn_count,
+    min(time) AS first_time,
+    max(time) AS last_time
+  FROM (
+      SELECT from_id AS account_id, time, label IS NOT DISTINCT FROM 'aggregate' AS aggregate,
+        0 AS amount_in, amount AS amount_out, fees
+      FROM lightning.transaction
+      WHERE from_id IS NOT NULL AND NOT pending AND time < $1
+    UNION ALL
+      SELECT to_id AS account_id, time, label IS NOT DISTINCT FROM 'aggregate' AS aggregate,
+        amount AS amount_in, 0 AS amount_out, 0 AS fees
+      FROM lightning.transaction
+      WHERE to_id IS NOT NULL AND NOT pending AND time < $1
+  ) AS sides
+  GROUP BY account_id, year
+    `, cutoff); err != nil {
+		return 0, fmt.Errorf("failed to compute aggregates: %w", err)
+	}
+
+	balancesBefore, err := affectedBalances(txn)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := txn.Exec(`
+DELETE FROM lightning.transaction
+WHERE NOT pending AND time < $1 AND label IS DISTINCT FROM 'aggregate'
+    `, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old transactions: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	collapsed = int(n)
+
+	// previous aggregates are merged into the new ones
+	if _, err := txn.Exec(`
+DELETE FROM lightning.transaction
+WHERE NOT pending AND time < $1 AND label = 'aggregate'
+    `, cutoff); err != nil {
+		return 0, fmt.Errorf("failed to delete old aggregates: %w", err)
+	}
+
+	// a zero net still gets its row so the account keeps a balance
+	if _, err := txn.Exec(`
+INSERT INTO lightning.transaction
+  (time, to_id, from_id, amount, description, payment_hash, label)
+SELECT last_time,
+  CASE WHEN net >= 0 THEN account_id END,
+  CASE WHEN net < 0 THEN account_id END,
+  abs(net),
+  'history of ' || year || ' (summarized)',
+  md5('aggregate:' || account_id || ':' || year),
+  'aggregate'
+FROM collapsing
+    `); err != nil {
+		return 0, fmt.Errorf("failed to insert aggregates: %w", err)
+	}
+
+	balancesAfter, err := affectedBalances(txn)
+	if err != nil {
+		return 0, err
+	}
+	if len(balancesAfter) != len(balancesBefore) {
+		return 0, fmt.Errorf("balances for %d accounts before, %d after",
+			len(balancesBefore), len(balancesAfter))
+	}
+	for account, before := range balancesBefore {
+		if after := balancesAfter[account]; after != before {
+			return 0, fmt.Errorf("balance of account %d would change from %d to %d",
+				account, before, after)
+		}
+	}
+
+	if _, err := txn.Exec(`
+INSERT INTO lightning.aggregation AS agg
+  (account_id, year, txn_count, amount_in, amount_out, fees, first_time, last_time)
+SELECT account_id, year, txn_count, amount_in, amount_out, fees, first_time, last_time
+FROM collapsing
+ON CONFLICT (account_id, year) DO UPDATE SET
+  txn_count = agg.txn_count + excluded.txn_count,
+  amount_in = agg.amount_in + excluded.amount_in,
+  amount_out = agg.amount_out + excluded.amount_out,
+  fees = agg.fees + excluded.fees,
+  first_time = least(agg.first_time, excluded.first_time),
+  last_time = greatest(agg.last_time, excluded.last_time),
+  aggregated_at = now()
+    `); err != nil {
+		return 0, fmt.Errorf("failed to record aggregation: %w", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		return 0, err
+	}
+	return collapsed, nil
+}
+
+func affectedBalances(txn *sqlx.Tx) (map[int]int64, error) {
+	var rows []struct {
+		AccountId int   `db:"account_id"`
+		Balance   int64 `db:"balance"`
+	}
+	if err := txn.Select(&rows, `
+SELECT account_id, balance::bigint AS balance FROM lightning.balance
+WHERE account_id IN (SELECT account_id FROM collapsing)
+    `); err != nil {
+		return nil, fmt.Errorf("failed to get balances: %w", err)
+	}
+
+	balances := make(map[int]int64, len(rows))
+	for _, row := range rows {
+		balances[row.AccountId] = row.Balance
+	}
+	return balances, nil
+}
+
+// handleAggregateCommand implements --aggregate-transactions [months],
+// which only needs DATABASE_URL.
+func handleAggregateCommand(args []string) {
+	months := 12
+	if len(args) > 0 {
+		var err error
+		if months, err = strconv.Atoi(args[0]); err != nil || months < 1 {
+			log.Fatal().Str("months", args[0]).Msg("invalid number of months")
+		}
+	}
+
+	var err error
+	pg, err = sqlx.Connect("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't connect to postgres")
+	}
+
+	collapsed, err := RunAggregateOldTransactions(months)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to aggregate transactions, nothing was changed")
+	}
+	fmt.Printf("collapsed %d transactions older than %d months\n", collapsed, months)
+}
+
+type BalanceMismatch struct {
+	AccountId  int   `db:"account_id"`
+	Ledger     int64 `db:"ledger"`
+	Recomputed int64 `db:"recomputed"`
+}
+
+// checkAccountBalances compares lightning.account_balance with the balances
+// computed from all transactions by lightning.balance.
+func checkAccountBalances() (mismatches []BalanceMismatch, err error) {
+	err = pg.Select(&mismatches, `
+SELECT
+  b.account_id,
+  coalesce(ab.balance, 0)::bigint AS ledger,
+  b.balance::bigint AS recomputed
+FROM lightning.balance AS b
+LEFT OUTER JOIN lightning.account_balance AS ab ON ab.account_id = b.account_id
+WHERE coalesce(ab.balance, 0) != b.balance
+ORDER BY b.account_id
+    `)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// benchmarkBalances times reading the balances of the accounts with most
+// transactions from the old view and from lightning.account_balance.
+func benchmarkBalances(n int) (view time.Duration, ledger time.Duration, err error) {
+	var accounts []int
+	if err = pg.Select(&accounts, `
+SELECT account_id FROM lightning.account_txn
+GROUP BY account_id
+ORDER BY count(*) DESC
+LIMIT $1
+    `, n); err != nil {
+		return
+	}
+
+	var balance int64
+	start := time.Now()
+	for _, account := range accounts {
+		if err = pg.Get(&balance, `
+SELECT balance::numeric(13) FROM lightning.balance WHERE account_id = $1
+        `, account); err != nil {
+			return
+		}
+	}
+	view = time.Since(start)
+
+	start = time.Now()
+	for _, account := range accounts {
+		balance = getBalance(pg, account)
+	}
+	ledger = time.Since(start)
+
+	return
+}
+
+// handleCheckBalancesCommand implements --check-balances,
+// which only needs DATABASE_URL.
+func handleCheckBalancesCommand() {
+	var err error
+	pg, err = sqlx.Connect("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't connect to postgres")
+	}
+
+	mismatches, err := checkAccountBalances()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to check balances")
+	}
+	for _, m := range mismatches {
+		fmt.Printf("account %d: ledger says %d msat, transactions say %d msat\n",
+			m.AccountId, m.Ledger, m.Recomputed)
+	}
+
+	view, ledger, err := benchmarkBalances(100)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to benchmark balances")
+	}
+	fmt.Printf("reading the 100 biggest balances: %s from transactions, %s from the ledger\n",
+		view, ledger)
+
+	if len(mismatches) > 0 {
+		fmt.Printf("%d accounts with wrong balances\n", len(mismatches))
+		os.Exit(1)
+	}
+	fmt.Println("all balances match")
+}
+
+func handleImportInvoicesCommand() {
+	var err error
+	pg, err = sqlx.Connect("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't connect to postgres")
+	}
+
+	rurl, err := url.Parse(os.Getenv("REDIS_URL"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid REDIS_URL")
+	}
+	pw, _ := rurl.User.Password()
+	rds = redis.NewClient(&redis.Options{Addr: rurl.Host, Password: pw})
+
+	imported, err := importRedisInvoiceData()
+	if err != nil {
+		log.Fatal().Err(err).Int("n", imported).Msg("failed to import invoices")
+	}
+	fmt.Printf("imported %d invoices from redis to postgres\n", imported)
 }
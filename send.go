@@ -59,9 +59,9 @@ func handleSend(ctx context.Context, opts docopt.Opts) {
 		return
 	}
 
-	// maybe this is an onchain address like bc1...?
-	if strings.HasPrefix(username, "bc1") {
-		handleSendToAddress(ctx, username, msats)
+	// maybe this is an onchain address like bc1... or a bitcoin: URI?
+	if req, ok := parsePaymentRequest(username); ok && req.Kind() == "onchain" {
+		handleSendToAddress(ctx, req.Onchain, msats)
 		// end here since the flow will proceed on handleSendToAddress
 		return
 	}
@@ -138,8 +138,24 @@ ensured:
 		"ReceiverHasNoChat": receiver.TelegramChatId == 0,
 	})
 
-	// notify receiver
-	if receiver.hasPrivateChat() && !ctx.Value("spammy").(bool) {
+	notifyInternalSendReceiver(ctx, &g, u, receiver, msats, amtraw, anonymous)
+}
+
+// notifyInternalSendReceiver tells the receiver of an internal send about it,
+// privately if possible, otherwise publicly on the group where it happened, if
+// it happened on a group.
+func notifyInternalSendReceiver(
+	ctx context.Context,
+	g *GroupChat,
+	u *User,
+	receiver *User,
+	msats int64,
+	amtraw string,
+	anonymous bool,
+) {
+	spammy, _ := ctx.Value("spammy").(bool)
+
+	if receiver.hasPrivateChat() && !spammy {
 		// if possible privately
 		if anonymous {
 			send(ctx, receiver, t.RECEIVEDSATSANON, t.T{"Sats": msats / 1000})
@@ -152,9 +168,9 @@ ensured:
 		}
 	}
 
-	if !receiver.hasPrivateChat() || ctx.Value("spammy").(bool) {
+	if g != nil && (!receiver.hasPrivateChat() || spammy) {
 		// publicly if the receiver doesn't have a chat or if the group is spammy
-		send(ctx, g, u, t.SATSGIVENPUBLIC, t.T{
+		send(ctx, *g, u, t.SATSGIVENPUBLIC, t.T{
 			"From":             u.AtName(ctx),
 			"To":               receiver.AtName(ctx),
 			"Sats":             msats / 1000,
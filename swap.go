@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fiatjaf/lntxbot/t"
+)
+
+// SwapProvider is whoever takes a lightning payment from us and sends the
+// same amount (minus their fees) to an onchain address.
+type SwapProvider interface {
+	Name() string
+
+	// Quote returns the fee tiers available for sending this amount, from the
+	// cheapest to the fastest.
+	Quote(amountSat int64) ([]SwapQuote, error)
+
+	// CreateSwap returns the invoice that must be paid for the swap to happen.
+	CreateSwap(address string, amountSat int64, satPerVByte int64) (bolt11 string, err error)
+
+	// LookupSwap returns an empty txid while the transaction isn't broadcast.
+	LookupSwap(bolt11 string) (txid string, txhex string, err error)
+}
+
+type SwapQuote struct {
+	Tier        string `json:"tier"` // economy, normal or priority
+	SatPerVByte int64  `json:"sat_per_vbyte"`
+	FeeSat      int64  `json:"fee_sat"`
+	TotalSat    int64  `json:"total_sat"`
+}
+
+var swaps SwapProvider = deezySwapProvider{}
+
+type OnchainSwap struct {
+	Id          int            `db:"id"`
+	AccountId   int            `db:"account_id"`
+	Provider    string         `db:"provider"`
+	Address     string         `db:"address"`
+	AmountSat   int64          `db:"amount_sat"`
+	SatPerVByte int64          `db:"sat_per_vbyte"`
+	Bolt11      string         `db:"bolt11"`
+	PaymentHash string         `db:"payment_hash"`
+	Status      string         `db:"status"`
+	Txid        sql.NullString `db:"txid"`
+	TxHex       sql.NullString `db:"tx_hex"`
+	MessageId   sql.NullInt64  `db:"message_id"`
+	CreatedAt   time.Time      `db:"created_at"`
+	SentAt      sql.NullTime   `db:"sent_at"`
+}
+
+// swaps whose transaction doesn't show up after this long are given up on.
+const onchainSwapExpiration = time.Hour * 24 * 3
+
+// swaps are saved as 'unpaid' before we pay the provider's invoice, if our
+// payment doesn't show up after this long it never went out.
+const onchainSwapUnpaidGrace = time.Minute * 10
+
+func (u User) saveOnchainSwap(swap OnchainSwap) (id int, err error) {
+	err = pg.Get(&id, `
+INSERT INTO onchain_swap
+  (account_id, provider, address, amount_sat, sat_per_vbyte, bolt11, payment_hash, message_id, status)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 'unpaid')
+RETURNING id
+    `, u.Id, swap.Provider, swap.Address, swap.AmountSat, swap.SatPerVByte,
+		swap.Bolt11, swap.PaymentHash, swap.MessageId)
+	return
+}
+
+func setOnchainSwapStatus(id int, status string) {
+	_, err := pg.Exec(`
+UPDATE onchain_swap SET status = $2 WHERE id = $1
+    `, id, status)
+	if err != nil {
+		log.Error().Err(err).Int("swap", id).Str("status", status).
+			Msg("failed to update onchain swap status")
+	}
+}
+
+// onchainSwapRoutine keeps looking up the swaps we have paid for until their
+// transactions are broadcast, then tells the user the txid.
+func onchainSwapRoutine() {
+	ctx := context.WithValue(context.Background(), "origin", "background")
+
+	for {
+		time.Sleep(time.Minute)
+
+		var pending []OnchainSwap
+		err := pg.Select(&pending, `
+SELECT * FROM onchain_swap WHERE status IN ('unpaid', 'pending') ORDER BY created_at
+        `)
+		if err != nil && err != sql.ErrNoRows {
+			log.Error().Err(err).Msg("failed to get pending onchain swaps")
+			continue
+		}
+
+		for _, swap := range pending {
+			checkOnchainSwap(ctx, swap)
+		}
+	}
+}
+
+func checkOnchainSwap(ctx context.Context, swap OnchainSwap) {
+	logger := log.With().Int("swap", swap.Id).Str("bolt11", swap.Bolt11).Logger()
+
+	u, err := loadUser(swap.AccountId)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to load user on onchain swap check")
+		return
+	}
+	ctx = context.WithValue(ctx, "initiator", u)
+
+	var replyTo interface{}
+	if swap.MessageId.Valid {
+		replyTo = int(swap.MessageId.Int64)
+	}
+
+	// only look at the provider after our payment has gone through
+	txn, err := u.getTransaction(swap.PaymentHash)
+	if err == sql.ErrNoRows {
+		// an unpaid swap may still be on its way to payInvoice
+		if swap.Status == "unpaid" && time.Since(swap.CreatedAt) < onchainSwapUnpaidGrace {
+			return
+		}
+		setOnchainSwapStatus(swap.Id, "failed")
+		send(ctx, u, t.ERROR, t.T{"Err": "The payment to the swap provider has failed."}, replyTo)
+		return
+	} else if err != nil {
+		return
+	}
+	if swap.Status == "unpaid" {
+		setOnchainSwapStatus(swap.Id, "pending")
+	}
+	if txn.IsPending() {
+		return
+	}
+
+	txid, txhex, err := swaps.LookupSwap(swap.Bolt11)
+	if err != nil || txid == "" {
+		if err != nil {
+			logger.Debug().Err(err).Msg("failed to lookup onchain swap")
+		}
+		if time.Since(swap.CreatedAt) > onchainSwapExpiration {
+			logger.Error().Msg("onchain swap transaction never showed up")
+			setOnchainSwapStatus(swap.Id, "expired")
+			send(ctx, u, t.ERROR, t.T{
+				"Err": fmt.Sprintf("%s hasn't sent the transaction yet, please contact them or us with the invoice.", swaps.Name()),
+			}, replyTo)
+		}
+		return
+	}
+
+	_, err = pg.Exec(`
+UPDATE onchain_swap
+SET status = 'sent', txid = $2, tx_hex = $3, sent_at = now()
+WHERE id = $1
+    `, swap.Id, txid, txhex)
+	if err != nil {
+		logger.Error().Err(err).Str("txid", txid).Msg("failed to save onchain swap txid")
+		return
+	}
+
+	send(ctx, u, t.ONCHAINSTATUS, t.T{"Txid": txid, "Hex": txhex}, replyTo)
+}
+
+// swapHTTPClient goes through tor when we have it, so the swap provider
+// doesn't learn our IP.
+var swapHTTPClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			if s.TorProxyURL != nil && s.TorProxyURL.Host != "" {
+				return s.TorProxyURL, nil
+			}
+			return nil, nil
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// powered by deezy.io, fee rates from mempool.space
+
+type deezySwapProvider struct{}
+
+func (deezySwapProvider) Name() string { return "deezy.io" }
+
+func (deezySwapProvider) call(method, path string, body interface{}, response interface{}) error {
+	reqBody := &bytes.Buffer{}
+	if body != nil {
+		json.NewEncoder(reqBody).Encode(body)
+	}
+
+	req, _ := http.NewRequest(method, "https://api.deezy.io/v1"+path, reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := swapHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call deezy.io API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("deezy.io API returned an error (%d): %s", resp.StatusCode, string(b))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return errors.New("deezy.io API returned a broken response")
+	}
+	return nil
+}
+
+func (d deezySwapProvider) Quote(amountSat int64) ([]SwapQuote, error) {
+	var info struct {
+		LiquidityFeePPM      int64 `json:"liquidity_fee_ppm"`
+		OnChainBytesEstimate int64 `json:"on_chain_bytes_estimate"`
+		MaxSwapAmountSats    int64 `json:"max_swap_amount_sats"`
+		MinSwapAmountSats    int64 `json:"min_swap_amount_sats"`
+		Available            bool  `json:"available"`
+	}
+	if err := d.call("GET", "/swap/info", nil, &info); err != nil {
+		return nil, err
+	}
+	if !info.Available {
+		return nil, errors.New("deezy.io is not doing swaps right now.")
+	}
+	if amountSat < info.MinSwapAmountSats {
+		return nil, fmt.Errorf("The minimum amount for onchain sends is %d sat.", info.MinSwapAmountSats)
+	}
+	if amountSat > info.MaxSwapAmountSats {
+		return nil, fmt.Errorf("The maximum amount for onchain sends is %d sat.", info.MaxSwapAmountSats)
+	}
+
+	var fees struct {
+		FastestFee  int64 `json:"fastestFee"`
+		HalfHourFee int64 `json:"halfHourFee"`
+		EconomyFee  int64 `json:"economyFee"`
+	}
+	resp, err := swapHTTPClient.Get("https://mempool.space/api/v1/fees/recommended")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fee estimates: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("mempool.space returned an error (%d)", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&fees); err != nil || fees.FastestFee == 0 {
+		return nil, errors.New("got broken fee estimates from mempool.space")
+	}
+
+	quote := func(tier string, satPerVByte int64) SwapQuote {
+		fee := amountSat*info.LiquidityFeePPM/1000000 +
+			info.OnChainBytesEstimate*satPerVByte
+		return SwapQuote{
+			Tier:        tier,
+			SatPerVByte: satPerVByte,
+			FeeSat:      fee,
+			TotalSat:    amountSat + fee,
+		}
+	}
+
+	return []SwapQuote{
+		quote("economy", fees.EconomyFee),
+		quote("normal", fees.HalfHourFee),
+		quote("priority", fees.FastestFee),
+	}, nil
+}
+
+func (d deezySwapProvider) CreateSwap(address string, amountSat int64, satPerVByte int64) (string, error) {
+	var val struct {
+		Bolt11Invoice string `json:"bolt11_invoice"`
+	}
+	err := d.call("POST", "/swap", struct {
+		AmountSats          int64  `json:"amount_sats"`
+		OnChainAddress      string `json:"on_chain_address"`
+		OnChainSatsPerVByte int64  `json:"on_chain_sats_per_vbyte"`
+	}{amountSat, address, satPerVByte}, &val)
+	if err != nil {
+		return "", err
+	}
+	if val.Bolt11Invoice == "" {
+		return "", errors.New("deezy.io API returned a broken response")
+	}
+	return val.Bolt11Invoice, nil
+}
+
+func (d deezySwapProvider) LookupSwap(bolt11 string) (txid string, txhex string, err error) {
+	var val struct {
+		Txid string `json:"on_chain_txid"`
+		Hex  string `json:"tx_hex"`
+	}
+	err = d.call("GET", "/swap/lookup?bolt11_invoice="+url.QueryEscape(bolt11), nil, &val)
+	return val.Txid, val.Hex, err
+}
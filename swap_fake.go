@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	decodepay "github.com/fiatjaf/ln-decodepay"
+)
+
+// FakeSwapProvider issues invoices from its own fake node and "broadcasts" a
+// transaction as soon as it's asked about it, the txid being derived from the
+// invoice. used together with the fake lightning backend.
+type FakeSwapProvider struct {
+	sync.Mutex
+
+	node  *FakeBackend
+	swaps map[string]fakeSwap
+}
+
+type fakeSwap struct {
+	Address   string
+	AmountSat int64
+	CreatedAt time.Time
+}
+
+func newFakeSwapProvider() *FakeSwapProvider {
+	return &FakeSwapProvider{
+		node:  newFakeBackend(),
+		swaps: make(map[string]fakeSwap),
+	}
+}
+
+func (f *FakeSwapProvider) Name() string { return "fake" }
+
+func (f *FakeSwapProvider) Quote(amountSat int64) ([]SwapQuote, error) {
+	if amountSat < 10000 {
+		return nil, errors.New("The minimum amount for onchain sends is 10000 sat.")
+	}
+
+	var quotes []SwapQuote
+	for i, tier := range []string{"economy", "normal", "priority"} {
+		satPerVByte := int64(1 + i*4)
+		fee := amountSat/1000 + 200*satPerVByte
+		quotes = append(quotes, SwapQuote{
+			Tier:        tier,
+			SatPerVByte: satPerVByte,
+			FeeSat:      fee,
+			TotalSat:    amountSat + fee,
+		})
+	}
+	return quotes, nil
+}
+
+func (f *FakeSwapProvider) CreateSwap(address string, amountSat int64, satPerVByte int64) (string, error) {
+	fee := amountSat/1000 + 200*satPerVByte
+	res, err := f.node.CreateInvoice(CreateInvoiceParams{
+		Msatoshi:    (amountSat + fee) * 1000,
+		Description: "swap to " + address,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	f.Lock()
+	f.swaps[res.Invoice] = fakeSwap{address, amountSat, time.Now()}
+	f.Unlock()
+
+	return res.Invoice, nil
+}
+
+func (f *FakeSwapProvider) LookupSwap(bolt11 string) (txid string, txhex string, err error) {
+	f.Lock()
+	_, ok := f.swaps[bolt11]
+	f.Unlock()
+	if !ok {
+		return "", "", errors.New("unknown swap")
+	}
+
+	inv, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		return "", "", err
+	}
+
+	hash := sha256.Sum256([]byte(inv.PaymentHash))
+	return hex.EncodeToString(hash[:]), "", nil
+}
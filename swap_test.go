@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	decodepay "github.com/fiatjaf/ln-decodepay"
+)
+
+func TestFakeSwapProvider(t *testing.T) {
+	provider := newFakeSwapProvider()
+
+	if _, err := provider.Quote(5000); err == nil {
+		t.Error("quote below the minimum didn't fail")
+	}
+	quotes, err := provider.Quote(20000)
+	if err != nil || len(quotes) != 3 {
+		t.Fatalf("got quotes %v, %v", quotes, err)
+	}
+
+	bolt11, err := provider.CreateSwap("bc1qtest", 20000, quotes[0].SatPerVByte)
+	if err != nil {
+		t.Fatalf("failed to create swap: %s", err)
+	}
+	inv, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		t.Fatalf("swap invoice is invalid: %s", err)
+	}
+	if inv.MSatoshi != quotes[0].TotalSat*1000 {
+		t.Errorf("swap invoice is for %d msat, quoted %d sat", inv.MSatoshi, quotes[0].TotalSat)
+	}
+
+	txid, _, err := provider.LookupSwap(bolt11)
+	expected := sha256.Sum256([]byte(inv.PaymentHash))
+	if err != nil || txid != hex.EncodeToString(expected[:]) {
+		t.Errorf("lookup returned %q, %v", txid, err)
+	}
+	if _, _, err := provider.LookupSwap("lnbc1unknown"); err == nil {
+		t.Error("lookup of an unknown swap didn't fail")
+	}
+}
+
+func loadOnchainSwap(tb testing.TB, id int) (swap OnchainSwap) {
+	if err := pg.Get(&swap, `SELECT * FROM onchain_swap WHERE id = $1`, id); err != nil {
+		tb.Fatalf("failed to load swap %d: %s", id, err)
+	}
+	return swap
+}
+
+func TestOnchainSwapUnpaid(t *testing.T) {
+	setupTestBot(t)
+	provider := swaps.(*FakeSwapProvider)
+
+	u := testUser(t, "onchainswap")
+	fundTestUser(t, u, 50000000)
+	ctx := context.WithValue(context.Background(), "initiator", u)
+
+	bolt11, err := provider.CreateSwap("bc1qtest", 20000, 1)
+	if err != nil {
+		t.Fatalf("failed to create swap: %s", err)
+	}
+	inv, _ := decodepay.Decodepay(bolt11)
+	id, err := u.saveOnchainSwap(OnchainSwap{
+		Provider:    provider.Name(),
+		Address:     "bc1qtest",
+		AmountSat:   20000,
+		SatPerVByte: 1,
+		Bolt11:      bolt11,
+		PaymentHash: inv.PaymentHash,
+	})
+	if err != nil {
+		t.Fatalf("failed to save swap: %s", err)
+	}
+
+	// the routine may look at it before payInvoice has created our transaction
+	checkOnchainSwap(ctx, loadOnchainSwap(t, id))
+	if swap := loadOnchainSwap(t, id); swap.Status != "unpaid" {
+		t.Fatalf("swap checked before being paid is %s", swap.Status)
+	}
+
+	if _, err := u.payInvoice(ctx, bolt11, 0); err != nil {
+		t.Fatalf("failed to pay swap invoice: %s", err)
+	}
+	eventually(t, func() bool {
+		txn, err := u.getTransaction(inv.PaymentHash)
+		return err == nil && !txn.IsPending()
+	})
+
+	checkOnchainSwap(ctx, loadOnchainSwap(t, id))
+	swap := loadOnchainSwap(t, id)
+	expected, _, _ := provider.LookupSwap(bolt11)
+	if swap.Status != "sent" || swap.Txid.String != expected {
+		t.Errorf("paid swap is %s with txid %q", swap.Status, swap.Txid.String)
+	}
+}
+
+func TestOnchainSwapNeverPaid(t *testing.T) {
+	setupTestBot(t)
+	provider := swaps.(*FakeSwapProvider)
+
+	u := testUser(t, "onchainswapfail")
+	ctx := context.WithValue(context.Background(), "initiator", u)
+
+	bolt11, err := provider.CreateSwap("bc1qtest", 20000, 1)
+	if err != nil {
+		t.Fatalf("failed to create swap: %s", err)
+	}
+	inv, _ := decodepay.Decodepay(bolt11)
+	id, err := u.saveOnchainSwap(OnchainSwap{
+		Provider:    provider.Name(),
+		Address:     "bc1qtest",
+		AmountSat:   20000,
+		SatPerVByte: 1,
+		Bolt11:      bolt11,
+		PaymentHash: inv.PaymentHash,
+	})
+	if err != nil {
+		t.Fatalf("failed to save swap: %s", err)
+	}
+
+	// still within the grace period
+	checkOnchainSwap(ctx, loadOnchainSwap(t, id))
+	if swap := loadOnchainSwap(t, id); swap.Status != "unpaid" {
+		t.Fatalf("recent unpaid swap is %s", swap.Status)
+	}
+
+	if _, err := pg.Exec(`
+UPDATE onchain_swap SET created_at = now() - interval '1 hour' WHERE id = $1
+    `, id); err != nil {
+		t.Fatalf("failed to age swap: %s", err)
+	}
+	checkOnchainSwap(ctx, loadOnchainSwap(t, id))
+	if swap := loadOnchainSwap(t, id); swap.Status != "failed" {
+		t.Errorf("stale unpaid swap is %s", swap.Status)
+	}
+}
@@ -30,6 +30,7 @@ var EN = map[Key]string{
 	INLINEGIVEFLIPRESULT: "Give away {{.Sats}} sat to one out of {{.MaxPlayers}} participants",
 	INLINECOINFLIPRESULT: "Lottery with entry fee of {{.Sats}} sat for {{.MaxPlayers}} participants",
 	INLINEHIDDENRESULT:   "{{.HiddenId}} ({{if gt .Message.Crowdfund 1}}crowd:{{.Message.Crowdfund}}{{else if gt .Message.Times 0}}priv:{{.Message.Times}}{{else if .Message.Public}}pub{{else}}priv{{end}}): {{.Message.Content}}",
+	INLINEPAYREQRESULT:   `Share {{if eq .Kind "bolt11"}}invoice{{else if eq .Kind "onchain"}}bitcoin address{{else if eq .Kind "lightning_address"}}lightning address{{else}}lnurl{{end}}{{if .Sats}} for {{.Sats}} sat{{end}}`,
 
 	LNURLUNSUPPORTED: "That kind of lnurl is not supported here.",
 	LNURLERROR:       `<b>{{.Host}}</b> lnurl error: {{.Reason}}`,
@@ -115,6 +116,12 @@ Any funds sent to this address (minus some fees) will be deposited to your @{{.S
 <b>Signature: </b><code>{{.Signature}}</code>
 
 Service powered by https://deezy.io/.`,
+	ONCHAINSENDCONFIRM: `Send {{.Sats}} sat to <code>{{.Address}}</code>?
+
+{{range .Quotes}}<b>{{.Tier}}</b>: {{.SatPerVByte}} sat/vB, {{.FeeSat}} sat in fees, {{.TotalSat}} sat in total.
+{{end}}
+<i>Fees are estimates, the invoice from {{.Provider}} will be checked before paying.</i>`,
+	ONCHAINFEETIER: "{{.Tier}} ({{.TotalSat}} sat)",
 
 	SMSSTATUS: `Here's your activation code: <code>{{.code}}</code>
 
@@ -165,6 +172,8 @@ Just pasting <code>lnbc1u1pwvmypepp5kjydaerr6rawl9zt7t2zzl9q0rf6rkpx7splhjlfnjr8
 
 <code>/paynow lnbc1u1pwvmypepp5kjydaerr6rawl9zt7t2zzl9q0rf6rkpx7splhjlfnjr869we3gfqdq6gpkxuarcvfhhggr90psk6urvv5cqp2rzjqtqkejjy2c44jrwj08y5ygqtmn8af7vscwnflttzpsgw7tuz9r407zyusgqq44sqqqqqqqqqqqqqqqgqpcxuncdelh5mtthgwmkrum2u5m6n3fcjkw6vdnffzh85hpr4tem3k3u0mq3k5l3hpy32ls2pkqakpkuv5z7yms2jhdestzn8k3hlr437cpajsnqm</code> pays the given invoice invoice without asking for confirmation.
 
+<code>/paynow alice@example.com 10usd</code> pays a lightning address right away, any amount accepted by /send works.
+
 /withdraw_lnurl_3000 generates an <b>lnurl and QR code for withdrawing 3000</b> satoshis from a <a href="https://lightning-wallet.com">compatible wallet</a> without asking for confirmation.
     `,
 
@@ -173,6 +182,8 @@ Just pasting <code>lnbc1u1pwvmypepp5kjydaerr6rawl9zt7t2zzl9q0rf6rkpx7splhjlfnjr8
 <code>/tip 100</code>, when sent as a reply to a message in a group where the bot is added, sends 100 satoshis to the author of the message.
 <code>/send 500 @username</code> sends 500 satoshis to Telegram user @username.
 <code>/send anonymously 1000 @someone</code> same as above, but telegram user @someone will see just: "Someone has sent you 1000 satoshis".
+<code>/send 10usd alice@example.com thanks for the coffee</code> pays the equivalent of 10 dollars to a lightning address, with a comment.
+<code>/send 50000 bc1q...</code> sends 50000 satoshis to an onchain address, after you pick how much to pay in network fees. Sending a <code>bitcoin:</code> URI with an amount, or a picture of its QR code, does the same.
     `,
 
 	TRANSACTIONSHELP: `
@@ -247,6 +258,73 @@ For specific documentation on how to setup it with @lntxbot visit <a href="https
 /bluewallet prints a string like "lndhub://&lt;login&gt;:&lt;password&gt;@&lt;url&gt;" which must be copied and pasted on BlueWallet's import screen.
 /bluewallet_refresh erases your previous password and prints a new string. You'll have to reimport the credentials on BlueWallet after this step. Only do it if your previous credentials were compromised.
     `,
+	LOGINSHELP: `Shows the services you've logged into with lnurl-auth. Each service sees a different key, derived from your account and its domain.
+
+/logins lists the services and when you last logged in.
+/logins_export &lt;domain&gt; shows the private key used for a domain, so you can import it on another wallet and keep the same identity there.
+/logins_block &lt;domain&gt; stops logins to a domain that don't come from you explicitly, like from the API or when paying.
+/logins_unblock &lt;domain&gt; undoes that.
+    `,
+	LOGINSLIST: `<b>lnurl-auth logins</b>
+{{range .Logins}}<b>{{.Domain}}</b>{{if .Count}} {{.Count}}x, last <i>{{.LastLogin | timeSmall}}</i>{{end}}{{if .Blocked}} <i>blocked</i>{{end}}
+{{else}}<i>You haven't logged in anywhere yet.</i>
+{{end}}`,
+	LOGINSEXPORT: `<b>{{.Domain}}</b>
+Public key: <code>{{.PublicKey}}</code>
+Private key: <code>{{.PrivateKey}}</code>
+
+Anyone with the private key can log in as you on {{.Domain}}, delete this message once you're done.`,
+
+	LNADDRESSHELP: `Configures what payers see when they pay your lightning address.
+
+/lnaddress shows your lightning address and its settings.
+/lnaddress_min &lt;satoshis&gt; and /lnaddress_max &lt;satoshis&gt; set the amounts payers can send.
+/lnaddress_comment &lt;characters&gt; sets how long comments can be, 0 disables them.
+/lnaddress_description [&lt;text&gt;...] sets the description, without text goes back to the default.
+/lnaddress_image [&lt;url&gt;] sets the image, without a URL goes back to your Telegram picture.
+/lnaddress_payerdata &lt;field&gt; &lt;mode&gt; asks payers for their <code>name</code>, <code>identifier</code>, <code>email</code> or <code>pubkey</code>, with mode <code>off</code>, <code>optional</code> or <code>mandatory</code>.
+/lnaddress_reset goes back to the defaults.
+    `,
+	LNADDRESSSETTINGS: `<b>{{.Address}}</b>
+Amounts: {{msatToSat .MinSendable | printf "%.0f"}} to {{msatToSat .MaxSendable | printf "%.0f"}} sat
+Comments: {{if .CommentAllowed}}up to {{.CommentAllowed}} characters{{else}}disabled{{end}}
+Description: {{if .Description}}<i>{{.Description}}</i>{{else}}default{{end}}
+Image: {{if .HasImage}}custom{{else}}default{{end}}
+Payer data: {{range $field, $mode := .PayerData}}<code>{{$field}}</code> {{$mode}}; {{end}}`,
+
+	NWCHELP: `Connects Nostr apps to your wallet with Nostr Wallet Connect (NIP-47).
+
+/nwc lists your connections.
+/nwc_new &lt;name&gt; [--daily=&lt;satoshis&gt;] creates a connection and shows its connection string, optionally limiting how much it can spend per day.
+/nwc_revoke &lt;name&gt; disconnects an app.
+
+Connected apps can pay invoices, create invoices, check your balance and list your transactions.
+    `,
+	NWCCREATED: `Connection <b>{{.Connection.Name}}</b> created{{if .Connection.DailyBudgetMsat.Valid}}, spending up to {{msatToSat .Connection.DailyBudgetMsat.Int64 | printf "%.0f"}} sat per day{{end}}. Paste the connection string below into your Nostr app.
+
+Anyone with it can spend from your wallet, keep it secret.`,
+	NWCLIST: `<b>Nostr Wallet Connect</b>
+{{range .Connections}}<b>{{.Name}}</b>{{if .DailyBudgetMsat.Valid}} daily {{msatToSat .DailyBudgetMsat.Int64 | printf "%.0f"}} sat{{end}}{{if .LastUsedAt}} last used <i>{{.LastUsedAt | timeSmall}}</i>{{end}}
+{{else}}<i>No connections yet, see /help_nwc.</i>
+{{end}}`,
+
+	WEBHOOKHELP: `Registers URLs that will be called by the bot whenever something happens in your wallet.
+
+/webhook lists your webhooks.
+/webhook_add &lt;url&gt; [&lt;event&gt;...] registers an https URL for the given events, or for all of them: <code>payment-received</code>, <code>payment-sent</code>, <code>payment-failed</code> and <code>tip-received</code>.
+/webhook_remove &lt;id&gt; removes a webhook.
+/webhook_secret shows the secret used to sign the payloads, the signature is an HMAC-SHA256 of the body sent in the <code>X-Lntxbot-Signature</code> header.
+/webhook_log shows the latest delivery attempts.
+    `,
+	WEBHOOKLIST: `<b>Webhooks</b>
+{{range .Webhooks}}<code>{{.Id}}</code> {{.URL}} <i>{{range $i, $e := .Events}}{{if $i}}, {{end}}{{$e}}{{end}}</i>
+{{else}}<i>No webhooks registered yet, see /help_webhook.</i>
+{{end}}`,
+	WEBHOOKADDED: `Webhook <code>{{.Webhook.Id}}</code> will be called at {{.Webhook.URL}} for <i>{{range $i, $e := .Webhook.Events}}{{if $i}}, {{end}}{{$e}}{{end}}</i>.`,
+	WEBHOOKLOG: `<b>Latest webhook deliveries</b>
+{{range .Deliveries}}<code>{{.Id}}</code> {{.Event}} {{.URL}} <b>{{.Status}}</b> ({{.Attempts}} attempts){{if .LastError.Valid}} <i>{{.LastError.String}}</i>{{end}} <i>{{.CreatedAt | timeSmall}}</i>
+{{else}}<i>Nothing delivered yet.</i>
+{{end}}`,
 	APIPASSWORDUPDATEERROR: "Error updating password. Please report: {{.Err}}",
 	APICREDENTIALS: `
 These are tokens for <i>Basic Auth</i>. The API is compatible with lndhub.io with some extra methods.
@@ -260,7 +338,16 @@ API Base URL: <code>{{.ServiceURL}}/</code>
 /api_url will show a QR code for the API Base URL.
 
 Keep these tokens secret. If they leak for some reason call /api_refresh to replace all.
+
+You can also have many named keys, each with its own scope and limits, that can be revoked individually: /api_keys lists them, <code>/api key create &lt;name&gt; [--scope=full|invoice|readonly] [--max-payment=&lt;satoshis&gt;] [--daily=&lt;satoshis&gt;] [--destinations=&lt;node ids or usernames separated by commas&gt;]</code> creates one and <code>/api key revoke &lt;name&gt;</code> revokes it.
     `,
+	APIKEYCREATED: `API key <b>{{.Key.Name}}</b> created with <i>{{.Key.Scope}}</i> access{{if .Key.MaxPaymentMsat.Valid}}, up to {{msatToSat .Key.MaxPaymentMsat.Int64 | printf "%.0f"}} sat per payment{{end}}{{if .Key.DailyBudgetMsat.Valid}}, up to {{msatToSat .Key.DailyBudgetMsat.Int64 | printf "%.0f"}} sat per day{{end}}{{if .Key.AllowedDestinations}}, only paying to {{range $i, $d := .Key.AllowedDestinations}}{{if $i}}, {{end}}<code>{{$d}}</code>{{end}}{{end}}.
+
+This is the only time the token will be shown, keep it secret.`,
+	APIKEYLIST: `<b>API keys</b>
+{{range .Keys}}<b>{{.Name}}</b> <i>{{.Scope}}</i>{{if .MaxPaymentMsat.Valid}} max {{msatToSat .MaxPaymentMsat.Int64 | printf "%.0f"}} sat{{end}}{{if .DailyBudgetMsat.Valid}} daily {{msatToSat .DailyBudgetMsat.Int64 | printf "%.0f"}} sat{{end}}{{if .LastUsedAt}} last used <i>{{.LastUsedAt | timeSmall}}</i>{{end}}
+{{else}}<i>No API keys created yet.</i>
+{{end}}`,
 
 	HIDEHELP: `Hides a message so it can be unlocked later with a payment.
 <code>/hide 500 'teaser showed on prompt'</code>, send this in reply to any message, with video, audio, images or text, and it will be hidden behind a 500 satoshis paywall.
@@ -454,6 +541,7 @@ Good luck! 🍽️
 <i>No transactions made yet.</i>
 {{end}}
     `,
+	TXLISTSUMMARIZED: `<i>Older history summarized: {{.Count}} transactions until {{.Until | timeSmall}}.</i>`,
 	TXLOG: `<b>Routes tried</b>{{if .PaymentHash}} for <code>{{.PaymentHash}}</code>{{end}}:
 {{range $t, $try := .Tries}}{{if $try.Success}}✅{{else}}❌{{end}} {{range $h, $hop := $try.Route}}➠{{.Channel | channelLink}}{{end}}{{with $try.Error}}{{if $try.Route}}
 {{else}} {{end}}<i>{{. | makeLinks}}</i>
@@ -35,6 +35,7 @@ const (
 	INLINEGIVEFLIPRESULT Key = "InlineGiveflipResult"
 	INLINECOINFLIPRESULT Key = "InlineCoinflipResult"
 	INLINEHIDDENRESULT   Key = "InlineHiddenResult"
+	INLINEPAYREQRESULT   Key = "InlinePayReqResult"
 
 	LNURLUNSUPPORTED          Key = "LnurlUnsupported"
 	LNURLERROR                Key = "LnurlError"
@@ -65,8 +66,10 @@ const (
 	PAYMENTRECEIVED      Key = "PaymentReceived"
 	FAILEDTOSAVERECEIVED Key = "FailedToSaveReceived"
 
-	ONCHAINSTATUS  Key = "OnchainStatus"
-	ONCHAINDEPOSIT Key = "OnchainDeposit"
+	ONCHAINSTATUS      Key = "OnchainStatus"
+	ONCHAINDEPOSIT     Key = "OnchainDeposit"
+	ONCHAINSENDCONFIRM Key = "OnchainSendConfirm"
+	ONCHAINFEETIER     Key = "OnchainFeeTier"
 
 	SMSSTATUS  Key = "SmsStatus"
 	SMSRECEIVE Key = "SmsReceive"
@@ -130,6 +133,24 @@ const (
 	BLUEWALLETHELP         Key = "bluewalletHelp"
 	APIPASSWORDUPDATEERROR Key = "APIPasswordUpdateError"
 	APICREDENTIALS         Key = "APICredentials"
+	APIKEYCREATED          Key = "APIKeyCreated"
+	APIKEYLIST             Key = "APIKeyList"
+
+	LOGINSHELP   Key = "loginsHelp"
+	LOGINSLIST   Key = "LoginsList"
+	LOGINSEXPORT Key = "LoginsExport"
+
+	LNADDRESSHELP     Key = "lnaddressHelp"
+	LNADDRESSSETTINGS Key = "LNAddressSettings"
+
+	NWCHELP    Key = "nwcHelp"
+	NWCCREATED Key = "NWCCreated"
+	NWCLIST    Key = "NWCList"
+
+	WEBHOOKHELP  Key = "webhookHelp"
+	WEBHOOKLIST  Key = "WebhookList"
+	WEBHOOKADDED Key = "WebhookAdded"
+	WEBHOOKLOG   Key = "WebhookLog"
 
 	HIDEHELP             Key = "hideHelp"
 	REVEALHELP           Key = "revealHelp"
@@ -180,8 +201,9 @@ const (
 	RETRACTQUESTION   Key = "RetractQuestion"
 	RECHECKPENDING    Key = "RecheckPending"
 
-	TXNOTFOUND Key = "TxNotFound"
-	TXINFO     Key = "TxInfo"
-	TXLIST     Key = "TxList"
-	TXLOG      Key = "TxLog"
+	TXNOTFOUND       Key = "TxNotFound"
+	TXINFO           Key = "TxInfo"
+	TXLIST           Key = "TxList"
+	TXLISTSUMMARIZED Key = "TxListSummarized"
+	TXLOG            Key = "TxLog"
 )
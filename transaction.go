@@ -287,13 +287,36 @@ func displayTransactionList(ctx context.Context, page int, tag string, filter In
 		)
 	}
 
-	send(ctx, EDIT, &keyboard, t.TXLIST, t.T{
+	text := translateTemplate(ctx, t.TXLIST, t.T{
 		"Offset":       offset,
 		"Limit":        limit,
 		"From":         offset + 1,
 		"To":           offset + limit,
 		"Transactions": txns,
 	})
+
+	// at the end of the history tell if older transactions were aggregated
+	if len(txns) < limit && tag == "" && filter == Both {
+		var summary struct {
+			Count int          `db:"count"`
+			Until sql.NullTime `db:"until"`
+		}
+		err := pg.Get(&summary, `
+SELECT coalesce(sum(txn_count), 0) AS count, max(last_time) AS until
+FROM lightning.aggregation
+WHERE account_id = $1
+        `, u.Id)
+		if err != nil {
+			log.Warn().Err(err).Stringer("user", u).Msg("failed to get aggregation summary")
+		} else if summary.Count > 0 {
+			text += "\n" + translateTemplate(ctx, t.TXLISTSUMMARIZED, t.T{
+				"Count": summary.Count,
+				"Until": summary.Until.Time,
+			})
+		}
+	}
+
+	send(ctx, EDIT, &keyboard, text)
 }
 
 func checkAllOutgoingPayments(ctx context.Context) {
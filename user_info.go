@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/docopt/docopt-go"
@@ -74,7 +75,7 @@ SELECT
     SELECT coalesce(sum(fees), 0)::float/1000 FROM lightning.transaction AS t
     WHERE b.account_id = t.from_id
   ) AS fees
-FROM lightning.balance AS b
+FROM lightning.account_balance AS b
 WHERE b.account_id = $1
 GROUP BY b.account_id, b.balance
     `, u.Id)
@@ -166,6 +167,69 @@ SELECT * FROM (
 	return
 }
 
+type TransactionFilter struct {
+	Limit     int
+	Offset    int
+	Direction InOut
+	Status    string // RECEIVED, SENT or PENDING
+	Tag       string
+	Since     *time.Time
+	Until     *time.Time
+}
+
+// listTransactionsFiltered is like listTransactions, but newest first, with
+// amounts in msatoshis and the descriptions untouched, for the APIs.
+func (u User) listTransactionsFiltered(f TransactionFilter) (txns []APITransaction, err error) {
+	args := []interface{}{u.Id}
+	filter := ""
+	addFilter := func(clause string, value interface{}) {
+		args = append(args, value)
+		filter += fmt.Sprintf(" AND "+clause, len(args))
+	}
+
+	switch f.Direction {
+	case In:
+		filter += " AND amount > 0"
+	case Out:
+		filter += " AND amount < 0"
+	}
+	if f.Status != "" {
+		addFilter("status = $%d", f.Status)
+	}
+	if f.Tag != "" {
+		addFilter("tag = $%d", f.Tag)
+	}
+	if f.Since != nil {
+		addFilter("time >= $%d", *f.Since)
+	}
+	if f.Until != nil {
+		addFilter("time < $%d", *f.Until)
+	}
+
+	args = append(args, f.Limit, f.Offset)
+	txns = make([]APITransaction, 0, f.Limit)
+	err = pg.Select(&txns, `
+SELECT
+  time,
+  status,
+  amount::bigint AS amount,
+  fees::bigint AS fees,
+  payment_hash,
+  preimage,
+  coalesce(description, '') AS description,
+  tag,
+  telegram_peer,
+  anonymous,
+  payee_node
+FROM lightning.account_txn
+WHERE account_id = $1`+filter+`
+ORDER BY time DESC, payment_hash
+LIMIT $`+strconv.Itoa(len(args)-1)+`
+OFFSET $`+strconv.Itoa(len(args))+`
+    `, args...)
+	return
+}
+
 func handleBalance(ctx context.Context, opts docopt.Opts) {
 	u := ctx.Value("initiator").(*User)
 
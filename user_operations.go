@@ -15,7 +15,6 @@ import (
 	"time"
 
 	"github.com/btcsuite/btcd/btcec"
-	"github.com/fiatjaf/go-cliche"
 	decodepay "github.com/fiatjaf/ln-decodepay"
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
@@ -110,14 +109,14 @@ func (u User) makeInvoice(
 	// hide the user id inside the preimage (first 4 bytes)
 	binary.BigEndian.PutUint32(preimage, uint32(u.Id))
 
-	// TODO: "expireIn":        int((*args.Expiry).Seconds()),
-
-	inv, err := ln.CreateInvoice(cliche.CreateInvoiceParams{
-		Msatoshi:        msatoshi,
-		Preimage:        hex.EncodeToString(preimage),
-		Description:     args.Description,
-		DescriptionHash: args.DescriptionHash,
-		Label:           fmt.Sprintf("lntxbotuser=%d", u.Id),
+	inv, err := ln.CreateInvoice(CreateInvoiceParams{
+		Msatoshi:          msatoshi,
+		Preimage:          hex.EncodeToString(preimage),
+		Description:       args.Description,
+		DescriptionHash:   args.DescriptionHash,
+		HashedDescription: args.HashedDescription,
+		Label:             fmt.Sprintf("lntxbotuser=%d", u.Id),
+		Expiry:            *args.Expiry,
 	})
 	if err != nil {
 		return "", "", fmt.Errorf("failed to create invoice: %w", err)
@@ -131,23 +130,16 @@ func (u User) makeInvoice(
 		}
 	}
 
-	saveInvoiceData(inv.PaymentHash, InvoiceData{
+	err = saveInvoiceData(inv.PaymentHash, InvoiceData{
 		UserId:    u.Id,
 		MessageId: messageId,
 		Preimage:  hex.EncodeToString(preimage),
+		Bolt11:    inv.Invoice,
 
 		MakeInvoiceArgs: args,
 	})
-
-	if args.BlueWallet {
-		encodedinv, _ := json.Marshal(map[string]interface{}{
-			"hash":   inv.PaymentHash,
-			"bolt11": inv.Invoice,
-			"desc":   args.Description,
-			"amount": msatoshi / 1000,
-			"expiry": int((*args.Expiry)),
-		})
-		rds.Set("justcreatedbluewalletinvoice:"+strconv.Itoa(u.Id), string(encodedinv), time.Minute*10)
+	if err != nil {
+		return "", "", ErrDatabase
 	}
 
 	return inv.Invoice, inv.PaymentHash, nil
@@ -181,8 +173,28 @@ func (u User) payInvoice(
 		}
 	}
 
+	markPaymentStarted(ctx)
+
 	// check first if it is internal
-	if data, err := loadInvoiceData(inv.PaymentHash); err == nil {
+	if data, errData := loadInvoiceData(inv.PaymentHash); errData == nil {
+		destinations := []string{inv.Payee}
+		if target, err := loadUser(data.UserId); err == nil {
+			destinations = append(destinations, target.Username)
+		}
+		if err := checkAPIKeySpending(ctx, amount, destinations...); err != nil {
+			return hash, err
+		}
+		defer func() {
+			if err != nil {
+				releaseAPIKeySpending(ctx, amount)
+			}
+		}()
+
+		// invoice data outlives the invoice, so check this here
+		if time.Unix(int64(inv.CreatedAt+inv.Expiry), 0).Before(time.Now()) {
+			return hash, errors.New("Invoice has expired.")
+		}
+
 		// it's an internal invoice. mark as paid internally.
 		err = u.addInternalPendingInvoice(
 			ctx,
@@ -204,15 +216,21 @@ func (u User) payInvoice(
 					data.Msatoshi)
 		}
 
-		go paymentReceived(ctx, hash, data.Msatoshi)
+		go paymentReceived(ctx, hash, data.Msatoshi, time.Now())
 		go paymentHasSucceeded(ctx, amount, 0, data.Preimage, data.Tag, hash)
 
 		return hash, nil
 	} else {
 		// it's an invoice from elsewhere, continue and
 		// actually send the lightning payment
+		if err := checkAPIKeySpending(ctx, amount, inv.Payee); err != nil {
+			return hash, err
+		}
+		trackAPIKeySpending(ctx, hash, amount)
+
 		err = u.actuallySendExternalPayment(ctx, bolt11, inv, amount)
 		if err != nil {
+			releaseAPIKeySpendingFor(hash)
 			return hash, err
 		}
 
@@ -275,10 +293,7 @@ VALUES ($1, $2, $3, $4, $5, true, $6, $7)
 
 	// perform payment
 	go func() {
-		_, err := ln.PayInvoice(cliche.PayInvoiceParams{
-			Invoice:  bolt11,
-			Msatoshi: msatoshi,
-		})
+		err := ln.PayInvoice(bolt11, msatoshi)
 		if err != nil {
 			send(ctx, t.ERROR, t.T{"Err": err.Error()})
 		}
@@ -343,7 +358,7 @@ func (u User) sendInternally(
 	desc string,
 	hash string,
 	tag string,
-) error {
+) (err error) {
 	if target.Id == u.Id {
 		return errors.New("Can't pay yourself.")
 	}
@@ -353,6 +368,18 @@ func (u User) sendInternally(
 		return ErrInvalidAmount
 	}
 
+	markPaymentStarted(ctx)
+
+	if err := checkAPIKeySpending(ctx, msats,
+		target.Username, strconv.Itoa(target.Id)); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			releaseAPIKeySpending(ctx, msats)
+		}
+	}()
+
 	var (
 		descn = sql.NullString{String: desc, Valid: desc != ""}
 		tagn  = sql.NullString{String: tag, Valid: tag != ""}
@@ -373,7 +400,7 @@ func (u User) sendInternally(
 		}
 	}
 
-	_, err = txn.Exec(`
+	err = txn.Get(&hash, `
 INSERT INTO lightning.transaction (
   from_id,
   to_id,
@@ -399,6 +426,7 @@ VALUES (
   END,
   $9
 )
+RETURNING payment_hash
     `, u.Id, target.Id, anonymous, msats, fees, descn, tagn, hashn, tgMessageId)
 	if err != nil {
 		return ErrDatabase
@@ -414,6 +442,29 @@ VALUES (
 		return ErrDatabase
 	}
 
+	from := ""
+	if !anonymous {
+		from = u.Username
+	}
+	go func() {
+		publishPaymentEvent(target.Id, EventInternalReceived, map[string]interface{}{
+			"payment_hash": hash,
+			"msatoshi":     msats,
+			"description":  desc,
+			"from":         from,
+		})
+		publishBalanceChanged(target.Id)
+		publishBalanceChanged(u.Id)
+	}()
+	go notifyUserWebhooks(target, WalletEventWebhook{
+		Event:       WebhookTipReceived,
+		PaymentHash: hash,
+		Msatoshi:    msats,
+		Description: desc,
+		Tag:         tag,
+		From:        from,
+	})
+
 	return nil
 }
 
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/go-lnurl"
+	"github.com/fiatjaf/lntxbot/t"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+)
+
+// how long to wait before each retry, after that we give up
+var webhookBackoff = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	12 * time.Hour,
+}
+
+// publicDialer only connects to public addresses, checked on the address it
+// actually connects to so DNS can't point it back at us.
+var publicDialer = &net.Dialer{
+	Timeout: 5 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+			return fmt.Errorf("%s is not a public address", host)
+		}
+		return nil
+	},
+}
+
+// webhookClient only talks to public addresses and doesn't follow redirects,
+// which count as failed deliveries.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         publicDialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var nonPublicNetworks = func() (networks []*net.IPNet) {
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+		"198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return
+}()
+
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+type WebhookDelivery struct {
+	Id             int            `db:"id" json:"id"`
+	AccountId      int            `db:"account_id" json:"-"`
+	URL            string         `db:"url" json:"url"`
+	Event          string         `db:"event" json:"event"`
+	Payload        types.JSONText `db:"payload" json:"payload"`
+	Status         string         `db:"status" json:"status"`
+	Attempts       int            `db:"attempts" json:"attempts"`
+	ResponseStatus sql.NullInt64  `db:"response_status" json:"-"`
+	LastError      sql.NullString `db:"last_error" json:"-"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	NextAttemptAt  time.Time      `db:"next_attempt_at" json:"-"`
+	DeliveredAt    *time.Time     `db:"delivered_at" json:"delivered_at"`
+}
+
+type InvoicePaidWebhook struct {
+	Event       string                 `json:"event"`
+	PaymentHash string                 `json:"payment_hash"`
+	Msatoshi    int64                  `json:"msatoshi"`
+	Description string                 `json:"description"`
+	Comment     string                 `json:"comment,omitempty"`
+	PayerData   *lnurl.PayerDataValues `json:"payerdata,omitempty"`
+}
+
+// UserWebhookSettings is stored on the user appdata.
+type UserWebhookSettings struct {
+	InvoiceWebhook string `json:"invoice"` // called for all invoices that don't specify one
+}
+
+// webhookSecret is the per-user key webhook payloads are signed with.
+func (u User) webhookSecret() []byte {
+	seedhash := sha256.Sum256(
+		[]byte(fmt.Sprintf("webhooksecret:%d:%s", u.Id, s.TelegramBotToken)))
+	return seedhash[:]
+}
+
+func signWebhookPayload(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isValidWebhookURL(webhook string) bool {
+	u, err := url.Parse(webhook)
+	return err == nil && u.Scheme == "https" && u.Hostname() != ""
+}
+
+// dispatchWebhook records a webhook to be delivered and tries it right away.
+// failures are retried later by webhookRetryRoutine.
+func dispatchWebhook(user *User, webhook string, event string, payload interface{}) {
+	if !isValidWebhookURL(webhook) {
+		log.Debug().Str("url", webhook).Stringer("user", user).
+			Msg("not sending webhook to invalid url")
+		return
+	}
+
+	j, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Interface("payload", payload).Msg("failed to encode webhook")
+		return
+	}
+
+	var delivery WebhookDelivery
+	err = pg.Get(&delivery, `
+INSERT INTO lightning.webhook_delivery (account_id, url, event, payload, next_attempt_at)
+VALUES ($1, $2, $3, $4, now() + $5::interval)
+RETURNING *
+    `, user.Id, webhook, event, string(j), fmt.Sprintf("%d seconds", int(webhookBackoff[0].Seconds())))
+	if err != nil {
+		log.Error().Err(err).Stringer("user", user).Str("url", webhook).
+			Msg("failed to save webhook delivery")
+		return
+	}
+
+	go attemptWebhookDelivery(user, delivery)
+}
+
+func attemptWebhookDelivery(user *User, delivery WebhookDelivery) {
+	delivery.Attempts++
+
+	req, _ := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Lntxbot-Event", delivery.Event)
+	req.Header.Set("X-Lntxbot-Delivery", fmt.Sprintf("%d", delivery.Id))
+	req.Header.Set("X-Lntxbot-Signature",
+		"sha256="+signWebhookPayload(user.webhookSecret(), delivery.Payload))
+
+	var responseStatus sql.NullInt64
+	var lastError sql.NullString
+	resp, err := webhookClient.Do(req)
+	if err == nil {
+		responseStatus = sql.NullInt64{Int64: int64(resp.StatusCode), Valid: true}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("got status %d", resp.StatusCode)
+		}
+	}
+
+	status := "delivered"
+	nextAttempt := time.Now()
+	if err != nil {
+		lastError = sql.NullString{String: err.Error(), Valid: true}
+		if delivery.Attempts > len(webhookBackoff) {
+			status = "failed"
+		} else {
+			status = "pending"
+			nextAttempt = nextAttempt.Add(webhookBackoff[delivery.Attempts-1])
+		}
+		log.Debug().Err(err).Int("id", delivery.Id).Str("url", delivery.URL).
+			Int("attempts", delivery.Attempts).Msg("webhook delivery failed")
+	}
+
+	_, err = pg.Exec(`
+UPDATE lightning.webhook_delivery
+SET attempts = $2, status = $3, response_status = $4, last_error = $5,
+    next_attempt_at = $6,
+    delivered_at = CASE WHEN $3 = 'delivered' THEN now() ELSE NULL END
+WHERE id = $1
+    `, delivery.Id, delivery.Attempts, status, responseStatus, lastError, nextAttempt)
+	if err != nil {
+		log.Error().Err(err).Int("id", delivery.Id).Msg("failed to update webhook delivery")
+	}
+}
+
+func webhookRetryRoutine() {
+	for {
+		time.Sleep(30 * time.Second)
+
+		// claim the deliveries that are due so nobody else retries them meanwhile
+		var deliveries []WebhookDelivery
+		err := pg.Select(&deliveries, `
+UPDATE lightning.webhook_delivery
+SET next_attempt_at = now() + interval '5 minutes'
+WHERE id IN (
+  SELECT id FROM lightning.webhook_delivery
+  WHERE status = 'pending' AND next_attempt_at <= now()
+  ORDER BY next_attempt_at
+  LIMIT 50
+)
+RETURNING *
+        `)
+		if err != nil && err != sql.ErrNoRows {
+			log.Error().Err(err).Msg("failed to get webhook deliveries to retry")
+			continue
+		}
+
+		for _, delivery := range deliveries {
+			user, err := loadUser(delivery.AccountId)
+			if err != nil {
+				continue
+			}
+			go attemptWebhookDelivery(user, delivery)
+		}
+	}
+}
+
+// notifyInvoiceWebhooks calls the webhook given when the invoice was made
+// and the user's default invoice webhook.
+func notifyInvoiceWebhooks(user *User, hash string, amount int64, data InvoiceData) {
+	payload := InvoicePaidWebhook{
+		Event:       "invoice-paid",
+		PaymentHash: hash,
+		Msatoshi:    amount,
+		Description: data.Description,
+		Comment:     data.Extra.Comment,
+		PayerData:   data.Extra.PayerData,
+	}
+
+	if data.Extra.Webhook != "" {
+		dispatchWebhook(user, data.Extra.Webhook, payload.Event, payload)
+	}
+
+	var settings UserWebhookSettings
+	if err := user.getAppData("webhook", &settings); err != nil {
+		log.Warn().Err(err).Stringer("user", user).Msg("failed to get webhook settings")
+		return
+	}
+	if settings.InvoiceWebhook != "" && settings.InvoiceWebhook != data.Extra.Webhook {
+		dispatchWebhook(user, settings.InvoiceWebhook, payload.Event, payload)
+	}
+}
+
+const (
+	WebhookPaymentReceived = "payment-received"
+	WebhookPaymentSent     = "payment-sent"
+	WebhookPaymentFailed   = "payment-failed"
+	WebhookTipReceived     = "tip-received"
+)
+
+var webhookEvents = []string{
+	WebhookPaymentReceived,
+	WebhookPaymentSent,
+	WebhookPaymentFailed,
+	WebhookTipReceived,
+}
+
+type UserWebhook struct {
+	Id        int            `db:"id" json:"id"`
+	URL       string         `db:"url" json:"url"`
+	Events    pq.StringArray `db:"events" json:"events"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+}
+
+type WalletEventWebhook struct {
+	Event       string   `json:"event"`
+	PaymentHash string   `json:"payment_hash"`
+	Msatoshi    int64    `json:"msatoshi"`
+	FeeMsatoshi int64    `json:"fee_msatoshi,omitempty"`
+	Preimage    string   `json:"preimage,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tag         string   `json:"tag,omitempty"`
+	From        string   `json:"from,omitempty"`
+	Failures    []string `json:"failures,omitempty"`
+}
+
+func (u User) addWebhook(webhook string, events []string) (hook UserWebhook, err error) {
+	if !isValidWebhookURL(webhook) {
+		return hook, errors.New("Invalid webhook URL, it must be https.")
+	}
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+	for _, event := range events {
+		if !isWebhookEvent(event) {
+			return hook, fmt.Errorf("Unknown event '%s', must be one of %s.",
+				event, strings.Join(webhookEvents, ", "))
+		}
+	}
+
+	err = pg.Get(&hook, `
+INSERT INTO lightning.webhook (account_id, url, events)
+VALUES ($1, $2, $3)
+ON CONFLICT (account_id, url) DO UPDATE SET events = $3
+RETURNING id, url, events, created_at
+    `, u.Id, webhook, pq.StringArray(events))
+	return
+}
+
+func (u User) removeWebhook(id int) error {
+	res, err := pg.Exec(`
+DELETE FROM lightning.webhook WHERE account_id = $1 AND id = $2
+    `, u.Id, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (u User) listWebhooks() (hooks []UserWebhook, err error) {
+	err = pg.Select(&hooks, `
+SELECT id, url, events, created_at FROM lightning.webhook
+WHERE account_id = $1
+ORDER BY id
+    `, u.Id)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (u User) listWebhookDeliveries(limit int) (deliveries []WebhookDelivery, err error) {
+	err = pg.Select(&deliveries, `
+SELECT * FROM lightning.webhook_delivery
+WHERE account_id = $1
+ORDER BY id DESC
+LIMIT $2
+    `, u.Id, limit)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyUserWebhooks sends the event to all webhooks the user registered for it.
+func notifyUserWebhooks(user *User, payload WalletEventWebhook) {
+	var urls []string
+	err := pg.Select(&urls, `
+SELECT url FROM lightning.webhook
+WHERE account_id = $1 AND $2 = ANY(events)
+    `, user.Id, payload.Event)
+	if err != nil && err != sql.ErrNoRows {
+		log.Warn().Err(err).Stringer("user", user).Msg("failed to get user webhooks")
+		return
+	}
+
+	for _, webhook := range urls {
+		dispatchWebhook(user, webhook, payload.Event, payload)
+	}
+}
+
+func handleWebhook(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+	go u.track("webhook", nil)
+
+	switch {
+	case opts["add"].(bool):
+		webhook, _ := opts.String("<url>")
+		events, _ := opts["<event>"].([]string)
+		hook, err := u.addWebhook(webhook, events)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, u, t.WEBHOOKADDED, t.T{"Webhook": hook})
+	case opts["remove"].(bool):
+		id, err := opts.Int("<id>")
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": "invalid webhook id."})
+			return
+		}
+		if err := u.removeWebhook(id); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": "webhook not found."})
+			return
+		}
+		send(ctx, u, t.COMPLETED)
+	case opts["secret"].(bool):
+		send(ctx, u, "<code>"+hex.EncodeToString(u.webhookSecret())+"</code>")
+	case opts["log"].(bool):
+		deliveries, err := u.listWebhookDeliveries(15)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, u, t.WEBHOOKLOG, t.T{"Deliveries": deliveries})
+	default:
+		hooks, err := u.listWebhooks()
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, u, t.WEBHOOKLIST, t.T{"Webhooks": hooks})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsValidWebhookURL(t *testing.T) {
+	for url, valid := range map[string]bool{
+		"https://example.com/hook":      true,
+		"https://example.com:8443/hook": true,
+		"http://example.com/hook":       false,
+		"ftp://example.com/hook":        false,
+		"https:///hook":                 false,
+		"example.com/hook":              false,
+		"":                              false,
+	} {
+		if isValidWebhookURL(url) != valid {
+			t.Errorf("%q valid should be %v", url, valid)
+		}
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, public := range map[string]bool{
+		"1.1.1.1":          true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.5.4":       false,
+		"192.168.0.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+	} {
+		if isPublicIP(net.ParseIP(ip)) != public {
+			t.Errorf("%s public should be %v", ip, public)
+		}
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "https://169.254.169.254/", http.StatusFound)
+		}))
+	defer server.Close()
+
+	// the test server is on loopback, so we can't even connect
+	_, err := webhookClient.Post(server.URL, "application/json", nil)
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("connected to a loopback address: %v", err)
+	}
+
+	// and when we connect, redirects aren't followed
+	client := *webhookClient
+	client.Transport = server.Client().Transport
+	resp, err := client.Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("got status %d, the redirect was followed", resp.StatusCode)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/fiatjaf/go-lnurl"
+)
+
+// NIP-57, zaps on lightning addresses. the zap request comes in the lnurl-pay
+// callback, gets committed to by the invoice description hash and once the
+// invoice is paid we publish a receipt signed by our own key.
+
+const (
+	ZapRequestKind = 9734
+	ZapReceiptKind = 9735
+)
+
+// maximum number of relays we'll publish a zap receipt to
+const maxZapRelays = 10
+
+type LNURLPayUserParams struct {
+	lnurl.LNURLPayParams
+	AllowsNostr bool   `json:"allowsNostr,omitempty"`
+	NostrPubkey string `json:"nostrPubkey,omitempty"`
+}
+
+func zapServiceKey() *btcec.PrivateKey {
+	seedhash := sha256.Sum256([]byte("zapservicekey:" + s.TelegramBotToken))
+	sk, _ := btcec.PrivKeyFromBytes(seedhash[:])
+	return sk
+}
+
+func zapServicePubKey() string {
+	return hex.EncodeToString(schnorrPubKey(zapServiceKey()))
+}
+
+// validateZapRequest checks the zap request as described in NIP-57 appendix D.
+func validateZapRequest(raw string, msatoshi int64) (zapRequest NostrEvent, err error) {
+	if err = json.Unmarshal([]byte(raw), &zapRequest); err != nil {
+		return zapRequest, errors.New("zap request is not valid JSON")
+	}
+	if zapRequest.Kind != ZapRequestKind {
+		return zapRequest, fmt.Errorf("zap request must be kind %d", ZapRequestKind)
+	}
+	if !zapRequest.CheckSignature() {
+		return zapRequest, errors.New("invalid zap request signature")
+	}
+
+	var ps, es, relays int
+	for _, tag := range zapRequest.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "p":
+			ps++
+		case "e":
+			es++
+		case "relays":
+			relays++
+		}
+	}
+	if ps != 1 {
+		return zapRequest, errors.New("zap request must have exactly one p tag")
+	}
+	if es > 1 {
+		return zapRequest, errors.New("zap request can't have more than one e tag")
+	}
+	if relays == 0 {
+		return zapRequest, errors.New("zap request must have a relays tag")
+	}
+
+	if amount := zapRequest.Tag("amount"); amount != "" {
+		if requested, err := strconv.ParseInt(amount, 10, 64); err != nil ||
+			requested != msatoshi {
+			return zapRequest, errors.New("zap request amount doesn't match")
+		}
+	}
+
+	return zapRequest, nil
+}
+
+func zapRelays(zapRequest NostrEvent) (relays []string) {
+	for _, tag := range zapRequest.Tags {
+		if len(tag) >= 2 && tag[0] == "relays" {
+			relays = append(relays, tag[1:]...)
+		}
+	}
+	if len(relays) > maxZapRelays {
+		relays = relays[:maxZapRelays]
+	}
+	return relays
+}
+
+// publishZapReceipt is called when an invoice that had a zap request is paid.
+// NIP-57 wants the receipt created_at to be the time the invoice was paid.
+func publishZapReceipt(hash string, data InvoiceData, paidAt time.Time) {
+	zapRequest, err := validateZapRequest(data.Extra.ZapRequest, data.Msatoshi)
+	if err != nil {
+		log.Warn().Err(err).Str("hash", hash).Msg("stored zap request is invalid")
+		return
+	}
+
+	receipt := NostrEvent{
+		Kind:      ZapReceiptKind,
+		CreatedAt: paidAt.Unix(),
+		Tags: [][]string{
+			{"p", zapRequest.Tag("p")},
+			{"P", zapRequest.PubKey},
+			{"bolt11", data.Bolt11},
+			{"description", data.Extra.ZapRequest},
+			{"preimage", data.Preimage},
+		},
+	}
+	for _, name := range []string{"e", "a"} {
+		if value := zapRequest.Tag(name); value != "" {
+			receipt.Tags = append(receipt.Tags, []string{name, value})
+		}
+	}
+	if err := receipt.Sign(zapServiceKey()); err != nil {
+		log.Warn().Err(err).Str("hash", hash).Msg("failed to sign zap receipt")
+		return
+	}
+
+	for _, url := range zapRelays(zapRequest) {
+		go func(url string) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			relay, err := connectRelay(url)
+			if err != nil {
+				log.Debug().Err(err).Str("relay", url).Msg("failed to connect to zap relay")
+				return
+			}
+			defer relay.Close()
+
+			if err := relay.Publish(ctx, receipt); err != nil {
+				log.Debug().Err(err).Str("relay", url).Msg("failed to publish zap receipt")
+			}
+		}(url)
+	}
+}
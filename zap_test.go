@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func TestZapReceipt(t *testing.T) {
+	previous := connectRelay
+	connectRelay = connectMemoryRelay
+	defer func() { connectRelay = previous }()
+
+	sender, _ := btcec.NewPrivateKey()
+	recipient := strings.Repeat("cd", 32)
+	zapped := strings.Repeat("ef", 32)
+
+	zapRequest := NostrEvent{
+		Kind: ZapRequestKind,
+		Tags: [][]string{
+			{"p", recipient},
+			{"e", zapped},
+			{"amount", "21000"},
+			{"relays", "wss://one.test", "wss://two.test"},
+		},
+		Content: "great post",
+	}
+	if err := zapRequest.Sign(sender); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	raw, _ := json.Marshal(zapRequest)
+
+	if _, err := validateZapRequest(string(raw), 20000); err == nil {
+		t.Error("zap request with another amount is valid")
+	}
+	if _, err := validateZapRequest(string(raw), 21000); err != nil {
+		t.Fatalf("zap request is invalid: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	receipts, _ := sharedMemoryRelay.Subscribe(ctx, NostrFilter{
+		Kinds: []int{ZapReceiptKind},
+		PTags: []string{recipient},
+	})
+
+	paidAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	data := InvoiceData{
+		Preimage: strings.Repeat("00", 32),
+		Bolt11:   "lnbc210n1zap",
+		MakeInvoiceArgs: &MakeInvoiceArgs{
+			Msatoshi: 21000,
+			Extra:    InvoiceExtra{ZapRequest: string(raw)},
+		},
+	}
+	publishZapReceipt(data.Hash(), data, paidAt)
+
+	var receipt NostrEvent
+	select {
+	case receipt = <-receipts:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no zap receipt on the relay")
+	}
+
+	if !receipt.CheckSignature() || receipt.PubKey != zapServicePubKey() {
+		t.Error("receipt isn't signed by the zap service key")
+	}
+	if receipt.CreatedAt != paidAt.Unix() {
+		t.Errorf("receipt created_at is %d, paid at %d", receipt.CreatedAt, paidAt.Unix())
+	}
+	for name, expected := range map[string]string{
+		"p":           recipient,
+		"P":           hex.EncodeToString(schnorrPubKey(sender)),
+		"e":           zapped,
+		"bolt11":      data.Bolt11,
+		"description": string(raw),
+		"preimage":    data.Preimage,
+	} {
+		if got := receipt.Tag(name); got != expected {
+			t.Errorf("receipt %s tag is %q", name, got)
+		}
+	}
+
+	// once per relay
+	select {
+	case <-receipts:
+	case <-time.After(2 * time.Second):
+		t.Error("receipt was published only once")
+	}
+}